@@ -0,0 +1,194 @@
+package retryablehttp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultAltSvcMaxAge is the freshness of alternative services without ma parameter
+const defaultAltSvcMaxAge = 24 * time.Hour
+
+// AltSvcEntry is an alternative service advertised by the Alt-Svc header (RFC 7838)
+type AltSvcEntry struct {
+	// Protocol is the ALPN protocol id of the alternative service (e.g. h3, h2)
+	Protocol string
+	// Authority is the host:port of the alternative service, the host is empty
+	// for the host of the origin (e.g. ":443")
+	Authority string
+	// MaxAge is the time the alternative service is fresh for (default: 24 hours)
+	MaxAge time.Duration
+	// Persist is set when the alternative service survives network changes
+	Persist bool
+}
+
+// ParseAltSvc returns the alternative services advertised by the Alt-Svc headers of the
+// response, none if the header is "clear". Malformed headers return the entries parsed
+// before the error along with it.
+func ParseAltSvc(resp *http.Response) ([]AltSvcEntry, error) {
+	if resp == nil {
+		return nil, nil
+	}
+	var entries []AltSvcEntry
+	for _, value := range resp.Header.Values("Alt-Svc") {
+		parsed, err := parseAltSvc(value)
+		entries = append(entries, parsed...)
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// HasHTTP2 returns true if the response advertises http/2 support via the Alt-Svc header
+func HasHTTP2(resp *http.Response) bool {
+	entries, _ := ParseAltSvc(resp)
+	for _, entry := range entries {
+		if entry.Protocol == "h2" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAltSvc parses a value of the Alt-Svc header
+func parseAltSvc(value string) ([]AltSvcEntry, error) {
+	if strings.EqualFold(strings.TrimSpace(value), "clear") {
+		return nil, nil
+	}
+	p := &altSvcParser{s: value}
+	var entries []AltSvcEntry
+	for {
+		p.skipSpace()
+		if p.done() {
+			return entries, nil
+		}
+		// empty list elements are allowed
+		if p.consume(',') {
+			continue
+		}
+		entry, err := p.entry()
+		if err != nil {
+			return entries, fmt.Errorf("alt-svc: %w", err)
+		}
+		entries = append(entries, entry)
+		p.skipSpace()
+		if !p.done() && !p.consume(',') {
+			return entries, fmt.Errorf("alt-svc: unexpected %q at %d", p.s[p.pos], p.pos)
+		}
+	}
+}
+
+// altSvcParser scans an Alt-Svc header value
+type altSvcParser struct {
+	s   string
+	pos int
+}
+
+// entry parses an alternative with its parameters
+func (p *altSvcParser) entry() (AltSvcEntry, error) {
+	protocol := p.token()
+	if protocol == "" || !p.consume('=') {
+		return AltSvcEntry{}, fmt.Errorf("missing protocol id at %d", p.pos)
+	}
+	// the protocol id is percent-encoded
+	protocol, err := url.PathUnescape(protocol)
+	if err != nil {
+		return AltSvcEntry{}, err
+	}
+	authority, err := p.value()
+	if err != nil {
+		return AltSvcEntry{}, err
+	}
+	entry := AltSvcEntry{Protocol: protocol, Authority: authority, MaxAge: defaultAltSvcMaxAge}
+
+	for {
+		p.skipSpace()
+		if !p.consume(';') {
+			return entry, nil
+		}
+		p.skipSpace()
+		name := p.token()
+		if name == "" || !p.consume('=') {
+			return entry, fmt.Errorf("malformed parameter at %d", p.pos)
+		}
+		value, err := p.value()
+		if err != nil {
+			return entry, err
+		}
+		switch strings.ToLower(name) {
+		case "ma":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return entry, fmt.Errorf("invalid ma %q", value)
+			}
+			entry.MaxAge = time.Duration(seconds) * time.Second
+		case "persist":
+			entry.Persist = value == "1"
+		}
+	}
+}
+
+// value parses a quoted-string or a token
+func (p *altSvcParser) value() (string, error) {
+	if !p.consume('"') {
+		if token := p.token(); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("missing value at %d", p.pos)
+	}
+	var value strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return value.String(), nil
+		case c == '\\' && !p.done():
+			value.WriteByte(p.s[p.pos])
+			p.pos++
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted string")
+}
+
+// token parses a token, empty if there is none at the position
+func (p *altSvcParser) token() string {
+	start := p.pos
+	for !p.done() && isTokenChar(p.s[p.pos]) {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+func (p *altSvcParser) consume(c byte) bool {
+	if !p.done() && p.s[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *altSvcParser) skipSpace() {
+	for !p.done() && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *altSvcParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+// isTokenChar reports whether c is a tchar of RFC 7230
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
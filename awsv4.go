@@ -0,0 +1,166 @@
+package retryablehttp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	readerutil "github.com/projectdiscovery/utils/reader"
+)
+
+const (
+	awsV4Algorithm       = "AWS4-HMAC-SHA256"
+	awsV4DateFormat      = "20060102T150405Z"
+	awsUnsignedPayload   = "UNSIGNED-PAYLOAD"
+	awsV4ContentSHA256   = "X-Amz-Content-Sha256"
+	awsV4DateHeader      = "X-Amz-Date"
+	awsV4RequestSuffix   = "aws4_request"
+	awsV4SecretPrefix    = "AWS4"
+	awsV4ShortDateFormat = "20060102"
+)
+
+// MiddlewareOnBeforeRequestSignAWSV4 signs requests with AWS Signature Version 4,
+// adding the Authorization and X-Amz-Date headers. Streaming request bodies are
+// sent as unsigned payload since they can't be read ahead.
+func MiddlewareOnBeforeRequestSignAWSV4(accessKey, secretKey, region, service string) ClientRequestMiddleware {
+	return func(client *Client, req *Request) error {
+		return signAWSV4(req, accessKey, secretKey, region, service, time.Now())
+	}
+}
+
+// signAWSV4 signs the request with AWS Signature Version 4 at the given time
+func signAWSV4(req *Request, accessKey, secretKey, region, service string, now time.Time) error {
+	payloadHash := awsUnsignedPayload
+	if req.streamBody == nil {
+		body, err := req.BodyBytes()
+		if err != nil {
+			return err
+		}
+		// reusable bodies rewind once fully read, others are replaced
+		if _, ok := req.Request.Body.(*readerutil.ReusableReadCloser); !ok && body != nil {
+			if err := req.SetBody(body); err != nil {
+				return err
+			}
+		}
+		payloadHash = hashSHA256Hex(body)
+	}
+
+	now = now.UTC()
+	amzDate := now.Format(awsV4DateFormat)
+	req.Header.Set(awsV4DateHeader, amzDate)
+	if service == "s3" {
+		req.Header.Set(awsV4ContentSHA256, payloadHash)
+	}
+
+	host := req.Request.Host
+	if host == "" {
+		host = req.Request.URL.Host
+	}
+	headers := map[string]string{
+		"host":                           host,
+		strings.ToLower(awsV4DateHeader): amzDate,
+	}
+	if service == "s3" {
+		headers[strings.ToLower(awsV4ContentSHA256)] = payloadHash
+	}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		headers["x-amz-security-token"] = token
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Request.Method,
+		awsV4CanonicalURI(req.Request.URL, service != "s3"),
+		awsV4CanonicalQuery(req.Request.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	shortDate := now.Format(awsV4ShortDateFormat)
+	scope := strings.Join([]string{shortDate, region, service, awsV4RequestSuffix}, "/")
+	stringToSign := strings.Join([]string{
+		awsV4Algorithm,
+		amzDate,
+		scope,
+		hashSHA256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte(awsV4SecretPrefix+secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, awsV4RequestSuffix)
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", awsV4Algorithm, accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsV4CanonicalURI returns the uri encoded path, path segments are encoded twice
+// for all services but s3
+func awsV4CanonicalURI(u *url.URL, doubleEncode bool) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segment = awsV4URIEncode(segment)
+		if doubleEncode {
+			segment = awsV4URIEncode(segment)
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, "/")
+}
+
+// awsV4CanonicalQuery returns the query parameters uri encoded and sorted by name and value
+func awsV4CanonicalQuery(u *url.URL) string {
+	params := make([]string, 0)
+	for name, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, awsV4URIEncode(name)+"="+awsV4URIEncode(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsV4URIEncode percent encodes all characters but the rfc 3986 unreserved ones
+func awsV4URIEncode(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		ch := value[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			sb.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", ch)
+		}
+	}
+	return sb.String()
+}
+
+func hashSHA256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
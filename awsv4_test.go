@@ -0,0 +1,55 @@
+package retryablehttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAWSV4(t *testing.T) {
+	// vectors from the aws signature version 4 test suite
+	tests := []struct {
+		url       string
+		signature string
+	}{
+		{"https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, test := range tests {
+		req, err := NewRequest(http.MethodGet, test.url, nil)
+		require.Nil(t, err)
+		err = signAWSV4(req, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+		require.Nil(t, err)
+		require.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+		require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature="+test.signature, req.Header.Get("Authorization"))
+	}
+}
+
+func TestMiddlewareOnBeforeRequestSignAWSV4_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{})
+	client.OnBeforeRequest = append(client.OnBeforeRequest, MiddlewareOnBeforeRequestSignAWSV4("AKID", "secret", "us-east-1", "sts"))
+
+	// the body is hashed and still sent in full
+	resp, err := client.Post(ts.URL, "application/x-www-form-urlencoded", strings.NewReader("Action=GetCallerIdentity"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "Action=GetCallerIdentity", string(body))
+}
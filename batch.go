@@ -0,0 +1,47 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// BatchResult is the outcome of a request sent by DoBatch
+type BatchResult struct {
+	// Request is the originating request
+	Request *Request
+	// Response is the response of the request, its body must be closed by the caller
+	Response *http.Response
+	// Err is the error returned by Do
+	Err error
+}
+
+// DoBatch sends the requests concurrently with at most concurrency of them in flight
+// and returns their results in the same order as the requests. A request whose context
+// is done while waiting for a slot is not sent and its result holds the context error.
+// Connections are reused across the requests unless the client kills idle connections.
+func (c *Client) DoBatch(reqs []*Request, concurrency int) []BatchResult {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := semaphore.NewWeighted(int64(concurrency))
+
+	results := make([]BatchResult, len(reqs))
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		results[i].Request = req
+		if err := sem.Acquire(req.Context(), 1); err != nil {
+			results[i].Err = err
+			continue
+		}
+		wg.Add(1)
+		go func(result *BatchResult) {
+			defer wg.Done()
+			defer sem.Release(1)
+			result.Response, result.Err = c.Do(result.Request)
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,278 @@
+package retryablehttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bodyTimeoutError is returned when reading a response body exceeds a time limit.
+// It implements net.Error and reports itself as a timeout.
+type bodyTimeoutError struct {
+	msg string
+}
+
+func (e *bodyTimeoutError) Error() string   { return e.msg }
+func (e *bodyTimeoutError) Timeout() bool   { return true }
+func (e *bodyTimeoutError) Temporary() bool { return true }
+
+// ErrBodyIdleTimeout is returned when reading from a response body receives no
+// bytes for longer than Options.ResponseBodyIdleTimeout
+var ErrBodyIdleTimeout error = &bodyTimeoutError{msg: "response body idle timeout exceeded"}
+
+// ErrBodyReadTimeout is returned when reading a response body takes longer than
+// Options.MaxBodyReadDuration in total
+var ErrBodyReadTimeout error = &bodyTimeoutError{msg: "response body read timeout exceeded"}
+
+// defaultBodyPeekLimit is the number of bytes of the response body peeked by
+// CheckRetryWithBody when neither BodyPeekLimit nor RespReadLimit are set
+const defaultBodyPeekLimit = 4096
+
+// defaultBodyPeekTimeout is the time waited for the peeked bytes of the response
+// body when BodyPeekTimeout isn't set
+const defaultBodyPeekTimeout = time.Second
+
+// defaultPartialResponseReadLimit is the size of the response body read in memory by
+// RetryOnPartialResponse when PartialResponseReadLimit isn't set
+const defaultPartialResponseReadLimit = 10 << 20
+
+// wrapResponseBody wraps the body of the response returned to the caller
+// according to the client options
+func (c *Client) wrapResponseBody(req *Request, resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	// with RetryOnPartialResponse the body was wrapped before being read by the attempt
+	if !c.options.RetryOnPartialResponse {
+		c.wrapBodyTimeouts(resp)
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, count: &req.Metrics.ResponseBodyBytes}
+}
+
+// wrapBodyTimeouts wraps the body of the response with the read time limits of the
+// client options
+func (c *Client) wrapBodyTimeouts(resp *http.Response) {
+	if counter := redirectBytesFrom(resp.Request); counter != nil {
+		resp.Body = &redirectBytesBody{ReadCloser: resp.Body, counter: counter}
+	}
+	if c.options.ResponseBodyIdleTimeout > 0 {
+		resp.Body = newIdleTimeoutBody(resp.Body, c.options.ResponseBodyIdleTimeout)
+	}
+	if c.options.MaxBodyReadDuration > 0 {
+		resp.Body = &readTimeoutBody{body: resp.Body, remaining: c.options.MaxBodyReadDuration}
+	}
+}
+
+// readFullBody reads up to limit bytes of the body of the response in memory, so that
+// truncated bodies fail the attempt instead of the reads of the caller. The rest of
+// larger bodies is streamed as is.
+func readFullBody(resp *http.Response, limit int64) error {
+	body := resp.Body
+	data, err := io.ReadAll(io.LimitReader(body, limit))
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("%w: %w", ErrPartialResponse, err)
+	}
+	if int64(len(data)) < limit {
+		body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return nil
+	}
+	resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(data), body), body: body}
+	return nil
+}
+
+// peekBody reads up to limit bytes of the response body, waiting for them at most
+// timeout when set, and puts them back in front of the unread remainder of the body,
+// which is streamed as is. Once the timeout expires the peek stops: the caller reads
+// the bytes peeked so far, then the body as it arrives. An error reading the peeked
+// bytes is returned by the body once they're read. The peek buffer grows with the
+// bytes read, so large limits don't allocate for short bodies.
+func peekBody(resp *http.Response, limit int64, timeout time.Duration) []byte {
+	body := &peekingBody{body: resp.Body, done: make(chan struct{})}
+	go body.fill(limit)
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-body.done:
+		case <-timer.C:
+		}
+	} else {
+		<-body.done
+	}
+	resp.Body = body
+	return body.stop()
+}
+
+// peekingBody reads the peeked bytes before the rest of the body
+type peekingBody struct {
+	body io.ReadCloser
+	// done is closed once fill stopped reading the body
+	done chan struct{}
+
+	mu      sync.Mutex
+	peek    bytes.Buffer
+	err     error
+	stopped bool
+}
+
+// fill reads up to limit bytes of the body in the peek buffer, until stopped
+func (b *peekingBody) fill(limit int64) {
+	defer close(b.done)
+	chunk := make([]byte, min(limit, 32<<10))
+	for read := int64(0); read < limit; {
+		n, err := b.body.Read(chunk[:min(int64(len(chunk)), limit-read)])
+		read += int64(n)
+		b.mu.Lock()
+		b.peek.Write(chunk[:n])
+		b.err = err
+		stopped := b.stopped
+		b.mu.Unlock()
+		if err != nil || stopped {
+			return
+		}
+	}
+}
+
+// stop stops the peek once the read in progress completes and returns a copy of
+// the bytes peeked so far
+func (b *peekingBody) stop() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	return bytes.Clone(b.peek.Bytes())
+}
+
+// readPeeked reads the peeked bytes, ok is false once there are none left
+func (b *peekingBody) readPeeked(p []byte) (n int, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.peek.Len() > 0 {
+		n, _ = b.peek.Read(p)
+		return n, true, nil
+	}
+	return 0, false, b.err
+}
+
+func (b *peekingBody) Read(p []byte) (int, error) {
+	if n, ok, _ := b.readPeeked(p); ok {
+		return n, nil
+	}
+	// the body is read directly once the read of the peek in progress completed
+	<-b.done
+	if n, ok, err := b.readPeeked(p); ok || err != nil {
+		return n, err
+	}
+	return b.body.Read(p)
+}
+
+func (b *peekingBody) Close() error {
+	return b.body.Close()
+}
+
+// countingBody adds the bytes read from the body to count
+type countingBody struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.count, int64(n))
+	return n, err
+}
+
+// idleTimeoutBody aborts the underlying body when no bytes are read from it
+// within the timeout. The timer starts with the first read.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+
+	start    sync.Once
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration) *idleTimeoutBody {
+	return &idleTimeoutBody{body: body, timeout: timeout}
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.start.Do(func() {
+		b.timer = time.AfterFunc(b.timeout, func() {
+			b.timedOut.Store(true)
+			// closing the body unblocks pending reads and drops the connection
+			b.body.Close()
+		})
+	})
+
+	n, err := b.body.Read(p)
+	if b.timedOut.Load() {
+		return n, ErrBodyIdleTimeout
+	}
+	if err != nil {
+		b.timer.Stop()
+	} else if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.start.Do(func() {})
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.body.Close()
+}
+
+// readTimeoutBody aborts the underlying body once the time spent in its reads
+// adds up to more than the budget
+type readTimeoutBody struct {
+	body      io.ReadCloser
+	remaining time.Duration
+	timer     *time.Timer
+	timedOut  atomic.Bool
+}
+
+func (b *readTimeoutBody) Read(p []byte) (int, error) {
+	if b.timedOut.Load() {
+		return 0, ErrBodyReadTimeout
+	}
+	if b.remaining <= 0 {
+		b.expire()
+		return 0, ErrBodyReadTimeout
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.remaining, b.expire)
+	} else {
+		b.timer.Reset(b.remaining)
+	}
+
+	start := time.Now()
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	b.remaining -= time.Since(start)
+	if b.timedOut.Load() {
+		return n, ErrBodyReadTimeout
+	}
+	return n, err
+}
+
+// expire closes the body, which unblocks pending reads and drops the connection
+func (b *readTimeoutBody) expire() {
+	b.timedOut.Store(true)
+	b.body.Close()
+}
+
+func (b *readTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	return b.body.Close()
+}
@@ -3,10 +3,14 @@ package buggyhttp
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -94,6 +98,34 @@ func superSlow(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// SO MANY TINY DELAYS
+// writes `bytes` bytes (default 10) waiting `delayMs` milliseconds (default 100) between each of them
+func trickle(w http.ResponseWriter, req *http.Request) {
+	delay := 100 * time.Millisecond
+	if v, err := strconv.Atoi(req.FormValue("delayMs")); err == nil && v >= 0 {
+		delay = time.Duration(v) * time.Millisecond
+	}
+	size := 10
+	if v, err := strconv.Atoi(req.FormValue("bytes")); err == nil && v >= 0 {
+		size = v
+	}
+
+	z := w.(http.Flusher)
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.WriteHeader(http.StatusOK)
+	z.Flush()
+	for i := 0; i < size; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := w.Write([]byte("a")); err != nil {
+			// this allows to quit the go routine when the client disconnects
+			break
+		}
+		z.Flush()
+	}
+}
+
 // simulates server closing immediately the connection without reply
 func emptyResponse(w http.ResponseWriter, req *http.Request) {
 	hj, _ := w.(http.Hijacker)
@@ -124,13 +156,87 @@ func unexpectedEOF(w http.ResponseWriter, req *http.Request) {
 	bufrw.Flush()
 }
 
+// announces a body longer than the one sent before closing the connection
+func truncatedBody(w http.ResponseWriter, req *http.Request) {
+	hj, _ := w.(http.Hijacker)
+	conn, bufrw, _ := hj.Hijack()
+	defer conn.Close()
+	_, _ = bufrw.WriteString("HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 10\r\n" +
+		"\r\n" +
+		"foo")
+	bufrw.Flush()
+}
+
+// echoes the request body followed by the received trailers, one "Key: value" per line
+func echoTrailer(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", body)
+	for name, values := range req.Trailer {
+		for _, value := range values {
+			fmt.Fprintf(w, "%v: %v\n", name, value)
+		}
+	}
+}
+
+// replies with 100 Continue before reading the body, then 200 with the length of the body.
+// Requests without Expect: 100-continue are rejected with 417.
+func expectContinue(w http.ResponseWriter, req *http.Request) {
+	if !strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+		w.WriteHeader(http.StatusExpectationFailed)
+		return
+	}
+	w.WriteHeader(http.StatusContinue)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%d", len(body))
+}
+
+// rejects uploads with 413 without reading the body
+func rejectUpload(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+}
+
+// sends 103 Early Hints with a preload link before the final 200
+func earlyHints(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+	w.WriteHeader(http.StatusEarlyHints)
+	fmt.Fprintf(w, "foo")
+}
+
+// Simulate a waf block page served with a 200 status
+func blocked(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprintf(w, "<html><head><title>Access Denied</title></head><body>Request blocked by the web application firewall</body></html>")
+}
+
 // Simulate normal 200 answer with body
 func foo(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "foo")
 }
 
+var (
+	// count is the number of requests received by successAfter since the last success
+	count   int
+	countMu sync.Mutex
+)
+
+// Reset zeroes the requests counter of the successAfter handler, which is shared by
+// all its callers. Tests relying on successAfter should call it first.
+func Reset() {
+	countMu.Lock()
+	defer countMu.Unlock()
+	count = 0
+}
+
 // generates recoverable errors until SuccessAfter attempts => after it 200 + body
-var count int // as of now a local horrible variable suffice
 func successAfter(w http.ResponseWriter, req *http.Request) {
 	var successAfter int = defaultSuccessAfterThreshold
 	if req.FormValue("successAfter") != "" {
@@ -139,8 +245,16 @@ func successAfter(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	countMu.Lock()
 	count++
-	if count <= successAfter {
+	fail := count <= successAfter
+	if !fail {
+		// zeroes attempts and return 200 + valid body
+		count = 0
+	}
+	countMu.Unlock()
+
+	if fail {
 		hj, _ := w.(http.Hijacker)
 		conn, bufrw, _ := hj.Hijack()
 		defer conn.Close()
@@ -157,8 +271,6 @@ func successAfter(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// zeroes attempts and return 200 + valid body
-	count = 0
 	fmt.Fprintf(w, "foo")
 }
 
@@ -169,37 +281,65 @@ var (
 	serverTLS *http.Server
 )
 
-// Listen on specified port
-func Listen(port int) {
+// Listen on specified port, 0 picks an ephemeral one. The listener is bound before
+// returning so the server accepts connections as soon as Listen returns.
+// It returns the port the server listens on.
+func Listen(port int) (int, error) {
+	Reset()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/foo", foo)
 	mux.HandleFunc("/successAfter", successAfter)
 	mux.HandleFunc("/emptyResponse", emptyResponse)
 	mux.HandleFunc("/unexpectedEOF", unexpectedEOF)
+	mux.HandleFunc("/truncatedBody", truncatedBody)
 	mux.HandleFunc("/endlessBody", endlessBody)
 	mux.HandleFunc("/endlessWaitTime", endlessWaitTime)
 	mux.HandleFunc("/superSlow", superSlow)
+	mux.HandleFunc("/trickle", trickle)
 	mux.HandleFunc("/messyHeaders", messyHeaders)
 	mux.HandleFunc("/messyEncoding", messyEncoding)
 	mux.HandleFunc("/infiniteRedirects", infiniteRedirects)
+	mux.HandleFunc("/echoTrailer", echoTrailer)
+	mux.HandleFunc("/blocked", blocked)
+	mux.HandleFunc("/expectContinue", expectContinue)
+	mux.HandleFunc("/rejectUpload", rejectUpload)
+	mux.HandleFunc("/earlyHints", earlyHints)
 
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return 0, err
+	}
 	server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
+		Addr:    listener.Addr().String(),
 		Handler: mux,
 	}
 
-	go server.ListenAndServe() //nolint
+	go server.Serve(listener) //nolint
+	return listener.Addr().(*net.TCPAddr).Port, nil
 }
 
-// ListenTLS because buggyhttp also supports bugged TLS
-func ListenTLS(port int, certFile, keyFile string) {
+// ListenTLS because buggyhttp also supports bugged TLS.
+// Like Listen it binds the listener, and loads the certificate, before returning.
+func ListenTLS(port int, certFile, keyFile string) (int, error) {
+	Reset()
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return 0, err
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return 0, err
+	}
 	serverTLS = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: newMux(),
+		Addr:      listener.Addr().String(),
+		Handler:   newMux(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
 	}
 
-	go serverTLS.ListenAndServeTLS(certFile, keyFile) //nolint
+	go serverTLS.Serve(tls.NewListener(listener, serverTLS.TLSConfig)) //nolint
+	return listener.Addr().(*net.TCPAddr).Port, nil
 }
 
 func newMux() *http.ServeMux {
@@ -208,11 +348,18 @@ func newMux() *http.ServeMux {
 	mux.HandleFunc("/successAfter", successAfter)
 	mux.HandleFunc("/emptyResponse", emptyResponse)
 	mux.HandleFunc("/unexpectedEOF", unexpectedEOF)
+	mux.HandleFunc("/truncatedBody", truncatedBody)
 	mux.HandleFunc("/endlessBody", endlessBody)
 	mux.HandleFunc("/endlessWaitTime", endlessWaitTime)
 	mux.HandleFunc("/superSlow", superSlow)
+	mux.HandleFunc("/trickle", trickle)
 	mux.HandleFunc("/messyHeaders", messyHeaders)
 	mux.HandleFunc("/infiniteRedirects", infiniteRedirects)
+	mux.HandleFunc("/echoTrailer", echoTrailer)
+	mux.HandleFunc("/blocked", blocked)
+	mux.HandleFunc("/expectContinue", expectContinue)
+	mux.HandleFunc("/rejectUpload", rejectUpload)
+	mux.HandleFunc("/earlyHints", earlyHints)
 	return mux
 }
 
@@ -22,8 +22,14 @@ func WaitForCtrlC() {
 }
 
 func main() {
-	buggyhttp.Listen(8080)
-	buggyhttp.ListenTLS(8081, "server.crt", "server.key")
+	if _, err := buggyhttp.Listen(8080); err != nil {
+		fmt.Fprintf(os.Stderr, "could not listen: %s\n", err)
+		os.Exit(1)
+	}
+	if _, err := buggyhttp.ListenTLS(8081, "server.crt", "server.key"); err != nil {
+		fmt.Fprintf(os.Stderr, "could not listen with tls: %s\n", err)
+		os.Exit(1)
+	}
 	fmt.Printf("Press Ctrl+C to end\n")
 	WaitForCtrlC()
 	fmt.Printf("\n")
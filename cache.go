@@ -0,0 +1,416 @@
+package retryablehttp
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheMaxBodySize is the size of the largest response body stored in the cache
+const cacheMaxBodySize = 8 << 20
+
+// ResponseCache stores the responses of GET and HEAD requests, see Options.Cache.
+// Implementations must be safe for concurrent use.
+type ResponseCache interface {
+	// Get returns the response stored for key, if any
+	Get(key string) (*CachedResponse, bool)
+	// Set stores the response for key
+	Set(key string, response *CachedResponse)
+}
+
+// CachedResponse is a response stored in a ResponseCache
+type CachedResponse struct {
+	StatusCode    int
+	Proto         string
+	ProtoMajor    int
+	ProtoMinor    int
+	Header        http.Header
+	Body          []byte
+	ContentLength int64
+	// Expires is the time the response becomes stale at, it's revalidated afterwards
+	// if it has an ETag
+	Expires time.Time
+	// Vary are the values of the request headers named by the Vary header of the response
+	Vary map[string]string
+}
+
+// fresh reports whether the response can be served without revalidation
+func (r *CachedResponse) fresh(now time.Time) bool {
+	return now.Before(r.Expires)
+}
+
+// matches reports whether the request has the values of the headers the response varies on
+func (r *CachedResponse) matches(req *http.Request) bool {
+	for name, value := range r.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns a new response to req with the stored status, headers and body
+func (r *CachedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(r.StatusCode) + " " + http.StatusText(r.StatusCode),
+		StatusCode:    r.StatusCode,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+		Header:        r.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: r.ContentLength,
+		Request:       req,
+	}
+}
+
+// size returns the approximate memory size of the response
+func (r *CachedResponse) size() int64 {
+	size := int64(len(r.Body))
+	for name, values := range r.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// LRUCache is an in-memory ResponseCache evicting the least recently used responses
+type LRUCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	entries    map[string]*list.Element
+	order      *list.List
+}
+
+// lruEntry is an element of the recency list of LRUCache
+type lruEntry struct {
+	key      string
+	response *CachedResponse
+}
+
+// NewLRUCache returns an LRUCache holding up to maxEntries responses whose headers and
+// bodies take up to maxBytes
+func NewLRUCache(maxEntries int, maxBytes int64) *LRUCache {
+	return &LRUCache{
+		maxEntries: max(maxEntries, 1),
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// Get returns the response stored for key, if any
+func (c *LRUCache) Get(key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*lruEntry).response, true
+}
+
+// Set stores the response for key, evicting the least recently used ones when full.
+// Responses larger than the cache aren't stored.
+func (c *LRUCache) Set(key string, response *CachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	if response.size() > c.maxBytes {
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, response: response})
+	c.size += response.size()
+	for c.order.Len() > c.maxEntries || c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the element from the cache
+func (c *LRUCache) remove(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.response.size()
+}
+
+// Len returns the number of stored responses
+func (c *LRUCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// cacheLookup is the state of a request using the cache
+type cacheLookup struct {
+	key string
+	// stale is the stored response revalidated by the request
+	stale *CachedResponse
+	// restore removes the If-None-Match header added for the revalidation
+	restore func()
+}
+
+// lookupCache returns the fresh response stored for the request, or the lookup
+// storing the response of the request once sent, nil if the cache doesn't apply.
+// The cache is shared by the requests of the client, the authenticated ones
+// don't use it.
+func (c *Client) lookupCache(req *Request) (*http.Response, *cacheLookup) {
+	req.Metrics.FromCache = false
+	// with RetryMiddlewareErrors the headers are only known once the attempts run the middlewares
+	if c.options.Cache == nil || c.options.RetryMiddlewareErrors || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil, nil
+	}
+	// a stored full response can't answer a range request
+	if req.Header.Get("Authorization") != "" || req.Header.Get("Cookie") != "" || req.Header.Get("Range") != "" {
+		return nil, nil
+	}
+	if jar := c.HTTPClient.Jar; jar != nil && len(jar.Cookies(req.Request.URL)) > 0 {
+		return nil, nil
+	}
+	directives := parseCacheControl(req.Header)
+	if _, ok := directives["no-store"]; ok {
+		return nil, nil
+	}
+	lookup := &cacheLookup{key: c.cacheKey(req), restore: func() {}}
+	stored, ok := c.options.Cache.Get(lookup.key)
+	if !ok || !stored.matches(req.Request) {
+		return nil, lookup
+	}
+	if _, noCache := directives["no-cache"]; !noCache && stored.fresh(time.Now()) {
+		req.Metrics.FromCache = true
+		return stored.response(req.Request), nil
+	}
+	// the caller's own conditional requests get the 304
+	etag := stored.Header.Get("ETag")
+	if etag != "" && req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		req.Header.Set("If-None-Match", etag)
+		lookup.stale = stored
+		lookup.restore = func() {
+			req.Header.Del("If-None-Match")
+		}
+	}
+	return nil, lookup
+}
+
+// cacheKey returns the key of the responses to the request in the cache. Virtual hosts
+// served by the same address and hosts dialed to another address with HostsMap don't
+// share their responses.
+func (c *Client) cacheKey(req *Request) string {
+	key := req.Method + " " + req.URL.String()
+	if host := req.Request.Host; host != "" && host != req.Request.URL.Host {
+		key += " host=" + host
+	}
+	hostname := req.Request.URL.Hostname()
+	ip, ok := c.options.HostsMap[hostname]
+	if !ok {
+		ip, ok = c.options.HostsMap[strings.ToLower(hostname)]
+	}
+	if ok {
+		key += " addr=" + ip
+	}
+	return key
+}
+
+// storeCache stores the response of the request in the cache and returns the response
+// for the caller, the stored one if it was revalidated
+func (c *Client) storeCache(req *Request, lookup *cacheLookup, resp *http.Response) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	now := time.Now()
+	if lookup.stale != nil && resp.StatusCode == http.StatusNotModified {
+		_, _ = DiscardN(req, resp, c.options.RespReadLimit)
+		// the 304 headers update the stored ones
+		updated := *lookup.stale
+		updated.Header = lookup.stale.Header.Clone()
+		for name, values := range resp.Header {
+			updated.Header[name] = values
+		}
+		updated.Expires = now.Add(freshnessLifetime(updated.Header, now))
+		c.options.Cache.Set(lookup.key, &updated)
+		req.Metrics.FromCache = true
+		return updated.response(req.Request)
+	}
+	if !cacheableStatus(resp.StatusCode) {
+		return resp
+	}
+	// private responses are meant for a single user, those setting cookies would skip the jar
+	directives := parseCacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return resp
+	}
+	if _, ok := directives["private"]; ok || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return resp
+	}
+	lifetime := freshnessLifetime(resp.Header, now)
+	if lifetime <= 0 && resp.Header.Get("ETag") == "" {
+		return resp
+	}
+	vary, ok := varyValues(req.Request, resp.Header)
+	if !ok {
+		return resp
+	}
+
+	entry := &CachedResponse{
+		StatusCode:    resp.StatusCode,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        resp.Header.Clone(),
+		ContentLength: resp.ContentLength,
+		Expires:       now.Add(lifetime),
+		Vary:          vary,
+	}
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		c.options.Cache.Set(lookup.key, entry)
+		return resp
+	}
+	// the body is stored once the caller read all of it
+	resp.Body = &cachingBody{body: resp.Body, store: func(data []byte) {
+		entry.Body = data
+		entry.ContentLength = int64(len(data))
+		c.options.Cache.Set(lookup.key, entry)
+	}}
+	return resp
+}
+
+// cacheableStatus reports whether responses with the status code can be stored (RFC 9110 15.1)
+func cacheableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound, http.StatusMethodNotAllowed,
+		http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// freshnessLifetime returns the time the response stays fresh for from Cache-Control max-age
+// or Expires, less its Age. Responses with no-cache or without either are stale right away.
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	directives := parseCacheControl(header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	var lifetime time.Duration
+	if maxAge, ok := directives["max-age"]; ok {
+		seconds, err := strconv.ParseInt(maxAge, 10, 64)
+		if err != nil {
+			return 0
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expiresAt.Sub(date)
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return lifetime
+}
+
+// parseCacheControl returns the directives of the Cache-Control headers with their
+// values, empty for directives without one
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return directives
+}
+
+// varyValues returns the values of the request headers the response varies on, false
+// if the response can't be stored because it varies on everything
+func varyValues(req *http.Request, header http.Header) (map[string]string, bool) {
+	var vary map[string]string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name == "" {
+				continue
+			}
+			if vary == nil {
+				vary = make(map[string]string)
+			}
+			vary[name] = req.Header.Get(name)
+		}
+	}
+	return vary, true
+}
+
+// cachingBody copies the body read by the caller and stores it once fully read,
+// bodies larger than cacheMaxBodySize or failing to be read aren't stored
+type cachingBody struct {
+	body     io.ReadCloser
+	data     []byte
+	overflow bool
+	stored   bool
+	store    func(data []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if !b.overflow && !b.stored {
+		if len(b.data)+n > cacheMaxBodySize {
+			b.overflow, b.data = true, nil
+		} else {
+			b.data = append(b.data, p[:n]...)
+		}
+	}
+	if err == io.EOF && !b.overflow && !b.stored {
+		b.stored = true
+		b.store(b.data)
+	}
+	return n, err
+}
+
+func (b *cachingBody) Close() error {
+	return b.body.Close()
+}
+
+// prefixedBody reads the bytes read while trying to cache the body before the rest of it
+type prefixedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *prefixedBody) Close() error {
+	return b.body.Close()
+}
+
+// errorReader returns err on reads
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
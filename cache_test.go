@@ -0,0 +1,189 @@
+package retryablehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2, 1<<20)
+	cache.Set("a", &CachedResponse{StatusCode: http.StatusOK})
+	cache.Set("b", &CachedResponse{StatusCode: http.StatusOK})
+	_, ok := cache.Get("a")
+	require.True(t, ok)
+	// b is the least recently used
+	cache.Set("c", &CachedResponse{StatusCode: http.StatusOK})
+	require.Equal(t, 2, cache.Len())
+	_, ok = cache.Get("b")
+	require.False(t, ok)
+	_, ok = cache.Get("a")
+	require.True(t, ok)
+	_, ok = cache.Get("c")
+	require.True(t, ok)
+
+	// the cache is bounded by the size of the responses too
+	cache = NewLRUCache(10, 10)
+	cache.Set("a", &CachedResponse{Body: []byte("12345")})
+	cache.Set("b", &CachedResponse{Body: []byte("12345")})
+	cache.Set("c", &CachedResponse{Body: []byte("12345")})
+	require.Equal(t, 2, cache.Len())
+	_, ok = cache.Get("a")
+	require.False(t, ok)
+	cache.Set("d", &CachedResponse{Body: []byte("12345678901")})
+	_, ok = cache.Get("d")
+	require.False(t, ok)
+	require.Equal(t, 2, cache.Len())
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second},
+		{http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Expires": {"0"}}, time.Minute},
+		{http.Header{"Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}, "Date": {now.UTC().Format(http.TimeFormat)}}, time.Hour},
+		{http.Header{"Expires": {"0"}}, 0},
+		{http.Header{}, 0},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.lifetime, freshnessLifetime(test.header, now), test.header)
+	}
+}
+
+func TestCache_Do(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, requests.Load())
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, Cache: NewLRUCache(10, 1<<20)})
+	var afterResponse atomic.Int32
+	client.OnAfterResponse = append(client.OnAfterResponse, func(_ *Client, _ *Request, _ *http.Response) error {
+		afterResponse.Add(1)
+		return nil
+	})
+	get := func(path string, headers ...string) (*Request, *http.Response, string) {
+		req, err := NewRequest(http.MethodGet, ts.URL+path, nil)
+		require.Nil(t, err)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		return req, resp, string(body)
+	}
+
+	// fresh responses are served without a request
+	req, _, body := get("/fresh")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/fresh 1", body)
+	req, resp, body := get("/fresh")
+	require.True(t, req.Metrics.FromCache)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "/fresh 1", body)
+	require.Equal(t, int32(1), requests.Load())
+	// the served responses go through the middlewares
+	require.Equal(t, int32(2), afterResponse.Load())
+
+	// authenticated requests don't use the cache
+	req, _, body = get("/fresh", "Authorization", "Bearer token")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/fresh 2", body)
+	req, _, _ = get("/fresh", "Cookie", "session=1")
+	require.False(t, req.Metrics.FromCache)
+
+	// stale responses are revalidated
+	_, _, body = get("/etag")
+	require.Equal(t, "/etag 4", body)
+	req, resp, body = get("/etag")
+	require.True(t, req.Metrics.FromCache)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "/etag 4", body)
+	require.Equal(t, int32(5), requests.Load())
+	require.Empty(t, req.Header.Get("If-None-Match"))
+
+	// no-store responses are not stored
+	get("/no-store")
+	req, _, body = get("/no-store")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/no-store 7", body)
+
+	// nor are private ones
+	get("/private")
+	req, _, body = get("/private")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/private 9", body)
+
+	// nor are the responses of other methods served from the cache
+	req, err := NewRequest(http.MethodPost, ts.URL+"/fresh", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, int32(10), requests.Load())
+
+	// virtual hosts of the same address don't share their responses
+	for i := 0; i < 2; i++ {
+		req, err = NewRequest(http.MethodGet, ts.URL+"/fresh", nil)
+		require.Nil(t, err)
+		req.SetHostHeader("vhost.example.com")
+		resp, err = client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, i == 1, req.Metrics.FromCache)
+		require.Equal(t, "/fresh 11", string(body))
+	}
+
+	// the stored full response doesn't answer range requests
+	req, _, body = get("/fresh", "Range", "bytes=0-1")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/fresh 12", body)
+
+	// bodies are only stored once read by the caller, which reads them as they arrive
+	req, err = NewRequest(http.MethodGet, ts.URL+"/fresh?unread", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Zero(t, req.Metrics.ResponseBodyBytes)
+	req, _, body = get("/fresh?unread")
+	require.False(t, req.Metrics.FromCache)
+	require.Equal(t, "/fresh 14", body)
+	req, _, body = get("/fresh?unread")
+	require.True(t, req.Metrics.FromCache)
+	require.Equal(t, "/fresh 14", body)
+}
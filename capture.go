@@ -0,0 +1,41 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"net/http/httputil"
+)
+
+// Exchange is the request/response exchange captured when CaptureExchange is enabled
+type Exchange struct {
+	// Request is the dump of the request sent by the final attempt
+	Request []byte
+	// Response is the dump of the final response including the beginning of its body,
+	// nil if there is none
+	Response []byte
+	// AttemptErrors are the errors of the failed attempts in order
+	AttemptErrors []error
+}
+
+// captureExchange dumps the final request and response of the exchange. Up to RespReadLimit
+// bytes of the response body received within BodyPeekTimeout are captured (4096 if unset),
+// which remain readable by the caller.
+func (c *Client) captureExchange(req *Request, resp *http.Response) {
+	if dump, err := req.Dump(); err == nil {
+		req.Exchange.Request = dump
+	}
+	if resp == nil {
+		return
+	}
+	dump, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return
+	}
+	if resp.Body != nil && resp.Body != http.NoBody {
+		limit := c.options.RespReadLimit
+		if limit <= 0 {
+			limit = defaultBodyPeekLimit
+		}
+		dump = append(dump, peekBody(resp, limit, c.options.bodyPeekTimeout())...)
+	}
+	req.Exchange.Response = dump
+}
@@ -0,0 +1,145 @@
+package retryablehttp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Client.Do when the circuit breaker of the
+// target host is open and the request was not sent
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerOptions contains configuration options for the per host circuit breaker
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failed attempts after which
+	// the circuit of a host is opened
+	FailureThreshold int
+	// ResetTimeout is the time after which an open circuit becomes half-open
+	// and a single probe request is allowed through
+	ResetTimeout time.Duration
+}
+
+// CircuitState is the state of a host circuit breaker
+type CircuitState uint8
+
+const (
+	// CircuitClosed lets all requests through
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects all requests until the reset timeout expires
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe request through
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type circuitBreaker struct {
+	options *CircuitBreakerOptions
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow returns true if a request can be sent through the breaker
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.currentState() {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if cb.probing {
+			return false
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+	}
+	return true
+}
+
+// record updates the breaker with the outcome of an attempt
+func (cb *circuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	if success {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.options.FailureThreshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// cancelProbe releases the half-open probe of an attempt that wasn't sent,
+// letting the next request probe the host
+func (cb *circuitBreaker) cancelProbe() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+}
+
+// currentState returns the state taking the reset timeout into account.
+// The caller must hold the lock.
+func (cb *circuitBreaker) currentState() CircuitState {
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.options.ResetTimeout {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// getCircuitBreaker returns the breaker for the request host or nil if circuit breaking is disabled
+func (c *Client) getCircuitBreaker(req *Request) *circuitBreaker {
+	if c.options.CircuitBreaker == nil || c.options.CircuitBreaker.FailureThreshold <= 0 {
+		return nil
+	}
+	breaker, _ := c.circuitBreakers.LoadOrStore(hostPortKey(req.Request.URL), &circuitBreaker{options: c.options.CircuitBreaker})
+	return breaker.(*circuitBreaker)
+}
+
+// CircuitState returns the circuit breaker state of the given host:port.
+// Hosts without any recorded attempt are reported as closed.
+func (c *Client) CircuitState(host string) CircuitState {
+	breaker, ok := c.circuitBreakers.Load(host)
+	if !ok {
+		return CircuitClosed
+	}
+	cb := breaker.(*circuitBreaker)
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.currentState()
+}
+
+// hostPortKey returns host:port of the url using the scheme default port if missing
+func hostPortKey(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -1,11 +1,16 @@
 package retryablehttp
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
-	"golang.org/x/net/http2"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Client is used to make HTTP requests. It adds additional functionality
@@ -15,9 +20,40 @@ type Client struct {
 	HTTPClient *http.Client
 	// HTTPClient is the internal HTTP client configured to fallback to native http2 at transport level
 	HTTPClient2 *http.Client
+	// HTTPClient3 is the internal HTTP client used for http/3 when AutoHTTP3Upgrade is enabled
+	HTTPClient3 *http.Client
 
 	requestCounter atomic.Uint32
 
+	// requestSeq is the number of requests sent by the client
+	requestSeq atomic.Uint32
+
+	// circuitBreakers holds the per host:port circuit breakers
+	circuitBreakers sync.Map
+	// hostSemaphores holds the per host:port in-flight requests semaphores
+	hostSemaphores sync.Map
+	// hostMetrics holds the per host:port metrics when CollectHostMetrics is enabled
+	hostMetrics sync.Map
+	// http3Authorities maps origins host:port to their advertised http3Authority until
+	// it expires according to the Alt-Svc max age
+	http3Authorities sync.Map
+
+	// connStats is the connection usage collected when CollectConnStats is enabled
+	connStats connStats
+
+	// shutdown tracks the requests in-flight, see Shutdown
+	shutdown shutdownState
+
+	// retryBudget limits the retries of the client, nil if RetryBudget is not set
+	retryBudget *retryBudget
+
+	// tlsConfig is the tls config built from options, nil if defaults are used
+	tlsConfig *tls.Config
+
+	// grpc is the client sending the gRPC calls, built on first use
+	grpc     *Client
+	grpcOnce sync.Once
+
 	// RequestLogHook allows a user-supplied function to be called
 	// before each retry.
 	RequestLogHook RequestLogHook
@@ -26,6 +62,13 @@ type Client struct {
 	ResponseLogHook ResponseLogHook
 	// ErrorHandler specifies the custom error handler to use, if any
 	ErrorHandler ErrorHandler
+	// OnRetry allows a user-supplied function to be called
+	// before sleeping for the backoff of each retry.
+	OnRetry RetryHook
+	// OnBeforeRequest are middlewares run in order before each request is sent
+	OnBeforeRequest []ClientRequestMiddleware
+	// OnAfterResponse are middlewares run in order on the response returned by Do
+	OnAfterResponse []ClientResponseMiddleware
 
 	// CheckRetry specifies the policy for handling retries, and is called
 	// after each request. The default policy is DefaultRetryPolicy.
@@ -55,14 +98,249 @@ type Options struct {
 	KillIdleConn bool
 	// Custom CheckRetry policy
 	CheckRetry CheckRetry
+	// CheckRetryWithBody is a retry policy receiving the first BodyPeekLimit bytes of the
+	// response body, which remain readable from the returned response. Only the peeked
+	// bytes are buffered, the rest of the body is streamed. It takes precedence over CheckRetry.
+	CheckRetryWithBody CheckRetryWithBody
+	// BodyPeekLimit is the number of bytes of the response body given to CheckRetryWithBody
+	// (default: RespReadLimit, or 4096 if unset)
+	BodyPeekLimit int64
+	// BodyPeekTimeout is the time waited for the bytes of the response body peeked by
+	// CheckRetryWithBody and CaptureExchange. Bytes received later aren't peeked but remain
+	// readable from the returned response (default: 1s)
+	BodyPeekTimeout time.Duration
+	// RetryableErrorCallback decides if a request failing with the given error
+	// should be retried, overriding the classification of the retry policy.
+	// Errors caused by cancellation or expiry of the request context are never retried.
+	RetryableErrorCallback func(error) bool
+	// RetryableNetErrors are the only request errors retried when set, matched as case-insensitive
+	// substrings of the error message (ex. "connection reset by peer", "no route to host").
+	// The names of common errnos (connection reset by peer, connection refused, connection
+	// aborted, broken pipe, no route to host, network is unreachable, host is down) match the
+	// errno whatever the message, and "timeout" matches any network timeout.
+	// RetryableErrorCallback takes precedence.
+	RetryableNetErrors []string
 	// Custom Backoff policy
 	Backoff Backoff
+	// RetryOnPartialResponse reads the response body in memory before returning the response,
+	// so that bodies truncated by a connection drop (io.ErrUnexpectedEOF, ...) fail the attempt
+	// with an error wrapping ErrPartialResponse, which the retry policy can retry
+	RetryOnPartialResponse bool
+	// PartialResponseReadLimit is the size of the response body read in memory by
+	// RetryOnPartialResponse, the rest of larger bodies is streamed without being
+	// retried (default: 10 MiB)
+	PartialResponseReadLimit int64
+	// NoRetryNonIdempotent disables retrying non-idempotent requests (POST, PATCH, ...)
+	// that may have reached the server, see IdempotentOnlyRetryPolicy
+	NoRetryNonIdempotent bool
 	// NoAdjustTimeout disables automatic adjustment of HTTP request timeout
 	NoAdjustTimeout bool
+	// PerRequestTimeoutRatio adjusts the HTTP request timeout to the given ratio of Timeout,
+	// capped at Timeout. When zero the legacy adjustment applies (30% of Timeout in whole
+	// seconds if Timeout is above 15 seconds and RetryMax above 1), negative disables it.
+	PerRequestTimeoutRatio float64
+	// PerAttemptTimeoutStrategy sets a timeout on each attempt, for instance
+	// growing with the attempt number (see ExponentialPerAttemptTimeout).
+	// When set, the automatic adjustment of HTTP request timeout is disabled.
+	PerAttemptTimeoutStrategy PerAttemptTimeoutStrategy
 	// Custom http client
 	HttpClient *http.Client
 	// Trace enables tracing of the HTTP request
 	Trace bool
+	// CollectTrace collects the timing of the final attempt of each request in
+	// Request.Metrics.Trace, see Request.EnableTrace to enable it per request
+	CollectTrace bool
+	// MetricsCollector receives the metrics of each request (see metrics/prometheus)
+	MetricsCollector MetricsCollector
+	// HappyEyeballs races the connections to the ipv6 and ipv4 addresses of dual-stack
+	// hosts giving ipv6 a short head start (RFC 8305), so that a firewalled address
+	// family doesn't delay the requests
+	HappyEyeballs bool
+	// MaxResponseHeaderBytes limits the size of the response headers, requests whose
+	// response exceeds it fail with an error wrapping ErrHeaderTooLarge. (default: 4096)
+	MaxResponseHeaderBytes int64
+	// DisableHTTP2Coalescing sends the requests of each authority (Host header) over
+	// dedicated http/2 connections, which otherwise are shared by the virtual hosts
+	// reached through the same address and may hit the wrong backend
+	DisableHTTP2Coalescing bool
+	// DisableHTTP2 sends the requests over http/1.1 only, advertised with ALPN, for servers
+	// negotiating h2 but misbehaving with it. The requests are not replayed over http/2 when
+	// the server responds with it, http/3 is still used if enabled.
+	DisableHTTP2 bool
+	// DetectContentType sets the Content-Type header of requests without one from the
+	// first 512 bytes of their body, with http.DetectContentType and JSON detection
+	DetectContentType bool
+	// Use100Continue sends the requests with a body with the Expect: 100-continue header,
+	// so that their body is only uploaded once the server accepted the request. Requests
+	// rejected before the upload (413 or 417) are not retried.
+	Use100Continue bool
+	// HeaderOrder is the order of the headers of the requests written by the client itself,
+	// the websocket handshake and the CONNECT request, instead of the sorted order of net/http.
+	// Header names are matched case-insensitively, unlisted headers are written after them.
+	HeaderOrder []string
+	// RandomizeHeaderOrder shuffles the headers of the requests written by the client itself
+	// which are not listed in HeaderOrder
+	RandomizeHeaderOrder bool
+	// UserAgent is the User-Agent header sent with requests not setting one
+	UserAgent string
+	// UserAgents are rotated round-robin across requests not setting a User-Agent
+	// header, taking precedence over UserAgent
+	UserAgents []string
+	// SkipDecompressContentTypes lists the content types (e.g. application/octet-stream or
+	// image/*) of the gzip encoded responses returned as transferred, with their
+	// Content-Encoding header, instead of being transparently decompressed
+	SkipDecompressContentTypes []string
+	// DisableAutoAcceptEncoding stops the client from requesting gzip compressed responses,
+	// which it decompresses transparently. The Accept-Encoding header and the decompression
+	// then depend on the request only:
+	//   - by default, Accept-Encoding: gzip is sent and gzip responses are decompressed
+	//     (resp.Uncompressed is set), but the ones of SkipDecompressContentTypes
+	//   - requests setting Accept-Encoding send it as is and get the responses as transferred
+	//   - with DisableAutoAcceptEncoding, requests without Accept-Encoding send none and get
+	//     the responses as transferred, SkipDecompressContentTypes is unused
+	// It is not applied to a custom HttpClient.
+	DisableAutoAcceptEncoding bool
+	// RawIOTimeout limits each read and write of the connections of DoRawBytes, so that servers
+	// accepting the connection but never responding don't hang it, even without Timeout
+	RawIOTimeout time.Duration
+	// RetryMiddlewareErrors handles the errors of the OnBeforeRequest middlewares as failed
+	// attempts given to the retry policy, instead of returning them, e.g. for a middleware
+	// fetching a token. The middlewares are run again by the next attempt until they succeed.
+	RetryMiddlewareErrors bool
+	// HostsMap maps hostnames to the ip connections to them are dialed to instead of
+	// resolving them, like curl --resolve. The url host is still used for the tls server
+	// name and the Host header. It does not apply to http/3 nor to a custom HttpClient.
+	HostsMap map[string]string
+	// NormalizePath canonicalizes the path before sending the request: percent-encoding is
+	// decoded and re-encoded in canonical form, requests with malformed escapes are rejected
+	// and dot segments are resolved. By default the raw path is sent as is, which payloads
+	// relying on encoded characters (crlf, path traversal, ...) depend on.
+	NormalizePath bool
+	// CaptureExchange captures the dumps of the final request and response, including up to
+	// RespReadLimit bytes of its body, and the errors of the failed attempts in Request.Exchange
+	CaptureExchange bool
+	// HARRecorder records the exchanges of the requests into a HAR document, it enables
+	// CaptureExchange and Trace from which the entries and their timings are built.
+	// (ex. NewHARRecorder(file))
+	HARRecorder *HARRecorder
+	// Tracer creates an OpenTelemetry span for each request with a child span for each attempt,
+	// the w3c traceparent header is injected unless already set on the request
+	Tracer trace.Tracer
+	// CollectResolvedIPs records the addresses the host of each request resolved to
+	// in Request.ResolvedAddrs
+	CollectResolvedIPs bool
+	// CollectInterimResponses records the informational (1xx) responses received before the
+	// final response of each request (e.g. 103 Early Hints) in Metrics.InterimResponses
+	CollectInterimResponses bool
+	// CollectTLSBackend records the tls stack which served the connection of each request,
+	// crypto/tls or the ztls fallback, in Request.TLSBackend
+	CollectTLSBackend bool
+	// CollectConnStats enables collecting the connection usage of the client (see Client.ConnStats)
+	CollectConnStats bool
+	// CollectHostMetrics enables aggregating the metrics of the requests per host:port
+	// (see Client.HostMetrics and Client.AllHostMetrics)
+	CollectHostMetrics bool
+	// ResponseBodyIdleTimeout aborts reading the response body with ErrBodyIdleTimeout
+	// when no bytes are received for the given duration. Unlike Timeout it only
+	// bounds stalls between reads, not the overall request.
+	ResponseBodyIdleTimeout time.Duration
+	// MaxBodyReadDuration aborts reading the response body with ErrBodyReadTimeout once the
+	// reads took that long in total, even if bytes keep trickling in (ex. slowloris servers
+	// defeating ResponseBodyIdleTimeout). The time spent by the caller between reads doesn't count.
+	MaxBodyReadDuration time.Duration
+	// CircuitBreaker enables a per host:port circuit breaker which stops
+	// sending requests to a host after consecutive failures
+	CircuitBreaker *CircuitBreakerOptions
+	// RetryBudget limits the retries of the client to a ratio of its requests, e.g. 0.1
+	// allows a retry every 10 requests on top of an initial reserve of 10 retries. Once
+	// exhausted, requests return the result of their last attempt without retrying,
+	// protecting the targets from retry storms. (default: unlimited)
+	RetryBudget float64
+	// ForwardAuthOnRedirect forwards the Authorization header on redirects to another
+	// origin (scheme, host and port), where it's dropped by default.
+	// Redirect options are not applied to a custom HttpClient.
+	ForwardAuthOnRedirect bool
+	// MaxTotalRedirectBytes limits the bytes of the response bodies read across the redirects
+	// of an attempt, the final response included. Exceeding it stops following the redirects
+	// or fails the reads of the final body with an error wrapping ErrResponseTooLarge.
+	// Only the final body is limited with a custom HttpClient. (default: unlimited)
+	MaxTotalRedirectBytes int64
+	// MaxInFlightPerHost limits the requests in-flight to each host:port, a request
+	// holds its slot from sending until the returned response body is closed.
+	// Unlike http.Transport MaxConnsPerHost it applies to any transport. (default: unlimited)
+	MaxInFlightPerHost int
+	// AutoHTTP3Upgrade sends the https requests to origins whose responses advertised h3
+	// via Alt-Svc directly over http/3. The request receiving the advertisement is not
+	// sent again, only the later requests to the same origin use http/3.
+	AutoHTTP3Upgrade bool
+	// HTTP3 sends https requests over http/3 first, falling back to http/1.x or
+	// http/2 with the standard client when the quic connection can't be established.
+	// Requests failing later are sent again only if idempotent. It takes precedence
+	// over AutoHTTP3Upgrade.
+	HTTP3 bool
+	// HTTP3RoundTripper is the round tripper used for http/3 requests when HTTP3 is
+	// enabled, allowing a pre-configured quic-go http3.RoundTripper. TLS options
+	// are not applied to it. (default: quic-go http3.RoundTripper)
+	HTTP3RoundTripper http.RoundTripper
+	// ClientCertificates are presented to servers requesting mutual tls authentication.
+	// TLS options are not applied to the transport of a custom HttpClient.
+	ClientCertificates []tls.Certificate
+	// ClientCertFile and ClientKeyFile are the paths of a PEM encoded certificate
+	// and key pair presented to servers requesting mutual tls authentication
+	ClientCertFile string
+	ClientKeyFile  string
+	// TLSMinVersion is the minimum tls version to negotiate (default: tls.VersionTLS10)
+	TLSMinVersion uint16
+	// TLSMaxVersion is the maximum tls version to negotiate (default: highest supported)
+	TLSMaxVersion uint16
+	// TLSHandshakeTimeout limits the time spent in tls handshakes, including the ztls
+	// fallback, independently of Timeout. (default: 10s)
+	TLSHandshakeTimeout time.Duration
+	// DisableZTLSFallback overrides the global DisableZTLSFallback for this client when set:
+	// true disables the ztls fallback on tls handshake errors, false enables it.
+	DisableZTLSFallback *bool
+	// VerifyCertificates verifies the certificate chain and host name of the servers,
+	// which are not verified by default
+	VerifyCertificates bool
+	// TLSVerifyCallback is called after the tls handshake of each connection, including the
+	// ztls fallback, with its state and rejects the connection if it returns an error,
+	// ex. to pin certificates. It's called whether VerifyCertificates is enabled or not.
+	TLSVerifyCallback func(cs tls.ConnectionState) error
+	// DialTimeout limits the time spent establishing connections, independently of Timeout,
+	// to fail fast on unreachable hosts. (default: 30s)
+	DialTimeout time.Duration
+	// TCPKeepAlive is the interval of the tcp keep-alive probes of the connections, negative
+	// disables them so that connections dropped by stateful firewalls are redialed instead.
+	// It only matters for pooled connections, KillIdleConn closes them after each request.
+	// (default: 30s)
+	TCPKeepAlive time.Duration
+	// LocalAddr is the local address connections are dialed from (ex. &net.TCPAddr{IP: ip}),
+	// to pick the source address of multi-homed hosts. Destinations without addresses of the
+	// same family fail with an error wrapping ErrAddressFamilyMismatch.
+	LocalAddr net.Addr
+	// CredentialProvider supplies the credentials of the requests without Request.Auth.
+	// A 401 response refreshes them once, retrying the request with the new ones
+	// (within RetryMax) whatever CheckRetry says.
+	CredentialProvider CredentialProvider
+	// Cache stores the responses of GET and HEAD requests, which are served from it without
+	// being sent while fresh according to their Cache-Control or Expires headers. Stale
+	// responses with an ETag are revalidated with If-None-Match. Responses are stored once
+	// their body is fully read by the caller, up to 8MiB. Requests carrying credentials,
+	// cookies or a Range header, and private responses, don't use it. It's not used with
+	// RetryMiddlewareErrors. (ex. NewLRUCache(1000, 64<<20))
+	Cache ResponseCache
+	// TCPFastOpen enables tcp fast open on the dialed connections, saving a round trip when
+	// connecting again to a host. It is supported on linux 4.11+ and ignored elsewhere,
+	// connections are dialed without fastdialer when it is supported.
+	TCPFastOpen bool
+	// StripHopByHopHeaders removes the hop-by-hop headers of the requests before sending them
+	// (Connection, Keep-Alive, Proxy-Authenticate, TE, Trailer, Transfer-Encoding, Upgrade and
+	// the headers listed in Connection, RFC 7230 6.1), ex. when forwarding requests received
+	// by a proxy. Headers set by the transport itself are still sent.
+	StripHopByHopHeaders bool
+	// TLSCipherSuites restricts the cipher suites offered for tls 1.0-1.2
+	// handshakes, including the ztls fallback (default: chrome ciphers)
+	TLSCipherSuites []uint16
 }
 
 // DefaultOptionsSpraying contains the default options for host spraying
@@ -89,8 +367,20 @@ var DefaultOptionsSingle = Options{
 	NoAdjustTimeout: true,
 }
 
-// NewClient creates a new Client with default settings.
+// NewClient creates a new Client with default settings. It returns nil if the
+// options are invalid, ex. unreadable client certificate files, see NewClientWithError.
 func NewClient(options Options) *Client {
+	client, _ := NewClientWithError(options)
+	return client
+}
+
+// NewClientWithError creates a new Client with default settings, returning the error
+// making the options invalid
+func NewClientWithError(options Options) (*Client, error) {
+	if options.HARRecorder != nil {
+		options.CaptureExchange = true
+		options.Trace = true
+	}
 	var httpclient *http.Client
 	if options.HttpClient != nil {
 		httpclient = options.HttpClient
@@ -100,9 +390,34 @@ func NewClient(options Options) *Client {
 		httpclient = DefaultPooledClient()
 	}
 
-	httpclient2 := DefaultClient()
-	if err := http2.ConfigureTransport(httpclient2.Transport.(*http.Transport)); err != nil {
-		return nil
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil && options.HttpClient == nil {
+		configureTransportTLS(httpclient, tlsConfig, &options)
+	}
+	if options.HappyEyeballs && options.HttpClient == nil {
+		useHappyEyeballs(httpclient, &options)
+	}
+	if transport, ok := httpclient.Transport.(*http.Transport); ok && options.HttpClient == nil {
+		if options.MaxResponseHeaderBytes > 0 {
+			transport.MaxResponseHeaderBytes = options.MaxResponseHeaderBytes
+		}
+		if options.DisableAutoAcceptEncoding {
+			transport.DisableCompression = true
+		}
+	}
+
+	transport2, err := newHTTP2Transport(&options, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	httpclient2 := &http.Client{Transport: transport2}
+	if options.DisableHTTP2Coalescing {
+		httpclient2.Transport = &authorityTransport{newTransport: func() (http.RoundTripper, error) {
+			return newHTTP2Transport(&options, tlsConfig)
+		}}
 	}
 
 	var retryPolicy CheckRetry
@@ -112,33 +427,204 @@ func NewClient(options Options) *Client {
 	if options.CheckRetry != nil {
 		retryPolicy = options.CheckRetry
 	}
+	if options.CheckRetryWithBody != nil {
+		retryPolicy = withBodyPeek(options.CheckRetryWithBody, options.bodyPeekLimit(), options.bodyPeekTimeout())
+	}
+
+	if len(options.RetryableNetErrors) > 0 {
+		retryPolicy = withRetryableErrorCallback(retryPolicy, func(err error) bool {
+			return isRetryableNetError(err, options.RetryableNetErrors)
+		})
+	}
+
+	if options.RetryableErrorCallback != nil {
+		retryPolicy = withRetryableErrorCallback(retryPolicy, options.RetryableErrorCallback)
+	}
+
+	if options.NoRetryNonIdempotent {
+		retryPolicy = IdempotentOnlyRetryPolicy(retryPolicy)
+	}
 
 	backoff = DefaultBackoff()
 	if options.Backoff != nil {
 		backoff = options.Backoff
 	}
 
+	c := &Client{
+		HTTPClient:  httpclient,
+		HTTPClient2: httpclient2,
+		CheckRetry:  retryPolicy,
+		Backoff:     backoff,
+		options:     options,
+		tlsConfig:   tlsConfig,
+	}
+
+	if options.RetryBudget > 0 {
+		c.retryBudget = newRetryBudget(options.RetryBudget)
+	}
+
+	c.OnBeforeRequest = append(c.OnBeforeRequest, options.middlewares()...)
+
+	if options.HttpClient == nil {
+		httpclient.CheckRedirect = c.redirectPolicy(httpclient.CheckRedirect)
+	}
+	httpclient2.CheckRedirect = c.redirectPolicy(httpclient2.CheckRedirect)
+
+	if options.HTTP3 && options.HTTP3RoundTripper != nil {
+		c.HTTPClient3 = &http.Client{Transport: options.HTTP3RoundTripper}
+	} else if options.HTTP3 || options.AutoHTTP3Upgrade {
+		c.HTTPClient3 = c.newHTTP3Client()
+	}
+	if c.HTTPClient3 != nil {
+		c.HTTPClient3.CheckRedirect = c.redirectPolicy(nil)
+	}
+
 	// add timeout to clients
 	if options.Timeout > 0 {
 		httpclient.Timeout = options.Timeout
 		httpclient2.Timeout = options.Timeout
+		if c.HTTPClient3 != nil {
+			c.HTTPClient3.Timeout = options.Timeout
+		}
 	}
 
 	// if necessary adjusts per-request timeout proportionally to general timeout (30%)
-	if options.Timeout > time.Second*15 && options.RetryMax > 1 && !options.NoAdjustTimeout {
-		httpclient.Timeout = time.Duration(options.Timeout.Seconds()*0.3) * time.Second
+	if !options.NoAdjustTimeout && options.PerAttemptTimeoutStrategy == nil {
+		switch {
+		case options.PerRequestTimeoutRatio > 0:
+			httpclient.Timeout = time.Duration(float64(options.Timeout) * options.PerRequestTimeoutRatio)
+			if httpclient.Timeout > options.Timeout {
+				httpclient.Timeout = options.Timeout
+			}
+		case options.PerRequestTimeoutRatio == 0 && options.Timeout > time.Second*15 && options.RetryMax > 1:
+			httpclient.Timeout = time.Duration(options.Timeout.Seconds()*0.3) * time.Second
+		}
 	}
 
-	c := &Client{
-		HTTPClient:  httpclient,
-		HTTPClient2: httpclient2,
-		CheckRetry:  retryPolicy,
-		Backoff:     backoff,
-		options:     options,
+	c.setKillIdleConnections()
+	return c, nil
+}
+
+// tlsHandshakeTimeout returns the time limit of tls handshakes
+func (options *Options) tlsHandshakeTimeout() time.Duration {
+	if options.TLSHandshakeTimeout > 0 {
+		return options.TLSHandshakeTimeout
 	}
+	return defaultTLSHandshakeTimeout
+}
 
-	c.setKillIdleConnections()
-	return c
+// bodyPeekLimit returns the number of bytes of the response body given to CheckRetryWithBody
+func (options *Options) bodyPeekLimit() int64 {
+	if options.BodyPeekLimit > 0 {
+		return options.BodyPeekLimit
+	}
+	if options.RespReadLimit > 0 {
+		return options.RespReadLimit
+	}
+	return defaultBodyPeekLimit
+}
+
+// bodyPeekTimeout returns the time waited for the peeked bytes of the response body
+func (options *Options) bodyPeekTimeout() time.Duration {
+	if options.BodyPeekTimeout > 0 {
+		return options.BodyPeekTimeout
+	}
+	return defaultBodyPeekTimeout
+}
+
+// partialResponseReadLimit returns the size of the response body read in memory by RetryOnPartialResponse
+func (options *Options) partialResponseReadLimit() int64 {
+	if options.PartialResponseReadLimit > 0 {
+		return options.PartialResponseReadLimit
+	}
+	return defaultPartialResponseReadLimit
+}
+
+// customDialer reports whether the options require dialing with settings other than the default ones
+func (options *Options) customDialer() bool {
+	return options.DialTimeout > 0 || options.TCPKeepAlive != 0 || options.LocalAddr != nil || len(options.HostsMap) > 0 ||
+		(options.TCPFastOpen && tcpFastOpenControl != nil)
+}
+
+// dialContext returns the function dialing the connections of the transports
+func (options *Options) dialContext() func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !options.customDialer() {
+		return dialContext
+	}
+	timeout, keepAlive := defaultDialTimeout, defaultTCPKeepAlive
+	if options.DialTimeout > 0 {
+		timeout = options.DialTimeout
+	}
+	if options.TCPKeepAlive != 0 {
+		keepAlive = options.TCPKeepAlive
+	}
+	var control func(network, address string, c syscall.RawConn) error
+	if options.TCPFastOpen {
+		control = tcpFastOpenControl
+	}
+	return withHostsMap(newDialContext(timeout, keepAlive, options.LocalAddr, control), options.HostsMap)
+}
+
+// middlewares returns the OnBeforeRequest middlewares installed by NewClient for the options
+func (options *Options) middlewares() []ClientRequestMiddleware {
+	var middlewares []ClientRequestMiddleware
+	if userAgentMiddleware := options.userAgentMiddleware(); userAgentMiddleware != nil {
+		middlewares = append(middlewares, userAgentMiddleware)
+	}
+	if options.StripHopByHopHeaders {
+		middlewares = append(middlewares, MiddlewareOnBeforeRequestStripHopByHopHeaders())
+	}
+	return middlewares
+}
+
+// userAgentMiddleware returns the middleware setting the user agent of the options,
+// nil if none is set
+func (options *Options) userAgentMiddleware() ClientRequestMiddleware {
+	if len(options.UserAgents) > 0 {
+		return MiddlewareOnBeforeRequestUserAgent(options.UserAgents...)
+	}
+	if options.UserAgent != "" {
+		return MiddlewareOnBeforeRequestUserAgent(options.UserAgent)
+	}
+	return nil
+}
+
+// tlsConfig returns the tls config to use for the transports or nil if
+// the options don't require any change to the default one
+func (options *Options) tlsConfig() (*tls.Config, error) {
+	var certificates []tls.Certificate
+	certificates = append(certificates, options.ClientCertificates...)
+	if options.ClientCertFile != "" || options.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.ClientCertFile, options.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+	// default transports dial tls with fastdialer whose ztls fallback and timeouts are global
+	if len(certificates) == 0 && options.TLSMinVersion == 0 && options.TLSMaxVersion == 0 && len(options.TLSCipherSuites) == 0 &&
+		options.DisableZTLSFallback == nil && options.TLSHandshakeTimeout == 0 && !options.customDialer() &&
+		!options.VerifyCertificates && options.TLSVerifyCallback == nil && !options.DisableHTTP2 {
+		return nil, nil
+	}
+
+	tlsConfig := defaultTLSConfig()
+	tlsConfig.Certificates = certificates
+	if options.TLSMinVersion != 0 {
+		tlsConfig.MinVersion = options.TLSMinVersion
+	}
+	if options.TLSMaxVersion != 0 {
+		tlsConfig.MaxVersion = options.TLSMaxVersion
+	}
+	if len(options.TLSCipherSuites) > 0 {
+		tlsConfig.CipherSuites = options.TLSCipherSuites
+	}
+	tlsConfig.InsecureSkipVerify = !options.VerifyCertificates
+	tlsConfig.VerifyConnection = options.TLSVerifyCallback
+	if options.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"http/1.1"}
+	}
+	return tlsConfig, nil
 }
 
 // NewWithHTTPClient creates a new Client with custom http client
@@ -158,3 +644,13 @@ func (c *Client) setKillIdleConnections() {
 		}
 	}
 }
+
+// CloseIdleConnections closes the idle connections of the internal clients.
+// Transports not supporting it are left untouched.
+func (c *Client) CloseIdleConnections() {
+	for _, httpClient := range []*http.Client{c.HTTPClient, c.HTTPClient2, c.HTTPClient3} {
+		if httpClient != nil {
+			httpClient.CloseIdleConnections()
+		}
+	}
+}
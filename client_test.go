@@ -1,19 +1,36 @@
 package retryablehttp
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/projectdiscovery/retryablehttp-go/buggyhttp"
 	urlutil "github.com/projectdiscovery/utils/url"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
 )
 
 // TestRequest parsing methodology
@@ -213,6 +230,7 @@ func testClientSuccess_Do(t *testing.T, body interface{}) {
 // Expected: Some recoverable network failures and after 5 retries the library should be able to get Status Code 200 + Valid Body with various backoff stategies
 // Request to /successafter => 5 attempts recoverable + at 6th attempt 200 + valid body
 func TestClientRetry_Do(t *testing.T) {
+	buggyhttp.Reset()
 	expectedRetries := 3
 	// Create a generic request towards /successAfter passing the number of times before the same request is successful
 	req, err := NewRequest("GET", fmt.Sprintf("http://127.0.0.1:8080/successAfter?successAfter=%d", expectedRetries), nil)
@@ -243,6 +261,7 @@ func TestClientRetry_Do(t *testing.T) {
 
 // TestClientRetryWithBody_Do does same as TestClientRetry_Do but with request body and 5 retries
 func TestClientRetryWithBody_Do(t *testing.T) {
+	buggyhttp.Reset()
 	expectedRetries := 5
 	// Create a generic request towards /successAfter passing the number of times before the same request is successful
 	req, err := NewRequest("GET", fmt.Sprintf("http://127.0.0.1:8080/successAfter?successAfter=%d", expectedRetries), "request with body")
@@ -293,6 +312,9 @@ func TestClientEmptyResponse_Do(t *testing.T) {
 		// if at the end we get don't failure then it's unexpected behavior
 		t.Fatalf("err: %v", err)
 	}
+	if !errors.Is(err, ErrConnectionClosedWithoutResponse) {
+		t.Fatalf("expected ErrConnectionClosedWithoutResponse, got: %v", err)
+	}
 }
 
 // TestClientUnexpectedEOF_Do tests a generic endpoint that simulates the server hanging the connection in the middle of a valid response (connection failure)
@@ -317,6 +339,68 @@ func TestClientUnexpectedEOF_Do(t *testing.T) {
 		// if at the end we get don't failure then it's unexpected behavior
 		t.Fatalf("err: %v", err)
 	}
+	// the server started responding
+	if errors.Is(err, ErrConnectionClosedWithoutResponse) {
+		t.Fatalf("unexpected ErrConnectionClosedWithoutResponse: %v", err)
+	}
+}
+
+func TestRetryOnPartialResponse_Do(t *testing.T) {
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+		Timeout:      5 * time.Second,
+	}
+
+	// by default the truncation surfaces when reading the body
+	resp, err := NewClient(options).Get("http://127.0.0.1:8080/truncatedBody")
+	require.Nil(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	options.RetryOnPartialResponse = true
+	client := NewClient(options)
+	var attempts int
+	client.RequestLogHook = func(r *http.Request, i int) {
+		attempts++
+	}
+	_, err = client.Get("http://127.0.0.1:8080/truncatedBody")
+	require.ErrorIs(t, err, ErrPartialResponse)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, 3, attempts)
+
+	attempts = 0
+	_, err = client.Get("http://127.0.0.1:8080/unexpectedEOF")
+	require.NotNil(t, err)
+	require.Equal(t, 3, attempts)
+
+	// complete bodies remain readable
+	resp, err = client.Get("http://127.0.0.1:8080/foo")
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "foo", string(body))
+
+	// bodies are read in memory up to the limit, the rest is streamed
+	options.PartialResponseReadLimit = 4096
+	resp, err = NewClient(options).Get("http://127.0.0.1:8080/endlessBody")
+	require.Nil(t, err)
+	n, err := io.CopyN(io.Discard, resp.Body, 3*4096)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, int64(3*4096), n)
+
+	// the body time limits apply to the read of the attempt
+	options.MaxBodyReadDuration = 200 * time.Millisecond
+	options.RetryMax = 0
+	start := time.Now()
+	_, err = NewClient(options).Get("http://127.0.0.1:8080/superSlow")
+	require.ErrorIs(t, err, ErrPartialResponse)
+	require.ErrorIs(t, err, ErrBodyReadTimeout)
+	require.Less(t, time.Since(start), time.Second)
 }
 
 // TestClientEndlessBody_Do tests a generic endpoint that simulates the server delivering an infinite content body
@@ -406,7 +490,3120 @@ func TestClientMessyEncoding_Do(t *testing.T) {
 
 func TestMain(m *testing.M) {
 	// start buggyhttp
-	buggyhttp.Listen(8080)
+	if _, err := buggyhttp.Listen(8080); err != nil {
+		fmt.Fprintf(os.Stderr, "could not start buggyhttp: %s\n", err)
+		os.Exit(1)
+	}
 	defer buggyhttp.Stop()
 	os.Exit(m.Run())
 }
+
+// TestStreamingRequest_Do tests that streaming bodies are sent chunked and are not
+// replayed once they started flowing
+func TestStreamingRequest_Do(t *testing.T) {
+	var hits atomic.Int32
+	transferEncodings := make(chan []string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/drop" {
+			hj, _ := w.(http.Hijacker)
+			conn, _, _ := hj.Hijack()
+			conn.Close()
+			return
+		}
+		transferEncodings <- r.TransferEncoding
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     3,
+	}
+	client := NewClient(options)
+
+	payload := strings.Repeat("stream", 1024)
+	req, err := NewStreamingRequest(http.MethodPost, ts.URL, io.MultiReader(strings.NewReader(payload)))
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), req.ContentLength)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	got, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, payload, string(got))
+	require.Equal(t, []string{"chunked"}, <-transferEncodings)
+
+	hits.Store(0)
+	req, err = NewStreamingRequest(http.MethodPost, ts.URL+"/drop", io.MultiReader(strings.NewReader(payload)))
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.Equal(t, int32(1), hits.Load(), "streaming request must not be retried")
+
+	// the body closed by an attempt failing before reading it is still sent by the retry
+	body := &closeRecorder{Reader: strings.NewReader(payload)}
+	req, err = NewStreamingRequest(http.MethodPost, ts.URL, body)
+	require.Nil(t, err)
+	var attempts atomic.Int32
+	req.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		if attempts.Add(1) == 1 {
+			r.Body.Close()
+			return nil, errors.New("dial failure")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	got, err = io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, payload, string(got))
+	require.Equal(t, []string{"chunked"}, <-transferEncodings)
+	require.Eventually(t, func() bool { return body.closed.Load() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+// closeRecorder counts the calls to Close
+type closeRecorder struct {
+	io.Reader
+	closed atomic.Int32
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Add(1)
+	return nil
+}
+
+// TestCircuitBreaker_Do tests that the circuit of a dead host trips and recovers once the host is back
+func TestCircuitBreaker_Do(t *testing.T) {
+	// reserve an address and close it so that connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     5,
+		// fastdialer caches unreachable addresses, use a plain transport
+		HttpClient: &http.Client{Transport: &http.Transport{}},
+		CircuitBreaker: &CircuitBreakerOptions{
+			FailureThreshold: 3,
+			ResetTimeout:     200 * time.Millisecond,
+		},
+	}
+	client := NewClient(options)
+
+	req, err := NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 3, req.Metrics.Failures, "breaker should open after 3 failed attempts")
+	require.Equal(t, CircuitOpen, client.CircuitState(addr))
+
+	// requests are rejected without dialing while the circuit is open
+	req, err = NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 0, req.Metrics.Failures)
+
+	// bring the host back and wait for the breaker to half-open
+	listener, err = net.Listen("tcp", addr)
+	require.Nil(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "foo")
+	}))
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, CircuitHalfOpen, client.CircuitState(addr))
+
+	req, err = NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, CircuitClosed, client.CircuitState(addr))
+}
+
+// TestCircuitBreakerCancelledProbe_Do tests that a half-open probe which isn't sent lets the next request probe the host
+func TestCircuitBreakerCancelledProbe_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	failMiddleware := true
+	client := NewClient(Options{
+		RetryMax:           0,
+		Timeout:            5 * time.Second,
+		MaxInFlightPerHost: 1,
+		// the middlewares run in the attempts, after the breaker let them through
+		RetryMiddlewareErrors: true,
+		CircuitBreaker: &CircuitBreakerOptions{
+			FailureThreshold: 1,
+			ResetTimeout:     10 * time.Millisecond,
+		},
+	})
+	client.OnBeforeRequest = append(client.OnBeforeRequest, func(client *Client, req *Request) error {
+		if failMiddleware {
+			return errors.New("middleware failed")
+		}
+		return nil
+	})
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	addr := ts.Listener.Addr().String()
+	openCircuit := func() {
+		client.getCircuitBreaker(req).record(false)
+		require.Equal(t, CircuitOpen, client.CircuitState(addr))
+		time.Sleep(20 * time.Millisecond)
+		require.Equal(t, CircuitHalfOpen, client.CircuitState(addr))
+	}
+
+	// the probe is cancelled while waiting for the in-flight slot of the host
+	openCircuit()
+	hostSemaphore := client.getHostSemaphore(req)
+	require.Nil(t, hostSemaphore.Acquire(context.Background(), 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	probe, err := NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	_, err = client.Do(probe)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	hostSemaphore.Release(1)
+
+	// the probe fails before it is sent
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, ErrCircuitOpen)
+
+	failMiddleware = false
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, CircuitClosed, client.CircuitState(addr))
+}
+
+// TestRequestSetBody_Do tests that a replaced body is sent with the right length and survives retries
+func TestRequestSetBody_Do(t *testing.T) {
+	buggyhttp.Reset()
+	req, err := NewRequest("POST", "http://127.0.0.1:8080/successAfter?successAfter=2", "original body")
+	require.Nil(t, err)
+
+	payloads := []interface{}{"fuzz", []byte("fuzzing payload"), strings.NewReader("reader payload")}
+	for _, payload := range payloads {
+		require.Nil(t, req.SetBody(payload))
+		body, err := req.BodyBytes()
+		require.Nil(t, err)
+		require.Equal(t, int64(len(body)), req.ContentLength)
+		require.Equal(t, fmt.Sprint(len(body)), req.Header.Get("Content-Length"))
+	}
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     4,
+	})
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 2, req.Metrics.Retries)
+
+	require.Nil(t, req.SetBody(nil))
+	require.Nil(t, req.Body)
+	require.Zero(t, req.ContentLength)
+}
+
+// TestClientDoRaw tests that the raw response bytes are returned as sent on the wire
+func TestClientDoRaw(t *testing.T) {
+	rawResponse := "HTTP/1.1 200 OK\r\nx-CuStOm-HeAdEr:   spaced value\r\nContent-Length: 2\r\n\r\nok"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = http.ReadRequest(bufio.NewReader(conn))
+			_, _ = conn.Write([]byte(rawResponse))
+			conn.Close()
+		}
+	}()
+
+	client := NewClient(Options{RetryMax: 1})
+	req, err := NewRequest(http.MethodGet, "http://"+listener.Addr().String()+"/", nil)
+	require.Nil(t, err)
+	raw, err := client.DoRaw(req)
+	require.Nil(t, err)
+	require.Equal(t, rawResponse, string(raw))
+
+	// only the final attempt is returned
+	client = NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     4,
+	})
+	buggyhttp.Reset()
+	req, err = NewRequest(http.MethodGet, "http://127.0.0.1:8080/successAfter?successAfter=2", nil)
+	require.Nil(t, err)
+	raw, err = client.DoRaw(req)
+	require.Nil(t, err)
+	require.Equal(t, 2, req.Metrics.Retries)
+	require.True(t, strings.HasPrefix(string(raw), "HTTP/1.1 200 OK\r\n"))
+	require.True(t, strings.HasSuffix(string(raw), "\r\n\r\nfoo"))
+
+	// the requests sent over another transport or protocol can't be recorded
+	req, err = NewRequest(http.MethodGet, "http://127.0.0.1:8080/foo", nil)
+	require.Nil(t, err)
+	req.Transport = &http.Transport{}
+	_, err = client.DoRaw(req)
+	require.ErrorIs(t, err, ErrRawUnsupported)
+	req, err = NewRequest(http.MethodGet, "http://127.0.0.1:8080/foo", nil)
+	require.Nil(t, err)
+	_, err = NewClient(Options{HTTP3: true}).DoRaw(req)
+	require.ErrorIs(t, err, ErrRawUnsupported)
+}
+
+func TestClientDoRawBytes(t *testing.T) {
+	// conflicting framing headers that net/http refuses to send
+	rawRequest := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 6\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\nG"
+	received := make(chan []byte, 1)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(rawRequest))
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+		_, _ = conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 3\r\n\r\nbad"))
+	}()
+
+	client := NewClient(Options{RetryMax: 1, Timeout: 5 * time.Second})
+	resp, err := client.DoRawBytes(listener.Addr().String(), []byte(rawRequest))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, rawRequest, string(<-received))
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "bad", string(body))
+
+	_, err = client.DoRawBytes("ftp://"+listener.Addr().String(), []byte(rawRequest))
+	require.ErrorAs(t, err, new(*UnsupportedSchemeError))
+}
+
+// TestClientTrickle_Do tests the buggyhttp endpoint writing the body one byte at a time
+// Expected: the full body is received after the configured delays
+func TestClientTrickle_Do(t *testing.T) {
+	req, err := NewRequest("GET", "http://127.0.0.1:8080/trickle?delayMs=20&bytes=5", nil)
+	require.Nil(t, err)
+
+	client := NewClient(Options{RetryMax: 1, Timeout: 5 * time.Second})
+	start := time.Now()
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "aaaaa", string(body))
+	require.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+}
+
+// TestClientResponseBodyIdleTimeout_Do tests that a stalled response body is aborted
+// Expected: a steady trickle is read completely while a stalled one fails with ErrBodyIdleTimeout
+func TestClientResponseBodyIdleTimeout_Do(t *testing.T) {
+	client := NewClient(Options{
+		RetryMax:                1,
+		Timeout:                 10 * time.Second,
+		ResponseBodyIdleTimeout: 200 * time.Millisecond,
+	})
+
+	req, err := NewRequest("GET", "http://127.0.0.1:8080/trickle?delayMs=50&bytes=10", nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Len(t, body, 10)
+
+	req, err = NewRequest("GET", "http://127.0.0.1:8080/trickle?delayMs=2000&bytes=3", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	start := time.Now()
+	_, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, ErrBodyIdleTimeout)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// TestClientMaxBodyReadDuration_Do tests that a body trickling in steadily is aborted
+// Expected: reading the superSlow body fails with ErrBodyReadTimeout at the budget
+// although bytes are received more often than the idle timeout
+func TestClientMaxBodyReadDuration_Do(t *testing.T) {
+	client := NewClient(Options{
+		RetryMax:                1,
+		Timeout:                 10 * time.Second,
+		ResponseBodyIdleTimeout: time.Second,
+		MaxBodyReadDuration:     750 * time.Millisecond,
+	})
+
+	req, err := NewRequest("GET", "http://127.0.0.1:8080/superSlow", nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	start := time.Now()
+	body, err := io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, ErrBodyReadTimeout)
+	require.NotEmpty(t, body)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+	require.GreaterOrEqual(t, time.Since(start), 700*time.Millisecond)
+	require.Less(t, time.Since(start), 1500*time.Millisecond)
+	// the body stays aborted
+	_, err = resp.Body.Read(make([]byte, 1))
+	require.ErrorIs(t, err, ErrBodyReadTimeout)
+
+	// bodies read within the budget are untouched
+	req, err = NewRequest("GET", "http://127.0.0.1:8080/trickle?delayMs=50&bytes=5", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Len(t, body, 5)
+}
+
+func TestClientUserAgents_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.UserAgent()))
+	}))
+	defer ts.Close()
+
+	userAgent := func(client *Client, userAgent string) string {
+		req, err := NewRequest(http.MethodGet, ts.URL, nil)
+		require.Nil(t, err)
+		if userAgent != "" {
+			req.Header.Set("User-Agent", userAgent)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+
+	client := NewClient(Options{UserAgent: "scanner/1.0"})
+	require.Equal(t, "scanner/1.0", userAgent(client, ""))
+	// user set values are kept
+	require.Equal(t, "custom", userAgent(client, "custom"))
+
+	client = NewClient(Options{UserAgents: []string{"ua-0", "ua-1", "ua-2"}})
+	for i := 0; i < 6; i++ {
+		require.Equal(t, fmt.Sprintf("ua-%d", i%3), userAgent(client, ""))
+	}
+	// the user agent set by the client is replaced when the request is sent again
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("ua-%d", i%3), string(body))
+	}
+}
+
+func TestStripHopByHopHeaders_Do(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer ts.Close()
+
+	send := func(client *Client) http.Header {
+		req, err := NewRequest(http.MethodGet, ts.URL, nil)
+		require.Nil(t, err)
+		req.Header.Set("Connection", "keep-alive, X-Hop")
+		req.Header.Set("X-Hop", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authenticate", "Basic")
+		req.Header.Set("TE", "trailers")
+		req.Header.Set("Upgrade", "h2c")
+		req.Header.Set("X-End-To-End", "1")
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return <-headers
+	}
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, StripHopByHopHeaders: true})
+	header := send(client)
+	for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Authenticate", "Te", "Upgrade"} {
+		require.Empty(t, header.Values(name), name)
+	}
+	// end-to-end headers are forwarded
+	require.Equal(t, "1", header.Get("X-End-To-End"))
+	require.Equal(t, "Bearer token", header.Get("Authorization"))
+
+	// the clones strip them too, with the middleware installed once
+	clone := client.With(func(options *Options) {
+		options.UserAgent = "scanner/1.0"
+	})
+	require.Len(t, clone.OnBeforeRequest, 2)
+	header = send(clone)
+	require.Empty(t, header.Values("X-Hop"))
+	require.Equal(t, "scanner/1.0", header.Get("User-Agent"))
+
+	header = send(NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second}))
+	require.Equal(t, "1", header.Get("X-Hop"))
+	require.Equal(t, "h2c", header.Get("Upgrade"))
+}
+
+func TestClientOnAfterResponse_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Server", "origin")
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	var statusCodes []int
+	client.OnAfterResponse = append(client.OnAfterResponse, func(client *Client, req *Request, resp *http.Response) error {
+		statusCodes = append(statusCodes, resp.StatusCode)
+		resp.Header.Set("X-Server", "rewritten")
+		return nil
+	})
+
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	// only the final response goes through the middlewares
+	require.Equal(t, []int{http.StatusOK}, statusCodes)
+	require.Equal(t, "rewritten", resp.Header.Get("X-Server"))
+
+	middlewareErr := errors.New("rejected")
+	client.OnAfterResponse = append(client.OnAfterResponse, func(client *Client, req *Request, resp *http.Response) error {
+		return middlewareErr
+	})
+	resp, err = client.Get(ts.URL)
+	require.ErrorIs(t, err, middlewareErr)
+	require.Nil(t, resp)
+}
+
+func TestClientMethods_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempt of each request to check bodies are replayed
+		if hits.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("Content-Type"), body)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     1,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	read := func(resp *http.Response, err error) string {
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+
+	require.Equal(t, "PUT text/plain put", read(client.Put(ts.URL, "text/plain", strings.NewReader("put"))))
+	require.Equal(t, "PATCH application/json {}", read(client.Patch(ts.URL, "application/json", []byte("{}"))))
+	require.Equal(t, "DELETE  ", read(client.Delete(ts.URL)))
+}
+
+func TestClientMaxInFlightPerHost_Do(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			previous := maxInFlight.Load()
+			if current <= previous || maxInFlight.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryMax:           0,
+		Timeout:            5 * time.Second,
+		MaxInFlightPerHost: 2,
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(ts.URL)
+			require.Nil(t, err)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(2), maxInFlight.Load())
+}
+
+func TestClientCollectResolvedIPs_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	require.Nil(t, err)
+
+	client := NewClient(Options{Timeout: 5 * time.Second, CollectResolvedIPs: true})
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest(http.MethodGet, "http://localhost:"+port, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, []string{"127.0.0.1"}, req.ResolvedAddrs)
+	}
+
+	// the addresses are the ones of the final attempt, each attempt resolves the host again
+	var hits atomic.Int32
+	retried := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer retried.Close()
+	_, port, err = net.SplitHostPort(retried.Listener.Addr().String())
+	require.Nil(t, err)
+	client = NewClient(Options{
+		RetryMax:           2,
+		RetryWaitMin:       time.Millisecond,
+		RetryWaitMax:       time.Millisecond,
+		Timeout:            5 * time.Second,
+		CheckRetry:         RetryOnStatusCodes(http.StatusServiceUnavailable),
+		CollectResolvedIPs: true,
+		HttpClient:         &http.Client{Transport: &http.Transport{DisableKeepAlives: true}},
+	})
+	req, err := NewRequest(http.MethodGet, "http://localhost:"+port, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 2, req.Metrics.Retries)
+	require.Contains(t, req.ResolvedAddrs, "127.0.0.1")
+	seen := make(map[string]bool)
+	for _, addr := range req.ResolvedAddrs {
+		require.False(t, seen[addr], "duplicate address %s in %v", addr, req.ResolvedAddrs)
+		seen[addr] = true
+	}
+}
+
+func TestRequestCookies(t *testing.T) {
+	req, err := NewRequest(http.MethodGet, "https://example.com/?a=b", nil)
+	require.Nil(t, err)
+	req.AddCookie(&http.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&http.Cookie{Name: "b", Value: "2"})
+	require.Equal(t, "a=1; b=2", req.Header.Get("Cookie"))
+
+	req.SetCookies([]*http.Cookie{{Name: "c", Value: "3"}})
+	req.Update()
+	cookies := req.Cookies()
+	require.Len(t, cookies, 1)
+	require.Equal(t, "c", cookies[0].Name)
+
+	clone := req.Clone(context.Background())
+	clone.AddCookie(&http.Cookie{Name: "d", Value: "4"})
+	require.Len(t, clone.Cookies(), 2)
+	require.Len(t, req.Cookies(), 1)
+}
+
+func TestClientCookieJarRetry_Do(t *testing.T) {
+	var hits atomic.Int32
+	var cookieHeaders []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookieHeaders = append(cookieHeaders, r.Header.Get("Cookie"))
+		if hits.Add(1) == 1 {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "jar"})
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.Nil(t, err)
+	httpClient := DefaultPooledClient()
+	httpClient.Jar = jar
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+		HttpClient:   httpClient,
+	})
+
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.AddCookie(&http.Cookie{Name: "user", Value: "set"})
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+
+	// jar cookies are sent once on each attempt
+	require.Equal(t, []string{"", "user=set; session=jar", "user=set; session=jar", "user=set; session=jar"}, cookieHeaders)
+	require.Equal(t, "user=set", req.Header.Get("Cookie"))
+}
+
+func TestClientRedirectBody_Do(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s auth=%s", r.Method, body, r.Header.Get("Authorization"))
+	}))
+	defer target.Close()
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same-host":
+			http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+		case "/cross-host":
+			http.Redirect(w, r, target.URL, http.StatusPermanentRedirect)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s auth=%s", r.Method, body, r.Header.Get("Authorization"))
+		}
+	}))
+	defer redirector.Close()
+
+	send := func(client *Client, path string) string {
+		req, err := NewRequest(http.MethodPut, redirector.URL+path, strings.NewReader("payload"))
+		require.Nil(t, err)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+
+	client := NewClient(Options{Timeout: 5 * time.Second})
+	require.Equal(t, "PUT payload auth=Bearer token", send(client, "/same-host"))
+	// the body follows cross origin redirects while credentials don't
+	require.Equal(t, "PUT payload auth=", send(client, "/cross-host"))
+
+	client = NewClient(Options{Timeout: 5 * time.Second, ForwardAuthOnRedirect: true})
+	require.Equal(t, "PUT payload auth=Bearer token", send(client, "/cross-host"))
+}
+
+func TestClientDialWebSocket(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(bufrw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", websocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		_ = bufrw.Flush()
+		// echo back the raw bytes
+		_, _ = io.Copy(conn, bufrw)
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	client := NewClient(Options{Timeout: 5 * time.Second})
+	header := http.Header{"X-Token": []string{"secret"}}
+	for _, serverURL := range []string{ts.URL, tlsServer.URL} {
+		wsURL := "ws" + strings.TrimPrefix(serverURL, "http")
+		conn, resp, err := client.DialWebSocket(wsURL, header)
+		require.Nil(t, err)
+		require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+		_, err = conn.Write([]byte("ping"))
+		require.Nil(t, err)
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		require.Nil(t, err)
+		require.Equal(t, "ping", string(buf))
+		conn.Close()
+	}
+
+	_, resp, err := client.DialWebSocket("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	require.ErrorIs(t, err, ErrBadHandshake)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// the context cancels the wait between the retries and a stalled handshake
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	refusedURL := "ws://" + refused.Addr().String()
+	refused.Close()
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer stalled.Close()
+	retryClient := NewClient(Options{
+		RetryMax:     5,
+		RetryWaitMin: 10 * time.Second,
+		RetryWaitMax: 10 * time.Second,
+		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			return err != nil, nil
+		},
+	})
+	for _, wsURL := range []string{refusedURL, "ws://" + stalled.Addr().String()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, _, err = retryClient.DialWebSocketContext(ctx, wsURL, nil)
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded, wsURL)
+		require.Less(t, time.Since(start), 5*time.Second, wsURL)
+	}
+
+	require.Nil(t, client.Shutdown(context.Background()))
+	_, _, err = client.DialWebSocket("ws"+strings.TrimPrefix(ts.URL, "http"), header)
+	require.ErrorIs(t, err, ErrClientClosed)
+}
+
+func TestNewMultipartRequest_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail the first attempt to check the body is replayed
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("upload")
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		content, _ := io.ReadAll(file)
+		fmt.Fprintf(w, "%s %s %s %s", r.FormValue("name"), r.FormValue("kind"), header.Filename, content)
+	}))
+	defer ts.Close()
+
+	req, err := NewMultipartRequest(http.MethodPost, ts.URL,
+		map[string]string{"name": "report", "kind": "txt"},
+		map[string]io.Reader{"upload": strings.NewReader("file content")},
+	)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data; boundary="))
+	require.Greater(t, req.ContentLength, int64(0))
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     1,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "report txt upload file content", string(body))
+}
+
+func TestReadAndReuse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "response body")
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{Timeout: 5 * time.Second, CollectConnStats: true})
+	for i := 0; i < 2; i++ {
+		req, err := NewRequest(http.MethodGet, ts.URL, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+
+		data, err := ReadAndReuse(req, resp, 4)
+		require.Nil(t, err)
+		require.Equal(t, "resp", string(data))
+		// the body is still readable
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Equal(t, "resp", string(body))
+		require.Equal(t, 0, req.Metrics.DrainErrors)
+	}
+
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	data, err := ReadAndReuse(req, resp, 1024)
+	require.Nil(t, err)
+	require.Equal(t, "response body", string(data))
+	// fully read bodies free their connection for reuse
+	resp, err = client.Get(ts.URL)
+	require.Nil(t, err)
+	_, _ = ReadAndReuse(req, resp, 1024)
+	require.Greater(t, client.ConnStats().ReusedConnections, uint64(0))
+}
+
+func TestPerRequestTimeoutRatio(t *testing.T) {
+	tests := []struct {
+		options Options
+		timeout time.Duration
+	}{
+		// legacy rule, whole seconds above 15s
+		{Options{Timeout: 20 * time.Second, RetryMax: 2}, 6 * time.Second},
+		{Options{Timeout: 10 * time.Second, RetryMax: 2}, 10 * time.Second},
+		{Options{Timeout: 2 * time.Second, RetryMax: 2, PerRequestTimeoutRatio: 0.3}, 600 * time.Millisecond},
+		{Options{Timeout: 20 * time.Second, RetryMax: 0, PerRequestTimeoutRatio: 0.5}, 10 * time.Second},
+		// capped at the client timeout
+		{Options{Timeout: 2 * time.Second, PerRequestTimeoutRatio: 2}, 2 * time.Second},
+		{Options{Timeout: 20 * time.Second, RetryMax: 2, PerRequestTimeoutRatio: -1}, 20 * time.Second},
+		{Options{Timeout: 20 * time.Second, RetryMax: 2, PerRequestTimeoutRatio: 0.5, NoAdjustTimeout: true}, 20 * time.Second},
+	}
+	for _, test := range tests {
+		client := NewClient(test.options)
+		require.Equal(t, test.timeout, client.HTTPClient.Timeout)
+	}
+}
+
+func TestClientDoBatch(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			current := maxInFlight.Load()
+			if n <= current || maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, r.URL.Query().Get("id"))
+	}))
+	defer ts.Close()
+
+	client := NewClient(DefaultOptionsSingle)
+
+	var reqs []*Request
+	for i := 0; i < 10; i++ {
+		req, err := NewRequest(http.MethodGet, fmt.Sprintf("%s/?id=%d", ts.URL, i), nil)
+		require.Nil(t, err)
+		reqs = append(reqs, req)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelledReq, err := NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	reqs = append(reqs, cancelledReq)
+
+	results := client.DoBatch(reqs, 3)
+	require.Len(t, results, len(reqs))
+	for i, result := range results[:10] {
+		require.Nil(t, result.Err)
+		require.Same(t, reqs[i], result.Request)
+		body, err := io.ReadAll(result.Response.Body)
+		require.Nil(t, err)
+		result.Response.Body.Close()
+		require.Equal(t, fmt.Sprint(i), string(body))
+	}
+	require.ErrorIs(t, results[10].Err, context.Canceled)
+	require.Nil(t, results[10].Response)
+	require.LessOrEqual(t, maxInFlight.Load(), int32(3))
+}
+
+func TestBodyBytesMetrics_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write(bytes.Repeat([]byte("a"), 1000))
+	}))
+	defer ts.Close()
+
+	client := NewClient(DefaultOptionsSingle)
+	req, err := NewRequest(http.MethodPost, ts.URL, "hello")
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), req.Metrics.RequestBodyBytes)
+	require.Equal(t, int64(0), atomic.LoadInt64(&req.Metrics.ResponseBodyBytes))
+
+	// abandoning the body early counts what was actually read
+	_, err = io.ReadFull(resp.Body, make([]byte, 10))
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, int64(10), atomic.LoadInt64(&req.Metrics.ResponseBodyBytes))
+
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), req.Metrics.RequestBodyBytes)
+	require.Equal(t, int64(1000), atomic.LoadInt64(&req.Metrics.ResponseBodyBytes))
+}
+
+func TestProtocolMetrics_Do(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+
+	protocol := func(client *Client, url string) string {
+		req, err := NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return req.Metrics.Protocol
+	}
+
+	require.Equal(t, "HTTP/1.1", protocol(NewClient(DefaultOptionsSingle), ts.URL))
+	require.Equal(t, "HTTP/2.0", protocol(NewClient(Options{HttpClient: h2Server.Client()}), h2Server.URL))
+}
+
+func TestNormalizePath_Do(t *testing.T) {
+	var requestURI string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestURI = r.RequestURI
+	}))
+	defer ts.Close()
+
+	rawURL := ts.URL + "/a/./b/../c%41/%0d%0a/?x=%2e%2e"
+	for _, tc := range []struct {
+		normalize bool
+		expected  string
+	}{
+		{normalize: false, expected: "/a/./b/../c%41/%0d%0a/?x=%2e%2e"},
+		{normalize: true, expected: "/a/cA/%0D%0A/?x=%2e%2e"},
+	} {
+		options := DefaultOptionsSingle
+		options.NormalizePath = tc.normalize
+		client := NewClient(options)
+
+		urlx, err := urlutil.ParseURL(rawURL, true)
+		require.Nil(t, err)
+		req, err := NewRequestFromURL(http.MethodGet, urlx, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, tc.expected, requestURI, "normalize %v", tc.normalize)
+		// the request url is left untouched
+		require.Equal(t, "/a/./b/../c%41/%0d%0a/", req.Request.URL.EscapedPath())
+	}
+
+	options := DefaultOptionsSingle
+	options.NormalizePath = true
+	client := NewClient(options)
+	urlx, err := urlutil.ParseURL(ts.URL+"/%zz", true)
+	require.Nil(t, err)
+	req, err := NewRequestFromURL(http.MethodGet, urlx, nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.ErrorContains(t, err, "invalid path encoding")
+}
+
+func TestClientStandardClient(t *testing.T) {
+	var hits atomic.Int32
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if hits.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     3,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	standardClient := client.StandardClient()
+
+	resp, err := standardClient.Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+
+	// the request context is honored
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	_, err = standardClient.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRequestTrailer_Do(t *testing.T) {
+	body := "chunked body"
+	req, err := NewRequest(http.MethodPost, "http://127.0.0.1:8080/echoTrailer", body)
+	require.Nil(t, err)
+	req.Trailer = http.Header{"X-Checksum": []string{"5d41402a"}}
+
+	dump, err := req.Dump()
+	require.Nil(t, err)
+	require.Contains(t, string(dump), "Transfer-Encoding: chunked")
+	require.Contains(t, string(dump), "Trailer: X-Checksum")
+	require.True(t, strings.HasSuffix(string(dump), "0\r\nX-Checksum: 5d41402a\r\n\r\n"), string(dump))
+
+	client := NewClient(DefaultOptionsSingle)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, body+"\nX-Checksum: 5d41402a\n", string(respBody))
+	require.Equal(t, int64(len(body)), req.ContentLength)
+}
+
+func TestClientConnect(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, bufrw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(bufrw, "HTTP/1.1 200 Connection established\r\n\r\n")
+		_ = bufrw.Flush()
+		go func() {
+			_, _ = io.Copy(target, bufrw)
+		}()
+		_, _ = io.Copy(conn, target)
+	}))
+	defer proxy.Close()
+
+	client := NewClient(Options{Timeout: 5 * time.Second})
+	header := http.Header{"Proxy-Authorization": []string{"Basic dXNlcjpwYXNz"}}
+	conn, resp, err := client.Connect(proxy.URL, "127.0.0.1:8080", header)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	defer conn.Close()
+
+	// the tunnel reaches buggyhttp
+	_, err = fmt.Fprint(conn, "GET /foo HTTP/1.1\r\nHost: 127.0.0.1:8080\r\n\r\n")
+	require.Nil(t, err)
+	tunnelResp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.Nil(t, err)
+	body, err := io.ReadAll(tunnelResp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "foo", string(body))
+
+	_, resp, err = client.Connect(proxy.URL, "127.0.0.1:8080", nil)
+	require.ErrorIs(t, err, ErrTunnelRejected)
+	require.Equal(t, http.StatusProxyAuthRequired, resp.StatusCode)
+
+	// the context cancels the wait between the retries and a stalled request
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	refusedURL := "http://" + refused.Addr().String()
+	refused.Close()
+	stalled, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer stalled.Close()
+	retryClient := NewClient(Options{
+		RetryMax:     5,
+		RetryWaitMin: 10 * time.Second,
+		RetryWaitMax: 10 * time.Second,
+		CheckRetry: func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+			return err != nil, nil
+		},
+	})
+	for _, proxyURL := range []string{refusedURL, "http://" + stalled.Addr().String()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		_, _, err = retryClient.ConnectContext(ctx, proxyURL, "127.0.0.1:8080", nil)
+		cancel()
+		require.ErrorIs(t, err, context.DeadlineExceeded, proxyURL)
+		require.Less(t, time.Since(start), 5*time.Second, proxyURL)
+	}
+}
+
+func TestClientOnRetry_Do(t *testing.T) {
+	buggyhttp.Reset()
+	expectedRetries := 3
+	req, err := NewRequest("GET", fmt.Sprintf("http://127.0.0.1:8080/successAfter?successAfter=%d", expectedRetries), nil)
+	require.Nil(t, err)
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     6,
+	})
+	var attempts []int
+	client.OnRetry = func(r *http.Request, attempt int, wait time.Duration, lastErr error) {
+		require.Equal(t, req.URL.String(), r.URL.String())
+		require.NotNil(t, lastErr)
+		require.GreaterOrEqual(t, wait, 10*time.Millisecond)
+		require.LessOrEqual(t, wait, 50*time.Millisecond)
+		attempts = append(attempts, attempt)
+	}
+
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, []int{1, 2, 3}, attempts)
+}
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// the host only answers on ipv4, ipv6 connections hang as if firewalled
+	ipv6Cancelled := make(chan struct{})
+	dialer := &happyEyeballsDialer{
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if strings.HasPrefix(addr, "[") {
+				<-ctx.Done()
+				close(ipv6Cancelled)
+				return nil, ctx.Err()
+			}
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+		lookup: func(ctx context.Context, host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")}, nil
+		},
+		delay: 50 * time.Millisecond,
+	}
+
+	start := time.Now()
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("dualstack.test", port))
+	require.Nil(t, err)
+	conn.Close()
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Less(t, time.Since(start), time.Second)
+	select {
+	case <-ipv6Cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("ipv6 dial was not cancelled")
+	}
+
+	// a failing preferred family starts the fallback without waiting
+	dialer.delay = time.Hour
+	dialer.dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if strings.HasPrefix(addr, "[") {
+			return nil, errors.New("network unreachable")
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	conn, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("dualstack.test", port))
+	require.Nil(t, err)
+	conn.Close()
+
+	client := NewClient(Options{Timeout: 5 * time.Second, HappyEyeballs: true})
+	resp, err := client.Get("http://localhost:8080/foo")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "foo", string(body))
+}
+
+func TestClientWith(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     1,
+		Timeout:      5 * time.Second,
+		UserAgent:    "original",
+	})
+	var logged atomic.Int32
+	client.RequestLogHook = func(r *http.Request, i int) {
+		logged.Add(1)
+	}
+
+	clone := client.With(func(options *Options) {
+		options.RetryMax = 3
+		options.Timeout = 10 * time.Second
+		options.CheckRetry = RetryOnStatusCodes(http.StatusServiceUnavailable)
+	})
+	require.Same(t, client.HTTPClient.Transport, clone.HTTPClient.Transport)
+	require.Same(t, client.HTTPClient2.Transport, clone.HTTPClient2.Transport)
+	require.NotSame(t, client.HTTPClient, clone.HTTPClient)
+	require.Equal(t, 5*time.Second, client.HTTPClient.Timeout)
+	require.Equal(t, 10*time.Second, clone.HTTPClient.Timeout)
+	require.Len(t, clone.OnBeforeRequest, 1)
+
+	// the retry policy of the clone doesn't affect the client
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, int32(1), hits.Load())
+
+	_, err = clone.Get(ts.URL)
+	require.ErrorIs(t, err, &RetriesExhaustedError{})
+	require.Equal(t, int32(5), hits.Load())
+	require.Equal(t, int32(5), logged.Load())
+
+	// transport options rebuild the transports
+	sprayingClone := client.With(func(options *Options) {
+		options.KillIdleConn = true
+	})
+	require.NotSame(t, client.HTTPClient.Transport, sprayingClone.HTTPClient.Transport)
+}
+
+func TestDisableHTTP2Coalescing_Do(t *testing.T) {
+	var mu sync.Mutex
+	var remoteAddrs map[string]map[string]struct{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// http/1.x requests get the malformed version making the client switch to http/2
+		if r.ProtoMajor == 1 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_, _ = conn.Write([]byte("HTTP/2 200 OK\r\nContent-Length: 0\r\n\r\n"))
+				conn.Close()
+			}
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if remoteAddrs[r.Host] == nil {
+			remoteAddrs[r.Host] = make(map[string]struct{})
+		}
+		remoteAddrs[r.Host][r.RemoteAddr] = struct{}{}
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		disableCoalescing bool
+		connections       int
+	}{
+		{disableCoalescing: false, connections: 1},
+		{disableCoalescing: true, connections: 2},
+	} {
+		remoteAddrs = make(map[string]map[string]struct{})
+		client := NewClient(Options{
+			RetryMax:               0,
+			Timeout:                5 * time.Second,
+			TLSMinVersion:          tls.VersionTLS10,
+			DisableHTTP2Coalescing: tc.disableCoalescing,
+		})
+		// keep-alive http/2 transport sharing connections across virtual hosts
+		transport := &http.Transport{TLSClientConfig: defaultTLSConfig()}
+		require.Nil(t, http2.ConfigureTransport(transport))
+		if tc.disableCoalescing {
+			client.HTTPClient2.Transport.(*authorityTransport).newTransport = func() (http.RoundTripper, error) {
+				transport := &http.Transport{TLSClientConfig: defaultTLSConfig()}
+				return transport, http2.ConfigureTransport(transport)
+			}
+		} else {
+			client.HTTPClient2.Transport = transport
+		}
+		for i := 0; i < 4; i++ {
+			req, err := NewRequest(http.MethodGet, ts.URL, nil)
+			require.Nil(t, err)
+			req.Request.Host = fmt.Sprintf("vhost%d.test", i%2)
+			resp, err := client.Do(req)
+			require.Nil(t, err)
+			resp.Body.Close()
+			require.Equal(t, "HTTP/2.0", resp.Proto)
+		}
+		client.HTTPClient2.CloseIdleConnections()
+
+		connections := make(map[string]struct{})
+		for _, hostAddrs := range remoteAddrs {
+			require.Len(t, hostAddrs, 1)
+			for addr := range hostAddrs {
+				connections[addr] = struct{}{}
+			}
+		}
+		require.Len(t, connections, tc.connections)
+	}
+}
+
+func TestAuthorityTransportEviction(t *testing.T) {
+	var created []*closeCounter
+	transport := &authorityTransport{
+		maxTransports: 2,
+		newTransport: func() (http.RoundTripper, error) {
+			created = append(created, &closeCounter{})
+			return created[len(created)-1], nil
+		},
+	}
+	for _, host := range []string{"a.test", "b.test", "a.test", "c.test"} {
+		_, err := transport.RoundTrip(&http.Request{Host: host, URL: &url.URL{Host: host}})
+		require.Nil(t, err)
+	}
+	// b is the least recently used
+	require.Len(t, created, 3)
+	require.Equal(t, 0, created[0].closed)
+	require.Equal(t, 1, created[1].closed)
+	require.Len(t, transport.transports, 2)
+}
+
+// closeCounter is a round tripper counting the calls to CloseIdleConnections
+type closeCounter struct {
+	closed int
+}
+
+func (c *closeCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func (c *closeCounter) CloseIdleConnections() {
+	c.closed++
+}
+
+func TestCaptureExchange_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("X-Reply", "yes")
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin:    10 * time.Millisecond,
+		RetryWaitMax:    10 * time.Millisecond,
+		RetryMax:        2,
+		CheckRetry:      RetryOnStatusCodes(http.StatusServiceUnavailable),
+		CaptureExchange: true,
+	})
+	req, err := NewRequest(http.MethodPost, ts.URL+"/path", "request body")
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(body))
+
+	require.NotNil(t, req.Exchange)
+	require.True(t, strings.HasPrefix(string(req.Exchange.Request), "POST /path HTTP/1.1\r\n"))
+	require.True(t, strings.HasSuffix(string(req.Exchange.Request), "\r\n\r\nrequest body"))
+	require.True(t, strings.HasPrefix(string(req.Exchange.Response), "HTTP/1.1 200 OK\r\n"))
+	require.Contains(t, string(req.Exchange.Response), "X-Reply: yes")
+	require.True(t, strings.HasSuffix(string(req.Exchange.Response), "\r\n\r\nok"))
+	require.Empty(t, req.Exchange.AttemptErrors)
+
+	req, err = NewRequest(http.MethodGet, "http://127.0.0.1:8080/emptyResponse", nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, ErrConnectionClosedWithoutResponse)
+	require.Len(t, req.Exchange.AttemptErrors, 3)
+	require.Nil(t, req.Exchange.Response)
+	require.True(t, strings.HasPrefix(string(req.Exchange.Request), "GET /emptyResponse HTTP/1.1\r\n"))
+
+	// only the beginning of the response body is captured
+	client = NewClient(Options{RetryMax: 0, CaptureExchange: true, RespReadLimit: 1})
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(body))
+	require.True(t, strings.HasSuffix(string(req.Exchange.Response), "\r\n\r\no"))
+
+	// nothing is captured by default
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err = NewClient(DefaultOptionsSingle).Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Nil(t, req.Exchange)
+}
+
+func TestClientHARRecording(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s", r.URL.Query().Get("id"), body)
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	recorder := NewHARRecorder(&buf)
+	options := DefaultOptionsSingle
+	options.HARRecorder = recorder
+	client := NewClient(options)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := client.Post(fmt.Sprintf("%s/?id=%d", ts.URL, i), "text/plain", "payload")
+			require.Nil(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.Nil(t, err)
+			resp.Body.Close()
+			require.Equal(t, fmt.Sprintf("%d payload", i), string(body))
+		}(i)
+	}
+	wg.Wait()
+	require.Nil(t, recorder.Close())
+
+	var har struct {
+		Log struct {
+			Version string
+			Creator struct{ Name, Version string }
+			Entries []struct {
+				StartedDateTime string
+				Time            float64
+				Request         struct {
+					Method      string
+					URL         string
+					QueryString []struct{ Name, Value string }
+					PostData    struct{ MimeType, Text string }
+				}
+				Response struct {
+					Status  int
+					Content struct {
+						Size     int
+						MimeType string
+						Text     string
+					}
+				}
+				Timings struct{ Send, Wait, Receive float64 }
+			}
+		}
+	}
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &har))
+	require.Equal(t, "1.2", har.Log.Version)
+	require.Equal(t, "retryablehttp-go", har.Log.Creator.Name)
+	require.Equal(t, libraryVersion(), har.Log.Creator.Version)
+	require.Len(t, har.Log.Entries, 5)
+	for _, entry := range har.Log.Entries {
+		require.Equal(t, http.MethodPost, entry.Request.Method)
+		require.True(t, strings.HasPrefix(entry.Request.URL, ts.URL+"/?id="))
+		id := entry.Request.QueryString[0].Value
+		require.Equal(t, "text/plain", entry.Request.PostData.MimeType)
+		require.Equal(t, "payload", entry.Request.PostData.Text)
+		require.Equal(t, http.StatusOK, entry.Response.Status)
+		require.Equal(t, id+" payload", entry.Response.Content.Text)
+		require.Equal(t, "text/plain", entry.Response.Content.MimeType)
+		_, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+		require.Nil(t, err)
+		require.GreaterOrEqual(t, entry.Time, entry.Timings.Send+entry.Timings.Wait+entry.Timings.Receive)
+	}
+
+	// documents without entries are valid too
+	buf.Reset()
+	require.Nil(t, NewHARRecorder(&buf).Close())
+	require.Nil(t, json.Unmarshal(buf.Bytes(), &har))
+	require.Empty(t, har.Log.Entries)
+}
+
+func TestDialTimeout_Do(t *testing.T) {
+	// non routable address, dials hang until they time out
+	const blackholed = "http://10.255.255.1/"
+
+	client := NewClient(Options{
+		RetryMax:    0,
+		Timeout:     10 * time.Second,
+		DialTimeout: 500 * time.Millisecond,
+	})
+	start := time.Now()
+	resp, err := client.Get(blackholed)
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), 5*time.Second, "the dial must time out before the request")
+}
+
+func TestCheckRetryWithBody_Do(t *testing.T) {
+	client := NewClient(Options{
+		RetryWaitMin:  10 * time.Millisecond,
+		RetryWaitMax:  10 * time.Millisecond,
+		RetryMax:      2,
+		Timeout:       5 * time.Second,
+		RespReadLimit: 64,
+		CheckRetryWithBody: func(ctx context.Context, resp *http.Response, err error, bodyPeek []byte) (bool, error) {
+			if err != nil {
+				return CheckRecoverableErrors(ctx, resp, err)
+			}
+			return bytes.Contains(bodyPeek, []byte("Access Denied")), nil
+		},
+	})
+	client.ErrorHandler = PassthroughErrorHandler
+	var attempts int
+	client.RequestLogHook = func(r *http.Request, i int) {
+		attempts++
+	}
+
+	// the block page is retried but still readable once the retries are exhausted
+	resp, err := client.Get("http://127.0.0.1:8080/blocked")
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, 3, attempts)
+	require.Contains(t, string(body), "blocked by the web application firewall")
+
+	attempts = 0
+	resp, err = client.Get("http://127.0.0.1:8080/foo")
+	require.Nil(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, 1, attempts)
+	require.Equal(t, "foo", string(body))
+}
+
+// keepAliveRecorder records the keep-alive settings of a connection
+type keepAliveRecorder struct {
+	net.Conn
+	enabled bool
+	period  time.Duration
+}
+
+func (c *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	c.enabled = keepalive
+	return nil
+}
+
+func (c *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	c.period = d
+	return nil
+}
+
+func TestTCPKeepAlive(t *testing.T) {
+	conn := &keepAliveRecorder{}
+	setKeepAlive(conn, 15*time.Second)
+	require.True(t, conn.enabled)
+	require.Equal(t, 15*time.Second, conn.period)
+	setKeepAlive(conn, -1)
+	require.False(t, conn.enabled)
+
+	// requests are sent over connections without keep-alives
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, TCPKeepAlive: -1})
+	resp, err := client.Get("http://127.0.0.1:8080/foo")
+	require.Nil(t, err)
+	resp.Body.Close()
+}
+
+func TestClientDoAll(t *testing.T) {
+	var calls atomic.Int32
+	statuses := []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusOK}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[int(calls.Add(1)-1)%len(statuses)]
+		w.WriteHeader(status)
+		fmt.Fprintf(w, "status %d", status)
+	}))
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin:  10 * time.Millisecond,
+		RetryWaitMax:  10 * time.Millisecond,
+		RetryMax:      3,
+		Timeout:       5 * time.Second,
+		RespReadLimit: 4096,
+		CheckRetry:    RetryOnStatusCodes(http.StatusServiceUnavailable, http.StatusInternalServerError),
+	}
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	responses, err := NewClient(options).DoAll(req)
+	require.Nil(t, err)
+	require.Len(t, responses, 3)
+	for i, resp := range responses {
+		require.Equal(t, statuses[i], resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Equal(t, fmt.Sprintf("status %d", statuses[i]), string(body))
+	}
+
+	// responses of exhausted retries are returned along with the error
+	calls.Store(0)
+	options.RetryMax = 1
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	responses, err = NewClient(options).DoAll(req)
+	require.ErrorAs(t, err, new(*RetriesExhaustedError))
+	require.Len(t, responses, 2)
+	require.Equal(t, http.StatusInternalServerError, responses[1].StatusCode)
+	body, err := io.ReadAll(responses[1].Body)
+	require.Nil(t, err)
+	require.Equal(t, "status 500", string(body))
+}
+
+func TestLocalAddr_Do(t *testing.T) {
+	remoteAddrs := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}})
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	host, _, err := net.SplitHostPort(<-remoteAddrs)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1", host)
+
+	// an ipv6 source can't reach an ipv4 destination
+	client = NewClient(Options{RetryMax: 2, Timeout: 5 * time.Second, LocalAddr: &net.TCPAddr{IP: net.ParseIP("::1")}})
+	_, err = client.Get(ts.URL)
+	require.ErrorIs(t, err, ErrAddressFamilyMismatch)
+}
+
+func TestRequestEnableTrace_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, KillIdleConn: false})
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Nil(t, req.Metrics.Trace, "tracing is disabled by default")
+
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.EnableTrace()
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	trace := req.Metrics.Trace
+	require.NotNil(t, trace)
+	require.Positive(t, trace.WroteRequest)
+	require.GreaterOrEqual(t, trace.GotFirstResponseByte, trace.WroteRequest)
+	require.Contains(t, trace.String(), "Got first response byte: ")
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRequestTransport_Do(t *testing.T) {
+	var served atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if served.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, r.Header.Get("X-Middleware"))
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	client.OnBeforeRequest = append(client.OnBeforeRequest, func(client *Client, req *Request) error {
+		req.Header.Set("X-Middleware", "applied")
+		return nil
+	})
+
+	var roundTrips int
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		roundTrips++
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "applied", string(body))
+	require.Equal(t, 2, roundTrips)
+	require.Equal(t, 1, req.Metrics.Retries)
+
+	// the client transport is used again without it
+	req.Transport = nil
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 2, roundTrips)
+}
+
+func TestDetectContentType_Do(t *testing.T) {
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt fails so that the body is sent again
+		if calls.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Content-Type", r.Header.Get("Content-Type"))
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin:      10 * time.Millisecond,
+		RetryWaitMax:      10 * time.Millisecond,
+		RetryMax:          1,
+		Timeout:           5 * time.Second,
+		CheckRetry:        RetryOnStatusCodes(http.StatusServiceUnavailable),
+		DetectContentType: true,
+	})
+	send := func(body string, contentType string) (string, string) {
+		req, err := NewRequest(http.MethodPost, ts.URL, body)
+		require.Nil(t, err)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		received, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.Header.Get("X-Content-Type"), string(received)
+	}
+
+	jsonBody := `{"name": "` + strings.Repeat("a", 1000) + `"}`
+	for _, tc := range []struct {
+		body, contentType, expected string
+	}{
+		{body: jsonBody, expected: "application/json"},
+		{body: `[1, 2]`, expected: "application/json"},
+		{body: `{not json`, expected: "text/plain; charset=utf-8"},
+		{body: "<html><body>hello</body></html>", expected: "text/html; charset=utf-8"},
+		{body: "\x89PNG\r\n\x1a\n\x00\x00", expected: "image/png"},
+		{body: jsonBody, contentType: "text/plain", expected: "text/plain"},
+	} {
+		contentType, received := send(tc.body, tc.contentType)
+		require.Equal(t, tc.expected, contentType)
+		require.Equal(t, tc.body, received, "the body must be sent intact")
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second})
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+	<-started
+
+	// the request in-flight is not done yet
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, client.Shutdown(ctx), context.DeadlineExceeded)
+
+	_, err := client.Get(ts.URL)
+	require.ErrorIs(t, err, ErrClientClosed)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+	close(release)
+
+	res := <-inFlight
+	require.Nil(t, res.err)
+	require.Equal(t, "done", res.body)
+	require.Nil(t, <-shutdown)
+}
+
+func TestUse100Continue_Do(t *testing.T) {
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusExpectationFailed, http.StatusRequestEntityTooLarge),
+	}
+	body := strings.Repeat("a", 64*1024)
+
+	// without the option the header isn't sent
+	req, err := NewRequest(http.MethodPost, "http://127.0.0.1:8080/expectContinue", body)
+	require.Nil(t, err)
+	resp, err := NewClient(options).Do(req)
+	require.Error(t, err)
+	require.Nil(t, resp)
+
+	options.Use100Continue = true
+	client := NewClient(options)
+
+	req, err = NewRequest(http.MethodPost, "http://127.0.0.1:8080/expectContinue", body)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	received, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, strconv.Itoa(len(body)), string(received))
+	require.Empty(t, req.Header.Get("Expect"), "the request header must be restored")
+
+	// the rejection is surfaced without retrying
+	req, err = NewRequest(http.MethodPost, "http://127.0.0.1:8080/rejectUpload", body)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Equal(t, 0, req.Metrics.Retries)
+}
+
+func TestRetryBudget_Do(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     5,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+		RetryBudget:  0.1,
+	})
+	client.ErrorHandler = PassthroughErrorHandler
+
+	// the initial reserve of 10 retries is spent by the first two requests
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		require.Nil(t, err)
+		resp.Body.Close()
+	}
+	require.Equal(t, int32(12), attempts.Load())
+	require.Equal(t, uint64(0), client.RetryBudgetDenied())
+
+	// the budget is exhausted, the last response is returned without retrying
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(13), attempts.Load())
+	require.Equal(t, 0, req.Metrics.Retries)
+	require.Equal(t, uint64(1), client.RetryBudgetDenied())
+}
+
+func TestHostMetrics_Do(t *testing.T) {
+	var count atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every other attempt fails
+		if count.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin:       time.Millisecond,
+		RetryWaitMax:       time.Millisecond,
+		RetryMax:           2,
+		Timeout:            5 * time.Second,
+		CheckRetry:         RetryOnStatusCodes(http.StatusServiceUnavailable),
+		CollectHostMetrics: true,
+	})
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(ts.URL)
+		require.Nil(t, err)
+		resp.Body.Close()
+	}
+	_, err := client.Get("http://127.0.0.1:1")
+	require.Error(t, err)
+
+	host := ts.Listener.Addr().String()
+	metrics := client.HostMetrics(host)
+	require.Equal(t, uint64(3), metrics.Requests)
+	require.Equal(t, uint64(3), metrics.Retries)
+	require.Equal(t, uint64(0), metrics.Errors)
+	require.Greater(t, metrics.AverageLatency, time.Duration(0))
+
+	all := client.AllHostMetrics()
+	require.Len(t, all, 2)
+	require.Equal(t, metrics, all[host])
+	require.Equal(t, uint64(1), all["127.0.0.1:1"].Requests)
+	require.Equal(t, uint64(1), all["127.0.0.1:1"].Errors)
+	require.Equal(t, uint64(1), all["127.0.0.1:1"].Failures)
+
+	require.Equal(t, HostMetrics{}, client.HostMetrics("unknown:80"))
+}
+
+func TestHeaderOrder(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:8080/socket?a=1", nil)
+	require.Nil(t, err)
+	req.Header.Set("Accept", "*/*")
+	req.Header.Set("User-Agent", "scanner")
+	req.Header.Set("X-Custom", "value")
+	req.Header["cookie"] = []string{"a=b"}
+
+	client := NewClient(Options{HeaderOrder: []string{"user-agent", "Cookie", "host", "Missing"}})
+	var buf bytes.Buffer
+	require.Nil(t, client.writeRequest(&buf, req))
+	require.Equal(t, "GET /socket?a=1 HTTP/1.1\r\n"+
+		"User-Agent: scanner\r\n"+
+		"cookie: a=b\r\n"+
+		"Host: 127.0.0.1:8080\r\n"+
+		"Accept: */*\r\n"+
+		"X-Custom: value\r\n\r\n", buf.String())
+
+	// the written request is parsed back with all its headers
+	client = NewClient(Options{RandomizeHeaderOrder: true})
+	orders := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		buf.Reset()
+		require.Nil(t, client.writeRequest(&buf, req))
+		parsed, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+		require.Nil(t, err)
+		require.Equal(t, "127.0.0.1:8080", parsed.Host)
+		require.Equal(t, "scanner", parsed.UserAgent())
+		require.Equal(t, "a=b", parsed.Header.Get("Cookie"))
+		orders[buf.String()] = true
+	}
+	require.Greater(t, len(orders), 1, "the header order must be randomized")
+
+	req.Header.Set("X-Invalid", "a\r\nb")
+	require.Error(t, client.writeRequest(&buf, req))
+}
+
+func TestSkipDecompressContentTypes_Do(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte("hello world"))
+	require.Nil(t, gz.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed.Bytes())
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryMax:                   0,
+		Timeout:                    5 * time.Second,
+		SkipDecompressContentTypes: []string{"application/octet-stream", "image/*"},
+	})
+	get := func(contentType string) (*http.Response, []byte) {
+		req, err := NewRequest(http.MethodGet, ts.URL+"?type="+url.QueryEscape(contentType), nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		require.Empty(t, req.Header.Get("Accept-Encoding"), "the request header must be restored")
+		return resp, body
+	}
+
+	resp, body := get("text/plain; charset=utf-8")
+	require.Equal(t, "hello world", string(body))
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.True(t, resp.Uncompressed)
+
+	for _, contentType := range []string{"application/octet-stream", "image/png"} {
+		resp, body = get(contentType)
+		require.Equal(t, compressed.Bytes(), body, "the body must be returned as transferred")
+		require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		require.False(t, resp.Uncompressed)
+	}
+}
+
+func TestIPv6Zone_Do(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("ipv6 loopback not available: %v", err)
+	}
+	var host atomic.Value
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host.Store(r.Host)
+	}))
+	ts.Listener.Close()
+	ts.Listener = listener
+	ts.Start()
+	defer ts.Close()
+
+	// the loopback interface is named lo on linux, lo0 on bsd and darwin
+	var zone string
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 && url.PathEscape(iface.Name) == iface.Name {
+			zone = iface.Name
+			break
+		}
+	}
+	if zone == "" {
+		t.Skip("no loopback interface usable as ipv6 zone")
+	}
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second})
+	// the zone is only used to dial, it's not sent in the Host header
+	for _, rawURL := range []string{"http://[::1%" + zone + "]:" + port + "/", "http://[::1%25" + zone + "]:" + port + "/"} {
+		resp, err := client.Get(rawURL)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, "[::1]:"+port, host.Load())
+	}
+}
+
+func TestRequestSetHostHeader_Do(t *testing.T) {
+	var hosts []string
+	var mu sync.Mutex
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		hosts = append(hosts, r.Host)
+		if len(hosts)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     1,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	// a middleware replacing the request must not drop the override
+	client.OnBeforeRequest = append(client.OnBeforeRequest, func(_ *Client, req *Request) error {
+		req.Request = req.Request.WithContext(req.Context())
+		req.Request.Host = ""
+		return nil
+	})
+
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.SetHostHeader("victim.com")
+	req.Update()
+	clone := req.Clone(context.Background())
+	for _, r := range []*Request{req, clone} {
+		resp, err := client.Do(r)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	require.Equal(t, []string{"victim.com", "victim.com", "victim.com", "victim.com"}, hosts)
+
+	// the override is kept when the url changes, which is still dialed
+	urlx, err := urlutil.Parse(ts.URL + "/path")
+	require.Nil(t, err)
+	clone.SetURL(urlx)
+	require.Equal(t, "victim.com", clone.Request.Host)
+
+	// without override the Host header follows the url
+	req, err = NewRequest(http.MethodGet, "http://example.com", nil)
+	require.Nil(t, err)
+	req.SetURL(urlx)
+	require.Equal(t, urlx.Host, req.Request.Host)
+}
+
+func TestRawIOTimeout(t *testing.T) {
+	// the server completes the tls handshake and never responds
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{generateTestCertificate(t, "tarpit")}})
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+				time.Sleep(5 * time.Second)
+			}()
+		}
+	}()
+
+	client := NewClient(Options{RetryMax: 0, RawIOTimeout: 200 * time.Millisecond})
+	start := time.Now()
+	_, err = client.DoRawBytes("https://"+listener.Addr().String(), []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestHostsMap_Do(t *testing.T) {
+	type seen struct{ host, serverName string }
+	received := make(chan seen, 1)
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- seen{host: r.Host, serverName: r.TLS.ServerName}
+	}))
+	defer ts.Close()
+	port := strconv.Itoa(ts.Listener.Addr().(*net.TCPAddr).Port)
+
+	for _, happyEyeballs := range []bool{false, true} {
+		client := NewClient(Options{
+			RetryMax:      0,
+			Timeout:       5 * time.Second,
+			HostsMap:      map[string]string{"example.com": "127.0.0.1"},
+			HappyEyeballs: happyEyeballs,
+		})
+		resp, err := client.Get("https://example.com:" + port + "/")
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, seen{host: "example.com:" + port, serverName: "example.com"}, <-received)
+	}
+}
+
+func TestDiscardN(t *testing.T) {
+	var count atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if count.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("try again"))
+			return
+		}
+		_, _ = w.Write([]byte("hello world"))
+	}))
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin:  time.Millisecond,
+		RetryWaitMax:  time.Millisecond,
+		RetryMax:      1,
+		Timeout:       5 * time.Second,
+		RespReadLimit: 4096,
+		CheckRetry:    RetryOnStatusCodes(http.StatusServiceUnavailable),
+	}
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := NewClient(options).Do(req)
+	require.Nil(t, err)
+	// the body of the retried response is drained
+	require.Equal(t, int64(len("try again")), req.Metrics.DrainedBytes)
+
+	n, err := DiscardN(req, resp, options.RespReadLimit)
+	require.Nil(t, err)
+	require.Equal(t, int64(len("hello world")), n)
+	require.Equal(t, int64(len("try again")+len("hello world")), req.Metrics.DrainedBytes)
+	require.Equal(t, 0, req.Metrics.DrainErrors)
+}
+
+func TestBodyPeekLimit_Do(t *testing.T) {
+	head := bytes.Repeat([]byte("a"), 1024)
+	tail := bytes.Repeat([]byte("b"), 1<<20)
+	peeked := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(head)
+		w.(http.Flusher).Flush()
+		// the rest of the body is only sent once the retry decision is made
+		<-peeked
+		_, _ = w.Write(tail)
+	}))
+	defer ts.Close()
+
+	var bodyPeeks [][]byte
+	client := NewClient(Options{
+		RetryMax:      0,
+		Timeout:       5 * time.Second,
+		RespReadLimit: 4096,
+		BodyPeekLimit: 100,
+		CheckRetryWithBody: func(ctx context.Context, resp *http.Response, err error, bodyPeek []byte) (bool, error) {
+			bodyPeeks = append(bodyPeeks, bodyPeek)
+			close(peeked)
+			return false, nil
+		},
+	})
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, [][]byte{head[:100]}, bodyPeeks)
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, len(head)+len(tail), len(body))
+	require.True(t, bytes.Equal(append(head, tail...), body))
+
+	// the error reading the peeked bytes is returned to the caller
+	resp, err = NewClient(Options{
+		RetryMax:      0,
+		Timeout:       5 * time.Second,
+		BodyPeekLimit: 100,
+		CheckRetryWithBody: func(ctx context.Context, resp *http.Response, err error, bodyPeek []byte) (bool, error) {
+			return false, nil
+		},
+	}).Get("http://127.0.0.1:8080/truncatedBody")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err = io.ReadAll(resp.Body)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, "foo", string(body))
+
+	// the peek doesn't wait for a stalled body past BodyPeekTimeout, nor do the reads of the caller
+	stalled, finished := make(chan struct{}), make(chan struct{})
+	stallServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(head)
+		w.(http.Flusher).Flush()
+		<-stalled
+		_, _ = w.Write([]byte("more"))
+		w.(http.Flusher).Flush()
+		<-finished
+		_, _ = w.Write(tail)
+	}))
+	defer stallServer.Close()
+	var stalledPeek []byte
+	resp, err = NewClient(Options{
+		RetryMax:        0,
+		Timeout:         5 * time.Second,
+		BodyPeekLimit:   4096,
+		BodyPeekTimeout: 100 * time.Millisecond,
+		CheckRetryWithBody: func(ctx context.Context, resp *http.Response, err error, bodyPeek []byte) (bool, error) {
+			stalledPeek = bodyPeek
+			return false, nil
+		},
+	}).Get(stallServer.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, head, stalledPeek)
+	close(stalled)
+	streamed := make([]byte, len(head)+len("more"))
+	_, err = io.ReadFull(resp.Body, streamed)
+	require.Nil(t, err)
+	require.Equal(t, append(bytes.Clone(head), "more"...), streamed)
+	close(finished)
+	body, err = io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(tail, body))
+
+	// a limit larger than the body doesn't allocate the whole window up front
+	peekResp := &http.Response{Body: io.NopCloser(strings.NewReader("foo"))}
+	require.Equal(t, "foo", string(peekBody(peekResp, 1<<62, 0)))
+	body, err = io.ReadAll(peekResp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "foo", string(body))
+}
+
+func TestDisableHTTP2_Do(t *testing.T) {
+	negotiated := make(chan string, 1)
+	h2Server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiated <- r.TLS.NegotiatedProtocol
+	}))
+	h2Server.EnableHTTP2 = true
+	h2Server.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	h2Server.StartTLS()
+	defer h2Server.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, DisableHTTP2: true})
+	req, err := NewRequest(http.MethodGet, h2Server.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "HTTP/1.1", req.Metrics.Protocol)
+	require.Equal(t, "http/1.1", <-negotiated)
+
+	// the fallback client doesn't negotiate h2 either
+	resp, err = client.HTTPClient2.Get(h2Server.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "HTTP/1.1", resp.Proto)
+	require.Equal(t, "http/1.1", <-negotiated)
+}
+
+func TestNewCompressedRequest_Do(t *testing.T) {
+	var attempts atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reader io.Reader
+		var err error
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			reader, err = gzip.NewReader(r.Body)
+		case "deflate":
+			reader, err = zlib.NewReader(r.Body)
+		case "zstd":
+			var decoder *zstd.Decoder
+			decoder, err = zstd.NewReader(r.Body)
+			if err == nil {
+				defer decoder.Close()
+			}
+			reader = decoder
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// the first attempt of each request is retried
+		if attempts.Add(1)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     1,
+		Timeout:      5 * time.Second,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+	payload := strings.Repeat(`{"key": "value"}`, 100)
+	for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+		req, err := NewCompressedRequest(http.MethodPost, ts.URL, payload, encoding)
+		require.Nil(t, err)
+		require.Less(t, req.ContentLength, int64(len(payload)))
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, encoding)
+		require.Equal(t, payload, string(body), encoding)
+	}
+
+	_, err := NewCompressedRequest(http.MethodPost, ts.URL, payload, "br")
+	require.ErrorIs(t, err, ErrUnsupportedEncoding)
+}
+
+func TestRetryMiddlewareErrors_Do(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	errToken := errors.New("token unavailable")
+	newClient := func(retryMiddlewareErrors bool) (*Client, *int) {
+		client := NewClient(Options{
+			RetryWaitMin:          time.Millisecond,
+			RetryWaitMax:          time.Millisecond,
+			RetryMax:              2,
+			Timeout:               5 * time.Second,
+			CheckRetry:            DefaultRetryPolicy(),
+			RetryMiddlewareErrors: retryMiddlewareErrors,
+		})
+		// the token is fetched at the second try
+		var calls int
+		client.OnBeforeRequest = append(client.OnBeforeRequest, func(_ *Client, req *Request) error {
+			calls++
+			if calls == 1 {
+				return errToken
+			}
+			req.Header.Set("Authorization", "Bearer token")
+			return nil
+		})
+		return client, &calls
+	}
+
+	client, calls := newClient(true)
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "Bearer token", string(body))
+	require.Equal(t, 2, *calls)
+	require.Equal(t, 1, req.Metrics.Retries)
+	require.Equal(t, int32(1), requests.Load())
+
+	// the error is returned without the option
+	client, calls = newClient(false)
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, errToken)
+	require.Equal(t, 1, *calls)
+	require.Equal(t, int32(1), requests.Load())
+}
+
+func TestRequestBodyBytesAfterDo(t *testing.T) {
+	client := NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     1,
+		Timeout:      5 * time.Second,
+	})
+	payload := "original request body"
+
+	req, err := NewRequest(http.MethodPost, "http://127.0.0.1:8080/foo", payload)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	body, err := req.BodyBytes()
+	require.Nil(t, err)
+	require.Equal(t, payload, string(body))
+
+	// the response is received before the body is fully sent
+	req, err = NewRequest(http.MethodPost, "http://127.0.0.1:8080/foo", payload)
+	require.Nil(t, err)
+	req.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		_, _ = io.ReadFull(r.Body, make([]byte, 8))
+		return &http.Response{StatusCode: http.StatusRequestEntityTooLarge, Body: http.NoBody, Request: r}, nil
+	})
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	body, err = req.BodyBytes()
+	require.Nil(t, err)
+	require.Equal(t, payload, string(body))
+	body, err = req.BodyBytes()
+	require.Nil(t, err)
+	require.Equal(t, payload, string(body))
+}
+
+func TestTCPFastOpen_Do(t *testing.T) {
+	// fastdialer is only bypassed where tcp fast open is supported
+	require.Equal(t, tcpFastOpenControl != nil, (&Options{TCPFastOpen: true}).customDialer())
+
+	// connections are redialed so that the later ones can use the cookie of the host
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, TCPFastOpen: true, KillIdleConn: true})
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("http://127.0.0.1:8080/foo")
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		require.Equal(t, "foo", string(body))
+	}
+}
+
+// tokenProvider returns a stale token first, then a valid one
+type tokenProvider struct {
+	calls atomic.Int32
+}
+
+func (p *tokenProvider) Credentials(req *http.Request) (*Auth, error) {
+	if p.calls.Add(1) == 1 {
+		return &Auth{Type: BearerAuth, Token: "stale"}, nil
+	}
+	return &Auth{Type: BearerAuth, Token: "valid"}, nil
+}
+
+func TestCredentialProvider_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer valid", "Basic dXNlcjpwYXNz":
+			fmt.Fprint(w, r.Header.Get("Authorization"))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	provider := &tokenProvider{}
+	client := NewClient(Options{
+		RetryWaitMin:       time.Millisecond,
+		RetryWaitMax:       time.Millisecond,
+		RetryMax:           2,
+		Timeout:            5 * time.Second,
+		CredentialProvider: provider,
+	})
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "Bearer valid", string(body))
+	require.Equal(t, int32(2), provider.calls.Load())
+	require.Equal(t, 1, req.Metrics.Retries)
+	// the request is left as it was
+	require.Nil(t, req.Auth)
+	require.Empty(t, req.Header.Get("Authorization"))
+
+	// the credentials of the request take precedence
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.Auth = &Auth{Type: BasicAuth, Username: "user", Password: "pass"}
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, "Basic dXNlcjpwYXNz", string(body))
+	require.Equal(t, int32(2), provider.calls.Load())
+
+	// credentials are refreshed only once
+	provider.calls.Store(0)
+	client = NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     2,
+		Timeout:      5 * time.Second,
+		CredentialProvider: credentialProviderFunc(func(req *http.Request) (*Auth, error) {
+			provider.calls.Add(1)
+			return &Auth{Type: BearerAuth, Token: "stale"}, nil
+		}),
+	})
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, int32(2), provider.calls.Load())
+}
+
+// credentialProviderFunc adapts a function to CredentialProvider
+type credentialProviderFunc func(req *http.Request) (*Auth, error)
+
+func (f credentialProviderFunc) Credentials(req *http.Request) (*Auth, error) {
+	return f(req)
+}
+
+func TestSendHTTP2Frames(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	require.Nil(t, err)
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range []hpack.HeaderField{
+		{Name: ":method", Value: http.MethodGet},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":path", Value: "/"},
+		{Name: ":authority", Value: u.Host},
+	} {
+		require.Nil(t, encoder.WriteField(field))
+	}
+
+	client := NewClient(Options{Timeout: 5 * time.Second})
+	frames, err := client.SendHTTP2Frames(ts.URL, []HTTP2Frame{
+		{Type: http2.FrameSettings},
+		{Type: http2.FrameHeaders, Flags: http2.FlagHeadersEndHeaders | http2.FlagHeadersEndStream, StreamID: 1, Payload: block.Bytes()},
+	})
+	require.Nil(t, err)
+
+	var status, body string
+	decoder := hpack.NewDecoder(4096, func(field hpack.HeaderField) {
+		if field.Name == ":status" {
+			status = field.Value
+		}
+	})
+	for _, frame := range frames {
+		switch {
+		case frame.StreamID == 1 && frame.Type == http2.FrameHeaders:
+			_, err := decoder.Write(frame.Payload)
+			require.Nil(t, err)
+		case frame.StreamID == 1 && frame.Type == http2.FrameData:
+			body += string(frame.Payload)
+		}
+	}
+	require.Equal(t, "200", status)
+	require.Equal(t, "HTTP/2.0", body)
+	last := frames[len(frames)-1]
+	require.True(t, last.Flags.Has(http2.FlagDataEndStream))
+
+	// the stream is reset by the server when the request is malformed
+	frames, err = client.SendHTTP2Frames(ts.URL, []HTTP2Frame{
+		{Type: http2.FrameSettings},
+		{Type: http2.FrameHeaders, Flags: http2.FlagHeadersEndHeaders | http2.FlagHeadersEndStream, StreamID: 1, Payload: []byte{0xff, 0xff}},
+	})
+	require.Nil(t, err)
+	last = frames[len(frames)-1]
+	require.Contains(t, []http2.FrameType{http2.FrameGoAway, http2.FrameRSTStream}, last.Type)
+}
+
+func TestMaxTotalRedirectBytes_Do(t *testing.T) {
+	chunk := strings.Repeat("a", 3000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hop, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+		if hop < 8 {
+			w.Header().Set("Location", fmt.Sprintf("/hop/%d", hop+1))
+			w.WriteHeader(http.StatusFound)
+		}
+		// chunked bodies are partially read by net/http on redirects
+		fmt.Fprint(w, chunk)
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, chunk)
+	}))
+	defer ts.Close()
+
+	newClient := func(limit int64) *Client {
+		return NewClient(Options{
+			RetryWaitMin:          time.Millisecond,
+			RetryWaitMax:          time.Millisecond,
+			RetryMax:              2,
+			Timeout:               5 * time.Second,
+			MaxTotalRedirectBytes: limit,
+		})
+	}
+
+	// the redirects stop once the limit is exceeded, without retries
+	client := newClient(5000)
+	req, err := NewRequest(http.MethodGet, ts.URL+"/hop/0", nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	require.ErrorIs(t, err, ErrResponseTooLarge)
+	require.Equal(t, 0, req.Metrics.Retries)
+
+	// the whole chain fits
+	client = newClient(1 << 20)
+	req, err = NewRequest(http.MethodGet, ts.URL+"/hop/0", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, chunk+chunk, string(body))
+
+	// the final response counts too
+	client = newClient(4000)
+	req, err = NewRequest(http.MethodGet, ts.URL+"/hop/8", nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	_, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.ErrorIs(t, err, ErrResponseTooLarge)
+}
+
+func TestRetryReasons_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	tests := []struct {
+		url        string
+		checkRetry CheckRetry
+		reason     string
+	}{
+		{"http://127.0.0.1:8080/emptyResponse", nil, "connection closed"},
+		{"http://127.0.0.1:8080/unexpectedEOF", nil, "unexpected EOF"},
+		{"http://127.0.0.1:8080/successAfter?successAfter=10", nil, "malformed HTTP status code"},
+		{ts.URL, RetryOnStatusCodes(http.StatusServiceUnavailable), "status 503"},
+	}
+	for _, test := range tests {
+		buggyhttp.Reset()
+		client := NewClient(Options{
+			RetryWaitMin: time.Millisecond,
+			RetryWaitMax: time.Millisecond,
+			RetryMax:     2,
+			Timeout:      5 * time.Second,
+			CheckRetry:   test.checkRetry,
+		})
+		client.ErrorHandler = PassthroughErrorHandler
+		req, err := NewRequest(http.MethodGet, test.url, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		require.Len(t, req.Metrics.RetryReasons, 2, test.url)
+		for _, reason := range req.Metrics.RetryReasons {
+			require.Contains(t, reason, test.reason, test.url)
+		}
+	}
+}
+
+func TestDoDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	modTime := time.Now()
+	newServer := func(acceptRanges bool) (*httptest.Server, *[]string) {
+		var ranges []string
+		var requests atomic.Int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ranges = append(ranges, r.Header.Get("Range"))
+			if requests.Add(1) == 1 {
+				// the connection drops midway through the body
+				if acceptRanges {
+					w.Header().Set("Accept-Ranges", "bytes")
+				}
+				w.Header().Set("ETag", `"v1"`)
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				_, _ = w.Write(content[:len(content)/3])
+				w.(http.Flusher).Flush()
+				panic(http.ErrAbortHandler)
+			}
+			if !acceptRanges {
+				_, _ = w.Write(content)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			http.ServeContent(w, r, "", modTime, bytes.NewReader(content))
+		}))
+		return ts, &ranges
+	}
+	client := NewClient(Options{
+		RetryWaitMin: time.Millisecond,
+		RetryWaitMax: time.Millisecond,
+		RetryMax:     2,
+		Timeout:      5 * time.Second,
+	})
+
+	// resumed from the bytes written
+	ts, ranges := newServer(true)
+	defer ts.Close()
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	var buf bytes.Buffer
+	n, err := client.DoDownload(req, &buf)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(content)), n)
+	require.Equal(t, content, buf.Bytes())
+	require.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(content)/3)}, *ranges)
+	require.Equal(t, 1, req.Metrics.Retries)
+	require.Equal(t, []string{"unexpected EOF"}, req.Metrics.RetryReasons)
+
+	// restarted without ranges
+	ts2, ranges := newServer(false)
+	defer ts2.Close()
+	req, err = NewRequest(http.MethodGet, ts2.URL, nil)
+	require.Nil(t, err)
+	buf.Reset()
+	n, err = client.DoDownload(req, &buf)
+	require.Nil(t, err)
+	require.Equal(t, int64(len(content)), n)
+	require.Equal(t, content, buf.Bytes())
+	require.Equal(t, []string{"", ""}, *ranges)
+
+	// error pages are not downloaded
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	req, err = NewRequest(http.MethodGet, notFound.URL, nil)
+	require.Nil(t, err)
+	buf.Reset()
+	_, err = client.DoDownload(req, &buf)
+	require.NotNil(t, err)
+	require.Zero(t, buf.Len())
+}
+
+func TestDisableAutoAcceptEncoding_Do(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write([]byte("hello world"))
+	require.Nil(t, gz.Close())
+
+	// gzip is sent to the clients accepting it, the accepted encodings are echoed
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fmt.Fprint(w, "hello world")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(compressed.Bytes())
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name           string
+		options        Options
+		acceptEncoding string
+		sent           string
+		compressed     bool
+	}{
+		{"default", Options{}, "", "gzip", false},
+		{"request header", Options{}, "gzip, br", "gzip, br", true},
+		{"skipped content types", Options{SkipDecompressContentTypes: []string{"image/*"}}, "", "gzip", false},
+		{"disabled", Options{DisableAutoAcceptEncoding: true}, "", "", false},
+		{"disabled with request header", Options{DisableAutoAcceptEncoding: true}, "gzip", "gzip", true},
+		{"disabled with skipped content types", Options{DisableAutoAcceptEncoding: true, SkipDecompressContentTypes: []string{"image/*"}}, "", "", false},
+	}
+	for _, test := range tests {
+		test.options.RetryMax = 0
+		test.options.Timeout = 5 * time.Second
+		client := NewClient(test.options)
+		req, err := NewRequest(http.MethodGet, ts.URL, nil)
+		require.Nil(t, err)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		resp, err := client.Do(req)
+		require.Nil(t, err, test.name)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err, test.name)
+		require.Equal(t, test.sent, resp.Header.Get("X-Accept-Encoding"), test.name)
+		if test.compressed {
+			require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"), test.name)
+			require.Equal(t, compressed.Bytes(), body, test.name)
+		} else {
+			require.Empty(t, resp.Header.Get("Content-Encoding"), test.name)
+			require.Equal(t, "hello world", string(body), test.name)
+		}
+	}
+}
+
+func TestCollectInterimResponses_Do(t *testing.T) {
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, CollectInterimResponses: true})
+	req, err := NewRequest(http.MethodGet, "http://127.0.0.1:8080/earlyHints", nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "foo", string(body))
+	require.Len(t, req.Metrics.InterimResponses, 1)
+	require.Equal(t, http.StatusEarlyHints, req.Metrics.InterimResponses[0].StatusCode)
+	require.Equal(t, "</style.css>; rel=preload; as=style", req.Metrics.InterimResponses[0].Header.Get("Link"))
+
+	// nothing is collected by default
+	req, err = NewRequest(http.MethodGet, "http://127.0.0.1:8080/earlyHints", nil)
+	require.Nil(t, err)
+	resp, err = NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second}).Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Empty(t, req.Metrics.InterimResponses)
+
+	// only the interim responses of the final attempt are kept
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", fmt.Sprintf("</attempt-%d.css>; rel=preload", hits.Add(1)))
+		w.WriteHeader(http.StatusEarlyHints)
+		if hits.Load() < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	client = NewClient(Options{
+		RetryMax:                2,
+		RetryWaitMin:            time.Millisecond,
+		RetryWaitMax:            time.Millisecond,
+		Timeout:                 5 * time.Second,
+		CheckRetry:              RetryOnStatusCodes(http.StatusServiceUnavailable),
+		CollectInterimResponses: true,
+	})
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, req.Metrics.InterimResponses, 1)
+	require.Equal(t, "</attempt-3.css>; rel=preload", req.Metrics.InterimResponses[0].Header.Get("Link"))
+}
+
+func TestDoClone(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.URL.RawQuery, r.Header.Get("X-Template"), body)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second})
+	template, err := NewRequest(http.MethodPost, ts.URL+"/?p=%0d%0a", strings.Repeat("body", 1024))
+	require.Nil(t, err)
+	template.Header.Set("X-Template", "1")
+	expected := "p=%0d%0a 1 " + strings.Repeat("body", 1024)
+
+	// the same template is sent by all the goroutines, each gets the whole body
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.DoClone(context.Background(), template)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err == nil && string(body) != expected {
+				err = fmt.Errorf("unexpected response %q", body)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Nil(t, err)
+	}
+
+	// the template is untouched and can still be sent as is
+	require.Zero(t, template.Metrics.Retries)
+	body, err := template.BodyBytes()
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat("body", 1024), string(body))
+	resp, err := client.Do(template)
+	require.Nil(t, err)
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Nil(t, err)
+	require.Equal(t, expected, string(got))
+
+	// streaming bodies can only be sent once
+	stream, err := NewStreamingRequest(http.MethodPost, ts.URL, strings.NewReader("stream"))
+	require.Nil(t, err)
+	_, err = client.DoClone(context.Background(), stream)
+	require.NotNil(t, err)
+}
+
+func TestRequestWithURL(t *testing.T) {
+	template, err := NewRequest(http.MethodPost, "http://127.0.0.1:8080/echoTrailer", "payload")
+	require.Nil(t, err)
+	template.Header.Set("X-Template", "1")
+
+	client := NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second})
+	for _, target := range []string{
+		"http://127.0.0.1:8080/echoTrailer",
+		"http://localhost:8080/echoTrailer?q=%0d%0a",
+		"http://127.0.0.1:8080/foo",
+		"http://127.0.0.1:8080/echoTrailer",
+	} {
+		req, err := template.WithURL(target)
+		require.Nil(t, err)
+		require.Equal(t, target, req.URL.String())
+		require.Equal(t, req.URL.Host, req.Host)
+		require.Equal(t, http.MethodPost, req.Method)
+		require.Equal(t, "1", req.Header.Get("X-Template"))
+
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.Nil(t, err)
+		// each clone sends the whole body
+		if strings.Contains(target, "echoTrailer") {
+			require.Equal(t, "payload\n", string(body))
+		} else {
+			require.Equal(t, "foo", string(body))
+		}
+	}
+	require.Equal(t, "http://127.0.0.1:8080/echoTrailer", template.URL.String())
+	body, err := template.BodyBytes()
+	require.Nil(t, err)
+	require.Equal(t, "payload", string(body))
+
+	// the Host header set on the template is kept
+	template.SetHostHeader("example.com")
+	req, err := template.WithURL("http://localhost:8080/foo")
+	require.Nil(t, err)
+	require.Equal(t, "example.com", req.Host)
+
+	_, err = template.WithURL("http://[::1")
+	require.NotNil(t, err)
+}
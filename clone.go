@@ -0,0 +1,94 @@
+package retryablehttp
+
+import (
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// With returns a new client built from the options of the client modified by configure.
+// The new client shares the transports, and so the connection pools, of the client unless
+// the options they're built from (KillIdleConn, HttpClient, HappyEyeballs, DisableHTTP2,
+// DisableHTTP2Coalescing, MaxResponseHeaderBytes, DisableAutoAcceptEncoding, dial, http/3
+// and tls options) are changed.
+// The http clients, bearing the timeouts and redirect policy, are always rebuilt, as is
+// the per client state (circuit breakers, in-flight limits, retry budget, connection stats
+// and host metrics).
+// Hooks are copied and so are middlewares added to the client,
+// while the user agent middleware is rebuilt from the options.
+func (c *Client) With(configure func(*Options)) *Client {
+	options := c.options
+	if configure != nil {
+		configure(&options)
+	}
+	// the timeout of the new client must not be set on the shared custom client
+	if options.HttpClient != nil {
+		httpClient := *options.HttpClient
+		options.HttpClient = &httpClient
+	}
+
+	clone := NewClient(options)
+	if clone == nil {
+		return nil
+	}
+	if sharesTransports(&c.options, &options) {
+		clone.HTTPClient.Transport = c.HTTPClient.Transport
+		clone.HTTPClient2.Transport = c.HTTPClient2.Transport
+		if c.HTTPClient3 != nil && clone.HTTPClient3 != nil {
+			clone.HTTPClient3.Transport = c.HTTPClient3.Transport
+		}
+	}
+
+	clone.RequestLogHook = c.RequestLogHook
+	clone.ResponseLogHook = c.ResponseLogHook
+	clone.ErrorHandler = c.ErrorHandler
+	clone.OnRetry = c.OnRetry
+	// skip the middlewares installed from the options of the client
+	userMiddlewares := c.OnBeforeRequest
+	if installed := len(c.options.middlewares()); len(userMiddlewares) >= installed {
+		userMiddlewares = userMiddlewares[installed:]
+	}
+	clone.OnBeforeRequest = append(clone.OnBeforeRequest, userMiddlewares...)
+	clone.OnAfterResponse = append([]ClientResponseMiddleware(nil), c.OnAfterResponse...)
+	return clone
+}
+
+// sharesTransports reports whether the transports built from the options are equivalent
+func sharesTransports(a, b *Options) bool {
+	return a.KillIdleConn == b.KillIdleConn &&
+		sameHTTPClientTransport(a.HttpClient, b.HttpClient) &&
+		a.HappyEyeballs == b.HappyEyeballs &&
+		a.DisableHTTP2Coalescing == b.DisableHTTP2Coalescing &&
+		a.DisableHTTP2 == b.DisableHTTP2 &&
+		a.MaxResponseHeaderBytes == b.MaxResponseHeaderBytes &&
+		a.DisableAutoAcceptEncoding == b.DisableAutoAcceptEncoding &&
+		a.AutoHTTP3Upgrade == b.AutoHTTP3Upgrade &&
+		a.HTTP3 == b.HTTP3 &&
+		a.HTTP3RoundTripper == b.HTTP3RoundTripper &&
+		len(a.ClientCertificates) == len(b.ClientCertificates) &&
+		(len(a.ClientCertificates) == 0 || &a.ClientCertificates[0] == &b.ClientCertificates[0]) &&
+		a.ClientCertFile == b.ClientCertFile &&
+		a.ClientKeyFile == b.ClientKeyFile &&
+		a.TLSMinVersion == b.TLSMinVersion &&
+		a.TLSMaxVersion == b.TLSMaxVersion &&
+		a.TLSHandshakeTimeout == b.TLSHandshakeTimeout &&
+		a.VerifyCertificates == b.VerifyCertificates &&
+		// callbacks can't be compared, transports using one are never shared
+		a.TLSVerifyCallback == nil && b.TLSVerifyCallback == nil &&
+		a.DialTimeout == b.DialTimeout &&
+		a.TCPKeepAlive == b.TCPKeepAlive &&
+		a.LocalAddr == b.LocalAddr &&
+		a.TCPFastOpen == b.TCPFastOpen &&
+		maps.Equal(a.HostsMap, b.HostsMap) &&
+		(a.DisableZTLSFallback == nil) == (b.DisableZTLSFallback == nil) &&
+		ztlsFallbackDisabled(a.DisableZTLSFallback) == ztlsFallbackDisabled(b.DisableZTLSFallback) &&
+		slices.Equal(a.TLSCipherSuites, b.TLSCipherSuites)
+}
+
+// sameHTTPClientTransport reports whether both custom clients are unset or use the same transport
+func sameHTTPClientTransport(a, b *http.Client) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Transport == b.Transport
+}
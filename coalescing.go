@@ -0,0 +1,119 @@
+package retryablehttp
+
+import (
+	"container/list"
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// newHTTP2Transport returns the transport of the http/2 client configured from the options
+func newHTTP2Transport(options *Options, tlsConfig *tls.Config) (*http.Transport, error) {
+	client := DefaultClient()
+	if tlsConfig != nil {
+		configureTransportTLS(client, tlsConfig, options)
+	}
+	if options.HappyEyeballs {
+		useHappyEyeballs(client, options)
+	}
+	transport := client.Transport.(*http.Transport)
+	if options.MaxResponseHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = options.MaxResponseHeaderBytes
+	}
+	if options.DisableAutoAcceptEncoding {
+		transport.DisableCompression = true
+	}
+	if options.DisableHTTP2 {
+		return transport, nil
+	}
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// maxAuthorityTransports is the number of authorities whose transports are kept by
+// authorityTransport, the least recently used ones are closed past it
+const maxAuthorityTransports = 256
+
+// authorityTransport sends the requests of each authority (the Host header, or the url
+// host when unset) over a dedicated transport, so that connections are never shared
+// between virtual hosts served from the same address
+type authorityTransport struct {
+	newTransport func() (http.RoundTripper, error)
+	// maxTransports is the number of transports kept (default: maxAuthorityTransports)
+	maxTransports int
+
+	mu         sync.Mutex
+	transports map[string]*list.Element
+	order      *list.List
+}
+
+// authorityEntry is an element of the recency list of authorityTransport
+type authorityEntry struct {
+	authority string
+	transport http.RoundTripper
+}
+
+func (t *authorityTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authority := req.Host
+	if authority == "" {
+		authority = req.URL.Host
+	}
+	transport, err := t.transport(authority)
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// transport returns the transport of the authority, evicting the least recently used
+// one when full
+func (t *authorityTransport) transport(authority string) (http.RoundTripper, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.transports == nil {
+		t.transports = make(map[string]*list.Element)
+		t.order = list.New()
+	}
+	if element, ok := t.transports[authority]; ok {
+		t.order.MoveToFront(element)
+		return element.Value.(*authorityEntry).transport, nil
+	}
+	transport, err := t.newTransport()
+	if err != nil {
+		return nil, err
+	}
+	t.transports[authority] = t.order.PushFront(&authorityEntry{authority: authority, transport: transport})
+	maxTransports := t.maxTransports
+	if maxTransports <= 0 {
+		maxTransports = maxAuthorityTransports
+	}
+	for t.order.Len() > maxTransports {
+		oldest := t.order.Back()
+		t.order.Remove(oldest)
+		entry := oldest.Value.(*authorityEntry)
+		delete(t.transports, entry.authority)
+		// the connections of in-flight requests are closed once done, keep-alives are disabled
+		closeIdleConnections(entry.transport)
+	}
+	return transport, nil
+}
+
+// CloseIdleConnections closes the idle connections of all the authorities
+func (t *authorityTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, element := range t.transports {
+		closeIdleConnections(element.Value.(*authorityEntry).transport)
+	}
+}
+
+// closeIdleConnections closes the idle connections of the transport, if supported
+func closeIdleConnections(transport http.RoundTripper) {
+	if closer, ok := transport.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
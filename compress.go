@@ -0,0 +1,43 @@
+package retryablehttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ErrUnsupportedEncoding is returned when compressing a request body with an unknown content coding
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// compressBody compresses data with the content coding: gzip, deflate (zlib format) or zstd
+func compressBody(data []byte, encoding string) ([]byte, error) {
+	var compressed bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&compressed)
+	case "deflate":
+		writer = zlib.NewWriter(&compressed)
+	case "zstd":
+		encoder, err := zstd.NewWriter(&compressed)
+		if err != nil {
+			return nil, err
+		}
+		writer = encoder
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, encoding)
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
@@ -0,0 +1,134 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// connectErrorBodyLimit is the maximum body size read from rejected CONNECT requests
+const connectErrorBodyLimit = 4096
+
+// ErrTunnelRejected is returned when the proxy doesn't establish the CONNECT tunnel
+var ErrTunnelRejected = errors.New("connect: tunnel rejected")
+
+// Connect sends a CONNECT request for addr (host:port) to the http:// or https:// proxy and
+// returns the established tunnel along with the proxy response. The header is sent with the
+// request, ex. for Proxy-Authorization. Retries apply to establishing the tunnel only, a
+// non 2xx response returns ErrTunnelRejected with the response and its body readable.
+func (c *Client) Connect(proxyURL, addr string, header http.Header) (net.Conn, *http.Response, error) {
+	return c.ConnectContext(context.Background(), proxyURL, addr, header)
+}
+
+// ConnectContext is like Connect with a context cancelling the CONNECT request and the wait
+// between its retries. The request is in-flight for Shutdown until it returns.
+func (c *Client) ConnectContext(ctx context.Context, proxyURL, addr string, header http.Header) (net.Conn, *http.Response, error) {
+	if !c.shutdown.begin() {
+		return nil, nil, ErrClientClosed
+	}
+	defer c.shutdown.inFlight.Done()
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil, &UnsupportedSchemeError{Scheme: u.Scheme, Err: fmt.Errorf("connect: unsupported proxy scheme %q", u.Scheme)}
+	}
+
+	for i := 0; ; i++ {
+		conn, resp, err := c.connectHandshake(ctx, u, addr, header)
+		if err == nil {
+			return conn, resp, nil
+		}
+		if errors.Is(err, ErrTunnelRejected) {
+			return nil, resp, err
+		}
+		if ctx.Err() != nil {
+			return nil, resp, ctx.Err()
+		}
+		if checkOK, _ := c.CheckRetry(ctx, resp, err); !checkOK || i >= c.options.RetryMax {
+			return nil, resp, err
+		}
+		timer := time.NewTimer(c.Backoff(c.options.RetryWaitMin, c.options.RetryWaitMax, i, resp))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, resp, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// connectHandshake dials the proxy and sends the CONNECT request
+func (c *Client) connectHandshake(ctx context.Context, proxy *url.URL, addr string, header http.Header) (net.Conn, *http.Response, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	dial, dialTLS := c.transportDialers()
+	var conn net.Conn
+	var err error
+	if proxy.Scheme == "https" {
+		conn, err = dialTLS(ctx, "tcp", hostPortKey(proxy))
+	} else {
+		conn, err = dial(ctx, "tcp", hostPortKey(proxy))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// a cancelled context interrupts the request reads and writes
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Opaque: addr},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       addr,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := c.writeRequest(conn, req); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		// keep the body of the rejection readable once the connection is closed
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, connectErrorBodyLimit))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		conn.Close()
+		return nil, resp, ErrTunnelRejected
+	}
+	if !stop() {
+		conn.Close()
+		return nil, nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: br}, resp, nil
+}
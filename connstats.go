@@ -0,0 +1,54 @@
+package retryablehttp
+
+import (
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// ConnStats contains the aggregate connection usage of a client
+type ConnStats struct {
+	// TotalConnections is the number of connections obtained by requests
+	TotalConnections uint64
+	// ReusedConnections is the number of connections reused from the idle pool
+	ReusedConnections uint64
+	// NewConnections is the number of newly dialed connections
+	NewConnections uint64
+}
+
+// connStats collects the connection usage when CollectConnStats is enabled
+type connStats struct {
+	reused      atomic.Uint64
+	newlyDialed atomic.Uint64
+}
+
+// ConnStats returns the connection usage of the client since creation or
+// the last ResetConnStats call. Stats are collected only if CollectConnStats is enabled.
+func (c *Client) ConnStats() ConnStats {
+	reused := c.connStats.reused.Load()
+	newlyDialed := c.connStats.newlyDialed.Load()
+	return ConnStats{
+		TotalConnections:  reused + newlyDialed,
+		ReusedConnections: reused,
+		NewConnections:    newlyDialed,
+	}
+}
+
+// ResetConnStats resets the connection usage of the client
+func (c *Client) ResetConnStats() {
+	c.connStats.reused.Store(0)
+	c.connStats.newlyDialed.Store(0)
+}
+
+// wrapContextWithConnStats installs the trace collecting the connection usage of the request
+func (c *Client) wrapContextWithConnStats(req *Request) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			if connInfo.Reused {
+				c.connStats.reused.Add(1)
+			} else {
+				c.connStats.newlyDialed.Add(1)
+			}
+		},
+	}
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
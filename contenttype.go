@@ -0,0 +1,41 @@
+package retryablehttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	readerutil "github.com/projectdiscovery/utils/reader"
+)
+
+// sniffLength is the number of bytes of the body considered to detect its content type
+const sniffLength = 512
+
+// detectContentType sets the Content-Type header of requests without one from the first
+// bytes of their body, leaving the body rewound
+func (r *Request) detectContentType() {
+	body, ok := r.Request.Body.(*readerutil.ReusableReadCloser)
+	if !ok || r.streamBody != nil || r.Request.Header.Get("Content-Type") != "" {
+		return
+	}
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	// reading to the end rewinds the body
+	_, _ = io.Copy(io.Discard, body)
+	if n == 0 {
+		return
+	}
+	complete := err != nil
+	r.Request.Header.Set("Content-Type", sniffContentType(head[:n], complete))
+}
+
+// sniffContentType returns the content type of the body starting with head, complete
+// if head is the whole body. JSON is detected on top of http.DetectContentType.
+func sniffContentType(head []byte, complete bool) string {
+	trimmed := bytes.TrimSpace(head)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && (!complete || json.Valid(trimmed)) {
+		return "application/json"
+	}
+	return http.DetectContentType(head)
+}
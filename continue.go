@@ -0,0 +1,33 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"strings"
+)
+
+// expectsContinue returns true when the request waits for the 100 Continue interim
+// response before sending its body
+func (r *Request) expectsContinue() bool {
+	return strings.EqualFold(r.Request.Header.Get("Expect"), "100-continue")
+}
+
+// setExpectContinue sets the Expect: 100-continue header of requests with a body and
+// returns a function removing it, so that the caller's request is left untouched
+func (r *Request) setExpectContinue() func() {
+	if r.Request.Body == nil || r.Request.Body == http.NoBody || r.Request.ContentLength == 0 || r.expectsContinue() {
+		return func() {}
+	}
+	r.Request.Header.Set("Expect", "100-continue")
+	return func() {
+		r.Request.Header.Del("Expect")
+	}
+}
+
+// rejectedContinue returns true when the server refused the body of a request expecting
+// 100 Continue, which would be refused again on retry
+func rejectedContinue(req *Request, resp *http.Response) bool {
+	if resp == nil || !req.expectsContinue() {
+		return false
+	}
+	return resp.StatusCode == http.StatusExpectationFailed || resp.StatusCode == http.StatusRequestEntityTooLarge
+}
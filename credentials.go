@@ -0,0 +1,65 @@
+package retryablehttp
+
+import (
+	"encoding/base64"
+	"net/http"
+)
+
+// CredentialProvider supplies the credentials of the requests sent without Request.Auth,
+// see Options.CredentialProvider. Implementations must be safe for concurrent use.
+type CredentialProvider interface {
+	// Credentials returns the credentials of the request, nil to send it without any.
+	// It's called again when the request gets a 401 response, to refresh them.
+	Credentials(req *http.Request) (*Auth, error)
+}
+
+// authorization returns the Authorization header value of basic and bearer credentials,
+// empty for digest ones which are sent in response to the challenge of the server
+func (a *Auth) authorization() string {
+	switch a.Type {
+	case BasicAuth:
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Username+":"+a.Password))
+	case BearerAuth:
+		return "Bearer " + a.Token
+	}
+	return ""
+}
+
+// saveAuthorization returns the func restoring the Authorization header the request has
+func (r *Request) saveAuthorization() (restore func()) {
+	values, ok := r.Header["Authorization"]
+	return func() {
+		if ok {
+			r.Header["Authorization"] = values
+		} else {
+			r.Header.Del("Authorization")
+		}
+	}
+}
+
+// setAuthorization sets the Authorization header of the basic and bearer credentials of the request
+func (r *Request) setAuthorization() {
+	if !r.hasAuth() {
+		return
+	}
+	if authorization := r.Auth.authorization(); authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+}
+
+// provideCredentials replaces the credentials of the request with the ones of the provider
+func (r *Request) provideCredentials(provider CredentialProvider, restoreAuthorization func()) error {
+	auth, err := provider.Credentials(r.Request)
+	if err != nil {
+		return err
+	}
+	r.Auth = auth
+	restoreAuthorization()
+	r.setAuthorization()
+	return nil
+}
+
+// unauthorized reports whether the response asks for (other) credentials
+func unauthorized(resp *http.Response) bool {
+	return resp != nil && resp.StatusCode == http.StatusUnauthorized
+}
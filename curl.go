@@ -0,0 +1,127 @@
+package retryablehttp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ToCurl returns the request as a curl command line, with the method, url, headers and body.
+// The body is sent with --data-binary, bodies which aren't printable text (binary, multipart
+// with CRLF line breaks) are quoted with the $'...' syntax of bash and zsh. Verification of
+// certificates is disabled with -k as by default in the client, and the protocol of the
+// response is requested with --http2 or --http3 once the request was sent. Streaming bodies
+// can't be rendered without consuming them and return an error.
+func (r *Request) ToCurl() (string, error) {
+	if r.streamBody != nil {
+		return "", errors.New("streaming request body can't be rendered as curl command")
+	}
+	body, err := r.BodyBytes()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"curl"}
+	if r.URL.Scheme == "https" {
+		args = append(args, "-k")
+	}
+	switch r.Metrics.Protocol {
+	case "HTTP/2.0":
+		args = append(args, "--http2")
+	case "HTTP/3.0":
+		args = append(args, "--http3")
+	}
+	// curl sends GET without body and POST with one by default
+	if (r.Method != "" && r.Method != http.MethodGet) || len(body) > 0 {
+		args = append(args, "-X", shellQuote(r.Method))
+	}
+	if r.hasAuth() {
+		switch r.Auth.Type {
+		case BearerAuth:
+			args = append(args, "--oauth2-bearer", shellQuote(r.Auth.Token))
+		case DigestAuth:
+			args = append(args, "--digest")
+			fallthrough
+		default:
+			args = append(args, "-u", shellQuote(r.Auth.Username+":"+r.Auth.Password))
+		}
+	}
+
+	if r.Request.Host != "" && r.Request.Host != r.URL.Host {
+		args = append(args, "-H", shellQuote("Host: "+r.Request.Host))
+	}
+	keys := make([]string, 0, len(r.Header))
+	for key := range r.Header {
+		// curl computes the length of the body
+		if http.CanonicalHeaderKey(key) == "Content-Length" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range r.Header[key] {
+			args = append(args, "-H", shellQuote(key+": "+value))
+		}
+	}
+
+	if len(body) > 0 {
+		args = append(args, "--data-binary", shellQuoteBytes(body))
+	}
+	args = append(args, shellQuote(r.URL.String()))
+	return strings.Join(args, " "), nil
+}
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	if !isPrintable(s) {
+		return shellQuoteBytes([]byte(s))
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// shellQuoteBytes quotes data as a single shell word, with the $'...' syntax escaping
+// the bytes which aren't printable text
+func shellQuoteBytes(data []byte) string {
+	if isPrintable(string(data)) {
+		return shellQuote(string(data))
+	}
+	var quoted strings.Builder
+	quoted.WriteString("$'")
+	for _, b := range data {
+		switch {
+		case b == '\\' || b == '\'':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(b)
+		case b == '\n':
+			quoted.WriteString(`\n`)
+		case b == '\r':
+			quoted.WriteString(`\r`)
+		case b == '\t':
+			quoted.WriteString(`\t`)
+		case b >= 0x20 && b < 0x7f:
+			quoted.WriteByte(b)
+		default:
+			fmt.Fprintf(&quoted, `\x%02x`, b)
+		}
+	}
+	quoted.WriteString("'")
+	return quoted.String()
+}
+
+// isPrintable returns true if s is valid utf-8 without control characters other than
+// new lines and tabs, which can be quoted as is
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if r < 0x20 && r != '\n' && r != '\t' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
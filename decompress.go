@@ -0,0 +1,79 @@
+package retryablehttp
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// setAcceptGzip requests gzip compressed responses, as the transport does, but for the client to
+// decompress them itself, and returns a function removing the header. Requests setting their own
+// Accept-Encoding are left untouched and their responses are not decompressed, as by the transport.
+func (r *Request) setAcceptGzip() (restore func(), added bool) {
+	if r.Request.Header.Get("Accept-Encoding") != "" || r.Request.Header.Get("Range") != "" || r.Request.Method == http.MethodHead {
+		return func() {}, false
+	}
+	r.Request.Header.Set("Accept-Encoding", "gzip")
+	return func() {
+		r.Request.Header.Del("Accept-Encoding")
+	}, true
+}
+
+// decompressResponse decompresses the gzip encoded response like the transport does, unless
+// its content type is listed in SkipDecompressContentTypes
+func (c *Client) decompressResponse(resp *http.Response) {
+	if resp == nil || resp.Body == nil || resp.Body == http.NoBody || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	if matchContentType(resp.Header.Get("Content-Type"), c.options.SkipDecompressContentTypes) {
+		return
+	}
+	resp.Body = &gzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// matchContentType returns true if the media type of contentType is one of the patterns,
+// which may end with a wildcard subtype (e.g. image/*)
+func matchContentType(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipBody decompresses the body on read, the gzip header is read by the first read
+type gzipBody struct {
+	body   io.ReadCloser
+	reader *gzip.Reader
+	err    error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		b.reader, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.reader.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	return b.body.Close()
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/projectdiscovery/retryablehttp-go"
@@ -66,3 +67,86 @@ func TestConnectionReuse(t *testing.T) {
 	// it should be less than 10
 	require.LessOrEqual(t, totalConns.Load(), uint32(10), "connection reuse failed")
 }
+
+func TestConnStats(t *testing.T) {
+	opts := retryablehttp.DefaultOptionsSingle
+	opts.CollectConnStats = true
+	client := retryablehttp.NewClient(opts)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "this is a test")
+	}))
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				resp, err := client.Get(ts.URL)
+				require.Nil(t, err)
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := client.ConnStats()
+	require.Equal(t, uint64(100), stats.TotalConnections)
+	require.Equal(t, stats.TotalConnections, stats.ReusedConnections+stats.NewConnections)
+	require.LessOrEqual(t, stats.NewConnections, uint64(10), "connection reuse failed")
+
+	client.ResetConnStats()
+	require.Equal(t, retryablehttp.ConnStats{}, client.ConnStats())
+}
+
+func TestConnStatsRetries(t *testing.T) {
+	opts := retryablehttp.DefaultOptionsSingle
+	opts.CollectConnStats = true
+	opts.RetryMax = 3
+	opts.RetryWaitMin = time.Millisecond
+	opts.RetryWaitMax = time.Millisecond
+	opts.CheckRetry = retryablehttp.RetryOnStatusCodes(http.StatusServiceUnavailable)
+	client := retryablehttp.NewClient(opts)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	// each attempt obtains a single connection
+	_, err := client.Get(ts.URL)
+	require.NotNil(t, err)
+	stats := client.ConnStats()
+	require.Equal(t, uint64(4), stats.TotalConnections)
+	require.Equal(t, uint64(3), stats.ReusedConnections)
+}
+
+func TestCloseIdleConnections(t *testing.T) {
+	opts := retryablehttp.DefaultOptionsSingle
+	opts.CollectConnStats = true
+	client := retryablehttp.NewClient(opts)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "this is a test")
+	}))
+	defer ts.Close()
+
+	get := func() {
+		resp, err := client.Get(ts.URL)
+		require.Nil(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	get()
+	get()
+	require.Equal(t, uint64(1), client.ConnStats().NewConnections)
+
+	client.CloseIdleConnections()
+	get()
+	require.Equal(t, uint64(2), client.ConnStats().NewConnections)
+}
@@ -4,13 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"io"
 	"net/http"
 	"net/http/httptrace"
+	"os"
 	"strings"
 	"time"
 
 	dac "github.com/Mzack9999/go-http-digest-auth-client"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // PassthroughErrorHandler is an ErrorHandler that directly passes through the
@@ -21,53 +22,344 @@ func PassthroughErrorHandler(resp *http.Response, err error, _ int) (*http.Respo
 }
 
 // Do wraps calling an HTTP method with retries.
-func (c *Client) Do(req *Request) (*http.Response, error) {
-	var resp *http.Response
-	var err error
+func (c *Client) Do(req *Request) (resp *http.Response, err error) {
+	if !c.shutdown.begin() {
+		return nil, ErrClientClosed
+	}
+	defer c.shutdown.inFlight.Done()
+
+	if c.options.MetricsCollector != nil {
+		start := time.Now()
+		retries := req.Metrics.Retries
+		defer func() {
+			c.observeRequest(req, resp, req.Metrics.Retries-retries+1, start)
+		}()
+	}
+
+	if c.options.CollectHostMetrics {
+		start := time.Now()
+		retries, failures := req.Metrics.Retries, req.Metrics.Failures
+		defer func() {
+			c.recordHostMetrics(req, resp, req.Metrics.Retries-retries, req.Metrics.Failures-failures, start)
+		}()
+	}
+
+	if c.options.HARRecorder != nil {
+		start := time.Now()
+		defer func() {
+			c.options.HARRecorder.record(req, start, err)
+		}()
+	}
+
+	if req.printTrace {
+		defer func() {
+			if req.Metrics.Trace != nil {
+				fmt.Fprint(os.Stderr, req.Metrics.Trace)
+			}
+		}()
+	}
 
 	// Create a main context that will be used as the main timeout
 	mainCtx, cancel := context.WithTimeout(context.Background(), c.options.Timeout)
 	defer cancel()
 
+	// ctx is the caller context, attempts run with a derived context
+	ctx := req.Context()
+	originalRequest := req.Request
+	defer func() {
+		req.Request = originalRequest
+	}()
+
+	// the request span covers all the attempts which get a child span each
+	var userTraceparent bool
+	if c.options.Tracer != nil {
+		var span trace.Span
+		ctx, span, userTraceparent = c.startRequestSpan(ctx, req)
+		req.Request = req.Request.WithContext(ctx)
+		defer func() {
+			endRequestSpan(span, req, resp, err)
+		}()
+		if !userTraceparent {
+			defer req.Header.Del("tracestate")
+			defer req.Header.Del("traceparent")
+		}
+	}
+
 	retryMax := c.options.RetryMax
-	if ctxRetryMax := req.Context().Value(RETRY_MAX); ctxRetryMax != nil {
+	if ctxRetryMax := ctx.Value(RETRY_MAX); ctxRetryMax != nil {
 		if maxRetriesParsed, ok := ctxRetryMax.(int); ok {
 			retryMax = maxRetriesParsed
 		}
 	}
 
+	if c.options.NormalizePath {
+		if err := c.normalizePath(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.options.CaptureExchange {
+		req.Exchange = &Exchange{}
+	}
+
+	if req.Transport != nil && req.httpClient == nil {
+		req.httpClient = c.transportClient(req.Transport)
+		defer func() {
+			req.httpClient = nil
+		}()
+	}
+
+	req.seq = c.requestSeq.Add(1) - 1
+	if c.retryBudget != nil {
+		c.retryBudget.deposit()
+	}
+	// with RetryMiddlewareErrors the middlewares are run by the attempts until they succeed
+	beforeRequestDone := !c.options.RetryMiddlewareErrors
+	if beforeRequestDone {
+		if err := c.runOnBeforeRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// the credentials of the request take precedence over the provider ones,
+	// which are requested by the attempts
+	provider := c.options.CredentialProvider
+	if req.hasAuth() {
+		provider = nil
+	} else if provider != nil {
+		defer func() {
+			req.Auth = nil
+		}()
+	}
+	needCredentials, refreshedCredentials := provider != nil, false
+	restoreAuthorization := func() {}
+	if req.hasAuth() || provider != nil {
+		restoreAuthorization = req.saveAuthorization()
+		defer restoreAuthorization()
+		req.setAuthorization()
+	}
+
+	// the http.Client jar adds its cookies to the request header on send,
+	// restore it on each attempt so they don't pile up
+	cookieHeader := req.Header.Values("Cookie")
+	defer req.setCookieHeader(cookieHeader)
+
+	// the cache is looked up with the headers the request is sent with, the responses
+	// it serves go through the OnAfterResponse middlewares like the received ones
+	cachedResp, lookup := c.lookupCache(req)
+	if cachedResp != nil {
+		if req.Exchange != nil {
+			c.captureExchange(req, cachedResp)
+		}
+		req.Metrics.Protocol = cachedResp.Proto
+		if err := c.runOnAfterResponse(req, cachedResp); err != nil {
+			cachedResp.Body.Close()
+			return nil, err
+		}
+		return cachedResp, nil
+	}
+	if lookup != nil {
+		defer func() {
+			lookup.restore()
+			if err == nil {
+				resp = c.storeCache(req, lookup, resp)
+			}
+		}()
+	}
+
+	req.setGetBody()
+	if req.streamBody != nil {
+		defer req.streamBody.finish()
+	}
+	if c.options.DetectContentType {
+		req.detectContentType()
+	}
+	if c.options.Use100Continue {
+		defer req.setExpectContinue()()
+	}
+	// the responses are decompressed by the client instead of the transport
+	// to return the ones of the skipped content types as is
+	var decompress bool
+	if len(c.options.SkipDecompressContentTypes) > 0 && !c.options.DisableAutoAcceptEncoding {
+		var restore func()
+		restore, decompress = req.setAcceptGzip()
+		defer restore()
+	}
+	req.Metrics.RequestBodyBytes = max(req.ContentLength, 0)
+	// trailers are only sent with chunked transfer encoding, which requires
+	// an unknown content length
+	if req.hasTrailer() {
+		req.Request = req.Request.WithContext(req.Context())
+		req.Request.ContentLength = -1
+	}
+
+	breaker := c.getCircuitBreaker(req)
+	hostSemaphore := c.getHostSemaphore(req)
+
+	// attempts is the number of attempts sent when giving up
+	var attempts int
 	for i := 0; ; i++ {
+		// fail fast without dialing if the host circuit is open
+		if breaker != nil && !breaker.allow() {
+			c.closeIdleConnections()
+			return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL, ErrCircuitOpen)
+		}
+
+		req.setCookieHeader(cookieHeader)
+		if req.streamBody != nil {
+			req.streamBody.reset()
+		}
+		if req.hostHeader != "" {
+			req.Request.Host = req.hostHeader
+		}
+
 		// request body can be read multiple times
 		// hence no need to rewind it
 		if c.RequestLogHook != nil {
 			c.RequestLogHook(req.Request, i)
 		}
 
+		// wait for an in-flight slot to the host
+		if hostSemaphore != nil {
+			if err := hostSemaphore.Acquire(ctx, 1); err != nil {
+				if breaker != nil {
+					breaker.cancelProbe()
+				}
+				c.closeIdleConnections()
+				return nil, err
+			}
+		}
+
+		attemptParent := ctx
+		var attemptSpan trace.Span
+		if c.options.Tracer != nil {
+			attemptParent, attemptSpan = c.startAttemptSpan(ctx, req, i, userTraceparent)
+		}
+		attemptCtx, cancelAttempt := c.withAttemptTimeout(attemptParent, req, i)
+		if attemptCtx == nil {
+			// the traces of the attempt are installed on a context derived from the caller one,
+			// the context of the previous attempt would run its traces as well
+			req.Request = req.Request.WithContext(attemptParent)
+		}
+		if hostSemaphore != nil {
+			cancelAttempt = releaseHostSemaphore(cancelAttempt, hostSemaphore)
+		}
+
 		if c.options.Trace {
 			c.wrapContextWithTrace(req)
 		}
+		if c.options.CollectTrace || req.collectTrace {
+			wrapContextWithTimings(req)
+		}
+		if c.options.CollectConnStats {
+			c.wrapContextWithConnStats(req)
+		}
+		if c.options.CollectResolvedIPs {
+			wrapContextWithResolvedAddrs(req)
+		}
+		if c.options.CollectInterimResponses {
+			wrapContextWithInterimResponses(req)
+		}
+		if c.options.MaxTotalRedirectBytes > 0 {
+			wrapContextWithRedirectBytes(req, c.options.MaxTotalRedirectBytes)
+		}
+		if c.options.CollectTLSBackend {
+			wrapContextWithTLSBackend(req)
+		}
+		attempt := newRetryAttempt(req, c.options.NoRetryNonIdempotent)
 
-		if req.hasAuth() && req.Auth.Type == DigestAuth {
+		var prepareErr error
+		if !beforeRequestDone {
+			prepareErr = c.runOnBeforeRequest(req)
+			beforeRequestDone = prepareErr == nil
+		}
+		if prepareErr == nil && needCredentials {
+			prepareErr = req.provideCredentials(provider, restoreAuthorization)
+			needCredentials = prepareErr != nil
+		}
+
+		if prepareErr != nil {
+			// the attempt fails without sending the request
+			resp, err = nil, prepareErr
+		} else if req.hasAuth() && req.Auth.Type == DigestAuth {
 			digestTransport := dac.NewTransport(req.Auth.Username, req.Auth.Password)
-			digestTransport.HTTPClient = c.HTTPClient
+			digestTransport.HTTPClient = c.getHTTPClient(req)
 			resp, err = digestTransport.RoundTrip(req.Request)
+		} else if c.HTTPClient3 != nil && req.httpClient == nil {
+			// Attempt the request over http/3 or upgrading to it when advertised
+			resp, err = c.doWithHTTP3(req)
 		} else {
 			// Attempt the request with standard behavior
-			resp, err = c.HTTPClient.Do(req.Request)
+			resp, err = c.getHTTPClient(req).Do(req.Request)
 		}
 
-		// Check if we should continue with retries.
-		checkOK, checkErr := c.CheckRetry(req.Context(), resp, err)
-
 		// if err is equal to missing minor protocol version retry with http/2
-		if err != nil && strings.Contains(err.Error(), "net/http: HTTP/1.x transport connection broken: malformed HTTP version \"HTTP/2\"") {
+		if err != nil && req.Transport == nil && !c.options.DisableHTTP2 && strings.Contains(err.Error(), "net/http: HTTP/1.x transport connection broken: malformed HTTP version \"HTTP/2\"") {
 			resp, err = c.HTTPClient2.Do(req.Request)
-			checkOK, checkErr = c.CheckRetry(req.Context(), resp, err)
+		}
+
+		if err != nil {
+			err = closedWithoutResponse(err, attempt)
+		}
+
+		if err == nil && decompress {
+			c.decompressResponse(resp)
+		}
+
+		// truncated bodies are retried like the other transport errors
+		if err == nil && c.options.RetryOnPartialResponse && resp.Body != nil {
+			// the body time limits apply to the read of the attempt
+			c.wrapBodyTimeouts(resp)
+			if err = readFullBody(resp, c.options.partialResponseReadLimit()); err != nil {
+				resp = nil
+			}
+		}
+
+		// the attempt timed out while the caller context is still valid
+		if err != nil && attemptCtx != nil && attemptCtx.Err() != nil && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", errAttemptTimeout, err)
+		}
+
+		// Check if we should continue with retries.
+		checkOK, checkErr := c.CheckRetry(context.WithValue(ctx, retryAttemptKey{}, attempt), resp, err)
+
+		// the credentials of the provider are refreshed once on 401
+		if provider != nil && !refreshedCredentials && err == nil && unauthorized(resp) && i < retryMax {
+			checkOK, checkErr = true, nil
+			needCredentials, refreshedCredentials = true, true
+		}
+
+		if breaker != nil {
+			if prepareErr == nil {
+				breaker.record(err == nil)
+			} else {
+				breaker.cancelProbe()
+			}
+		}
+
+		// streaming bodies can't be replayed once they started flowing
+		if checkOK && !req.canRetryBody() {
+			checkOK = false
+		}
+		// the server refused the body before it was sent, retrying won't change its mind
+		if checkOK && rejectedContinue(req, resp) {
+			checkOK = false
+		}
+		// stop retrying once the retry budget of the client is exhausted
+		if checkOK && i < retryMax && !c.allowRetry(req) {
+			checkOK = false
+		}
+
+		if attemptSpan != nil {
+			endAttemptSpan(attemptSpan, resp, err, checkOK && i < retryMax)
 		}
 
 		if err != nil {
 			// Increment the failure counter as the request failed
 			req.Metrics.Failures++
+			if req.Exchange != nil {
+				req.Exchange.AttemptErrors = append(req.Exchange.AttemptErrors, err)
+			}
 		} else {
 			// Call this here to maintain the behavior of logging all requests,
 			// even if CheckRetry signals to stop.
@@ -82,6 +374,23 @@ func (c *Client) Do(req *Request) (*http.Response, error) {
 			if checkErr != nil {
 				err = checkErr
 			}
+			err = asTypedError(err)
+			if req.Exchange != nil {
+				c.captureExchange(req, resp)
+			}
+			if err == nil && resp != nil {
+				req.Metrics.Protocol = resp.Proto
+			}
+			if err == nil {
+				c.wrapResponseBody(req, resp)
+			}
+			releaseAttempt(resp, cancelAttempt)
+			if err == nil && resp != nil {
+				if err = c.runOnAfterResponse(req, resp); err != nil {
+					resp.Body.Close()
+					resp = nil
+				}
+			}
 			c.closeIdleConnections()
 			return resp, err
 		}
@@ -89,39 +398,72 @@ func (c *Client) Do(req *Request) (*http.Response, error) {
 		// We do this before drainBody beause there's no need for the I/O if
 		// we're breaking out
 		remain := retryMax - i
-		if remain <= 0 {
+		giveUp := remain <= 0
+		var wait time.Duration
+		if !giveUp {
+			wait = c.Backoff(c.options.RetryWaitMin, c.options.RetryWaitMax, i, resp)
+			// The request context deadline bounds the backoff too, there is no point
+			// in sleeping for a retry it doesn't leave the time for.
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+				giveUp = true
+			}
+		}
+		if giveUp {
+			if err == nil && resp != nil && req.attemptResponses != nil {
+				c.collectAttemptResponse(req, resp)
+			}
+			releaseAttempt(resp, cancelAttempt)
+			attempts = i + 1
 			break
 		}
 
 		// Increment the retries counter as we are going to do one more retry
 		req.Metrics.Retries++
+		req.Metrics.RetryReasons = append(req.Metrics.RetryReasons, describeRetry(resp, err))
+		if c.options.MetricsCollector != nil {
+			c.observeRetry(req, resp, err)
+		}
 
 		// We're going to retry, consume any response to reuse the connection.
 		if err == nil && resp != nil {
-			c.drainBody(req, resp)
+			if req.attemptResponses != nil {
+				c.collectAttemptResponse(req, resp)
+			} else {
+				c.drainBody(req, resp)
+			}
 		}
+		cancelAttempt()
 
 		// Wait for the time specified by backoff then retry.
 		// If the context is cancelled however, return.
-		wait := c.Backoff(c.options.RetryWaitMin, c.options.RetryWaitMax, i, resp)
+		if c.OnRetry != nil {
+			c.OnRetry(req.Request, i+1, wait, err)
+		}
 
 		// Exit if the main context or the request context is done
 		// Otherwise, wait for the duration and try again.
 		// use label to explicitly specify what to break
+		timer := time.NewTimer(wait)
 	selectstatement:
 		select {
 		case <-mainCtx.Done():
 			break selectstatement
-		case <-req.Context().Done():
+		case <-ctx.Done():
+			timer.Stop()
 			c.closeIdleConnections()
-			return nil, req.Context().Err()
-		case <-time.After(wait):
+			return nil, ctx.Err()
+		case <-timer.C:
 		}
+		timer.Stop()
+	}
+
+	if req.Exchange != nil {
+		c.captureExchange(req, resp)
 	}
 
 	if c.ErrorHandler != nil {
 		c.closeIdleConnections()
-		return c.ErrorHandler(resp, err, retryMax+1)
+		return c.ErrorHandler(resp, err, attempts)
 	}
 
 	// By default, we close the response body and return an error without
@@ -130,16 +472,78 @@ func (c *Client) Do(req *Request) (*http.Response, error) {
 		resp.Body.Close()
 	}
 	c.closeIdleConnections()
-	return nil, fmt.Errorf("%s %s giving up after %d attempts: %w", req.Method, req.URL, retryMax+1, err)
+	return nil, &RetriesExhaustedError{
+		Method:   req.Method,
+		URL:      req.URL.String(),
+		Attempts: attempts,
+		LastErr:  asTypedError(err),
+	}
 }
 
-// Try to read the response body so we can reuse this connection.
-func (c *Client) drainBody(req *Request, resp *http.Response) {
-	_, err := io.Copy(io.Discard, io.LimitReader(resp.Body, c.options.RespReadLimit))
+// DoAll sends the request like Do and returns the responses of all its attempts in order,
+// ex. to log a 503 then 500 then 200 progression, along with the error of Do. The bodies of
+// the responses are read up to RespReadLimit, closed and replaced with the bytes read.
+func (c *Client) DoAll(req *Request) ([]*http.Response, error) {
+	var responses []*http.Response
+	req.attemptResponses = &responses
+	defer func() {
+		req.attemptResponses = nil
+	}()
+
+	resp, err := c.Do(req)
+	// the final response is already collected when returned by the error handler
+	if resp != nil && (len(responses) == 0 || responses[len(responses)-1] != resp) {
+		c.collectAttemptResponse(req, resp)
+	}
+	return responses, err
+}
+
+// DoClone sends a clone of the request with the given context, leaving req untouched, so that
+// the same template request can be sent by multiple goroutines at once. The clone gets its own
+// copy of the body, its metrics are not recorded in req. Streaming requests can't be cloned.
+func (c *Client) DoClone(ctx context.Context, req *Request) (*http.Response, error) {
+	clone, err := req.cloneWithBody(ctx)
 	if err != nil {
-		req.Metrics.DrainErrors++
+		return nil, err
+	}
+	return c.Do(clone)
+}
+
+// collectAttemptResponse buffers the body of the response and adds it to the responses of the request
+func (c *Client) collectAttemptResponse(req *Request, resp *http.Response) {
+	_, _ = ReadAndReuse(req, resp, c.options.RespReadLimit)
+	*req.attemptResponses = append(*req.attemptResponses, resp)
+}
+
+// releaseAttempt releases the attempt context once the response body is closed,
+// or immediately if there is no body
+func releaseAttempt(resp *http.Response, cancelAttempt context.CancelFunc) {
+	if resp != nil && resp.Body != nil {
+		resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancelAttempt}
+		return
 	}
-	resp.Body.Close()
+	cancelAttempt()
+}
+
+// transportClient returns a copy of the http client of the client, with its timeout,
+// redirect policy and cookie jar, sending the requests with the given transport
+func (c *Client) transportClient(transport http.RoundTripper) *http.Client {
+	httpClient := *c.HTTPClient
+	httpClient.Transport = transport
+	return &httpClient
+}
+
+// getHTTPClient returns the http client to use for the request
+func (c *Client) getHTTPClient(req *Request) *http.Client {
+	if req.httpClient != nil {
+		return req.httpClient
+	}
+	return c.HTTPClient
+}
+
+// Try to read the response body so we can reuse this connection.
+func (c *Client) drainBody(req *Request, resp *http.Response) {
+	_, _ = DiscardN(req, resp, c.options.RespReadLimit)
 }
 
 const closeConnectionsCounter = 100
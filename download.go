@@ -0,0 +1,137 @@
+package retryablehttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DoDownload sends the request like Do and streams the response body to w, returning the
+// number of bytes written. A body failing midway is resumed up to RetryMax times: with a
+// Range request from the bytes already written if the server sent Accept-Ranges: bytes, or
+// else by downloading it again and skipping them, so that w never gets a byte twice.
+// Responses other than 2xx fail without writing their body. The resumes are counted in
+// req.Metrics as retries.
+func (c *Client) DoDownload(req *Request, w io.Writer) (int64, error) {
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return 0, fmt.Errorf("download: unexpected status %q", resp.Status)
+	}
+	acceptRanges := headerContainsToken(resp.Header, "Accept-Ranges", "bytes")
+	// the resumed range must come from the same version of the resource
+	validator := resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+
+	dst := &downloadWriter{w: w}
+	var skip int64
+	for resume := 0; ; resume++ {
+		err = dst.copyFrom(resp.Body, skip)
+		resp.Body.Close()
+		if err == nil || dst.err != nil || resume >= c.options.RetryMax {
+			return dst.written, err
+		}
+		req.Metrics.Retries++
+		req.Metrics.RetryReasons = append(req.Metrics.RetryReasons, describeRetry(nil, err))
+
+		wait := c.Backoff(c.options.RetryWaitMin, c.options.RetryWaitMax, resume, nil)
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return dst.written, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if resp, skip, err = c.resumeDownload(req, dst.written, acceptRanges, validator); err != nil {
+			return dst.written, err
+		}
+	}
+}
+
+// resumeDownload requests the rest of the body of the download from offset, it returns
+// the response and the number of bytes of its body to skip
+func (c *Client) resumeDownload(req *Request, offset int64, acceptRanges bool, validator string) (*http.Response, int64, error) {
+	resumeReq := req.Clone(req.Context())
+	if acceptRanges {
+		resumeReq.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		if validator != "" {
+			resumeReq.Header.Set("If-Range", validator)
+		}
+	}
+	resp, err := c.Do(resumeReq)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && acceptRanges:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("download: unexpected content range %q resuming from %d", resp.Header.Get("Content-Range"), offset)
+		}
+		return resp, 0, nil
+	case resp.StatusCode == http.StatusOK:
+		// the whole body is sent again when the resource changed
+		if acceptRanges && validator != "" {
+			resp.Body.Close()
+			return nil, 0, fmt.Errorf("download: resource changed while resuming from %d", offset)
+		}
+		return resp, offset, nil
+	default:
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("download: unexpected status %q resuming from %d", resp.Status, offset)
+	}
+}
+
+// contentRangeStart returns the first byte position of a Content-Range header
+func contentRangeStart(contentRange string) (int64, bool) {
+	position, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	position, _, ok = strings.Cut(position, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(position, 10, 64)
+	return start, err == nil
+}
+
+// downloadWriter counts the bytes written to w and keeps its error, which is not retried
+type downloadWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+func (d *downloadWriter) Write(p []byte) (int, error) {
+	n, err := d.w.Write(p)
+	d.written += int64(n)
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+// copyFrom writes the body to the writer after skipping its first bytes
+func (d *downloadWriter) copyFrom(body io.Reader, skip int64) error {
+	if skip > 0 {
+		if _, err := io.CopyN(io.Discard, body, skip); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	_, err := io.Copy(d, body)
+	return err
+}
@@ -0,0 +1,142 @@
+package retryablehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+)
+
+var (
+	// A regular expression to match the error returned by net/http when the
+	// response has a malformed or unsupported http version
+	httpVersionErrorRegex = regexp.MustCompile(`malformed HTTP version "([^"]*)"`)
+
+	// A regular expression to match the errors returned by net/http and http2 when
+	// the response headers exceed the transport MaxResponseHeaderBytes
+	headerTooLargeErrorRegex = regexp.MustCompile(`server response headers exceeded \d+ bytes|response header list larger than advertised limit`)
+)
+
+// ErrHeaderTooLarge is wrapped by the error returned when the response headers
+// exceed Options.MaxResponseHeaderBytes
+var ErrHeaderTooLarge = errors.New("response headers too large")
+
+// ErrAddressFamilyMismatch is wrapped by the error returned when the destination has no
+// address of the family of Options.LocalAddr
+var ErrAddressFamilyMismatch = errors.New("local address family mismatch")
+
+// ErrResponseTooLarge is wrapped by the error returned when the response bodies read
+// across the redirects of a request exceed Options.MaxTotalRedirectBytes
+var ErrResponseTooLarge = errors.New("response too large")
+
+// ErrConnectionClosedWithoutResponse is wrapped by the error returned when the server
+// closes the connection without sending any response, a signal of its own when scanning
+// (e.g. a filtering device dropping the requests it doesn't like)
+var ErrConnectionClosedWithoutResponse = errors.New("connection closed without response")
+
+// ErrPartialResponse is wrapped by the error of the attempts whose response body
+// couldn't be read entirely with Options.RetryOnPartialResponse
+var ErrPartialResponse = errors.New("partial response")
+
+// RetriesExhaustedError is returned by Client.Do when the request still fails
+// after all attempts
+type RetriesExhaustedError struct {
+	Method string
+	URL    string
+	// Attempts is the number of attempts made, including the initial request
+	Attempts int
+	// LastErr is the error of the last attempt, nil if it returned a response
+	LastErr error
+}
+
+func (e *RetriesExhaustedError) Error() string {
+	return fmt.Sprintf("%s %s giving up after %d attempts: %v", e.Method, e.URL, e.Attempts, e.LastErr)
+}
+
+func (e *RetriesExhaustedError) Unwrap() error {
+	return e.LastErr
+}
+
+// Is reports whether target is a RetriesExhaustedError
+func (e *RetriesExhaustedError) Is(target error) bool {
+	_, ok := target.(*RetriesExhaustedError)
+	return ok
+}
+
+// UnsupportedSchemeError is returned when the scheme of the request url
+// is not supported by the transport
+type UnsupportedSchemeError struct {
+	Scheme string
+	// Err is the transport error
+	Err error
+}
+
+func (e *UnsupportedSchemeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnsupportedSchemeError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an UnsupportedSchemeError
+func (e *UnsupportedSchemeError) Is(target error) bool {
+	_, ok := target.(*UnsupportedSchemeError)
+	return ok
+}
+
+// UnsupportedHTTPVersionError is returned when the server responds with
+// a malformed or unsupported http version
+type UnsupportedHTTPVersionError struct {
+	Version string
+	// Err is the transport error
+	Err error
+}
+
+func (e *UnsupportedHTTPVersionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnsupportedHTTPVersionError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an UnsupportedHTTPVersionError
+func (e *UnsupportedHTTPVersionError) Is(target error) bool {
+	_, ok := target.(*UnsupportedHTTPVersionError)
+	return ok
+}
+
+// asTypedError converts the untyped transport errors into the exported error types
+func asTypedError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if match := schemeErrorRegex.FindStringSubmatch(err.Error()); match != nil {
+		return &UnsupportedSchemeError{Scheme: match[1], Err: err}
+	}
+	if match := httpVersionErrorRegex.FindStringSubmatch(err.Error()); match != nil {
+		return &UnsupportedHTTPVersionError{Version: match[1], Err: err}
+	}
+	if !errors.Is(err, ErrHeaderTooLarge) && headerTooLargeErrorRegex.MatchString(err.Error()) {
+		return fmt.Errorf("%w: %w", ErrHeaderTooLarge, err)
+	}
+	return err
+}
+
+// closedWithoutResponse wraps the error of an attempt whose connection was closed by the
+// server before the response in ErrConnectionClosedWithoutResponse. net/http reports it
+// with a bare EOF once the connection was obtained, unlike the connections closed in the
+// middle of the response. The EOFs of failed tls handshakes and proxy CONNECTs happen
+// before the connection is obtained and are left as is.
+func closedWithoutResponse(err error, attempt *retryAttempt) error {
+	if !attempt.gotConn.Load() {
+		return err
+	}
+	var urlErr *url.Error
+	if err == io.EOF || (errors.As(err, &urlErr) && urlErr.Err == io.EOF) {
+		return fmt.Errorf("%w: %w", ErrConnectionClosedWithoutResponse, err)
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+package retryablehttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+// grpcStatusUnavailable is the UNAVAILABLE grpc status code, the only one retried
+const grpcStatusUnavailable = 14
+
+// grpcFrameHeaderLength is the length of the prefix of length-prefixed grpc messages
+const grpcFrameHeaderLength = 5
+
+// ErrGRPCCompressed is returned when the response message is compressed, which is not supported
+var ErrGRPCCompressed = errors.New("grpc: compressed response message")
+
+// GRPCResponse is the response of a unary gRPC call
+type GRPCResponse struct {
+	// Message is the serialized response message, nil if the server didn't send any
+	Message []byte
+	// Status is the grpc-status code of the call, 0 (OK) on success
+	Status int
+	// StatusMessage is the decoded grpc-message describing the status
+	StatusMessage string
+	// Header is the response metadata
+	Header http.Header
+	// Trailer is the trailing response metadata
+	Trailer http.Header
+}
+
+// DoGRPC makes a unary gRPC call of the method (/package.Service/Method) on target, the
+// base url of the server, sending the serialized message with the given metadata. The call
+// is made over http/2, in cleartext (h2c) for http:// targets, and is retried only when it
+// fails with UNAVAILABLE or a recoverable transport error. See the grpc package to send
+// protobuf messages.
+func (c *Client) DoGRPC(target, fullMethod string, message []byte, md map[string][]string) (*GRPCResponse, error) {
+	req, err := NewRequest(http.MethodPost, strings.TrimSuffix(target, "/")+fullMethod, grpcFrame(message))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range md {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	resp, err := c.grpcClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	grpcResp := &GRPCResponse{Header: resp.Header, Trailer: resp.Trailer}
+	grpcResp.Status, grpcResp.StatusMessage = grpcStatus(resp)
+	if grpcResp.Message, err = grpcUnframe(body); err != nil {
+		return nil, err
+	}
+	return grpcResp, nil
+}
+
+// grpcClient returns the client sending the gRPC calls, built on first use from the options
+// of the client with the gRPC retry policy and an http/2 transport
+func (c *Client) grpcClient() *Client {
+	c.grpcOnce.Do(func() {
+		c.grpc = c.With(func(options *Options) {
+			options.CheckRetry = grpcRetryPolicy
+			options.CheckRetryWithBody = nil
+			// UNAVAILABLE calls were not processed by the server
+			options.NoRetryNonIdempotent = false
+			// the status is in the trailers, available once the body is read
+			options.RetryOnPartialResponse = true
+			options.HTTP3 = false
+			options.AutoHTTP3Upgrade = false
+		})
+		c.grpc.HTTPClient.Transport = c.newGRPCTransport()
+		c.grpc.ErrorHandler = PassthroughErrorHandler
+	})
+	return c.grpc
+}
+
+// grpcRetryPolicy retries calls failing with UNAVAILABLE or a recoverable transport error
+func grpcRetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	if err != nil || resp == nil {
+		return CheckRecoverableErrors(ctx, resp, err)
+	}
+	status, _ := grpcStatus(resp)
+	return status == grpcStatusUnavailable, nil
+}
+
+// grpcStatus returns the status of the call from the trailers, or the headers
+// of trailers-only responses
+func grpcStatus(resp *http.Response) (int, string) {
+	header := resp.Trailer
+	if resp.Header.Get("Grpc-Status") != "" {
+		header = resp.Header
+	}
+	status, err := strconv.Atoi(header.Get("Grpc-Status"))
+	if err != nil {
+		// calls without status are reported as UNKNOWN
+		return 2, fmt.Sprintf("missing grpc-status (http status %d)", resp.StatusCode)
+	}
+	message, err := url.PathUnescape(header.Get("Grpc-Message"))
+	if err != nil {
+		message = header.Get("Grpc-Message")
+	}
+	return status, message
+}
+
+// grpcFrame returns the message prefixed with its compression flag and length
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, grpcFrameHeaderLength+len(message))
+	binary.BigEndian.PutUint32(frame[1:grpcFrameHeaderLength], uint32(len(message)))
+	copy(frame[grpcFrameHeaderLength:], message)
+	return frame
+}
+
+// grpcUnframe returns the message of the length-prefixed body, nil if empty
+func grpcUnframe(body []byte) ([]byte, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	if len(body) < grpcFrameHeaderLength {
+		return nil, fmt.Errorf("grpc: truncated message prefix: %w", io.ErrUnexpectedEOF)
+	}
+	if body[0] != 0 {
+		return nil, ErrGRPCCompressed
+	}
+	length := binary.BigEndian.Uint32(body[1:grpcFrameHeaderLength])
+	if uint64(len(body)-grpcFrameHeaderLength) < uint64(length) {
+		return nil, fmt.Errorf("grpc: truncated message: %w", io.ErrUnexpectedEOF)
+	}
+	return bytes.Clone(body[grpcFrameHeaderLength : grpcFrameHeaderLength+int(length)]), nil
+}
+
+// grpcTransport sends the calls over http/2 with tls or in cleartext depending on the scheme
+type grpcTransport struct {
+	tls, cleartext *http2.Transport
+}
+
+// newGRPCTransport returns the http/2 transport of the gRPC calls dialing with the dialers of the client
+func (c *Client) newGRPCTransport() *grpcTransport {
+	dial, _ := c.transportDialers()
+	tlsConfig := defaultTLSConfig()
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+
+	return &grpcTransport{
+		tls: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, config *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				config = config.Clone()
+				if config.ServerName == "" {
+					config.ServerName, _, _ = net.SplitHostPort(addr)
+				}
+				handshakeCtx, cancel := withHandshakeTimeout(ctx, c.options.tlsHandshakeTimeout())
+				defer cancel()
+				tlsConn := tls.Client(conn, config)
+				if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			},
+		},
+		cleartext: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		},
+	}
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return t.cleartext.RoundTrip(req)
+	}
+	return t.tls.RoundTrip(req)
+}
+
+func (t *grpcTransport) CloseIdleConnections() {
+	t.tls.CloseIdleConnections()
+	t.cleartext.CloseIdleConnections()
+}
@@ -0,0 +1,43 @@
+// Package grpc makes unary gRPC calls with protobuf messages through a retryablehttp.Client,
+// isolating the protobuf dependency from the users of the retryablehttp package
+package grpc
+
+import (
+	"fmt"
+
+	"github.com/projectdiscovery/retryablehttp-go"
+	"google.golang.org/protobuf/proto"
+)
+
+// StatusError is returned when a call completes with a status other than OK
+type StatusError struct {
+	// Code is the grpc-status code of the call
+	Code int
+	// Message is the grpc-message of the call
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("grpc: status %d: %s", e.Code, e.Message)
+}
+
+// Invoke calls the method (/package.Service/Method) on target, the base url of the server,
+// sending in with the given metadata (ex. metadata.MD) and unmarshaling the response into out.
+// Calls completing with a status other than OK return a StatusError along with the response.
+func Invoke(client *retryablehttp.Client, target, fullMethod string, in, out proto.Message, md map[string][]string) (*retryablehttp.GRPCResponse, error) {
+	message, err := proto.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DoGRPC(target, fullMethod, message, md)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != 0 {
+		return resp, &StatusError{Code: resp.Status, Message: resp.StatusMessage}
+	}
+	if err := proto.Unmarshal(resp.Message, out); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
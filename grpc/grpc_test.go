@@ -0,0 +1,73 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/retryablehttp-go"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestInvoke(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		w.Header().Set("Content-Type", "application/grpc")
+		if r.URL.Path == "/test.Greeter/Missing" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "method not found")
+			return
+		}
+		// trailers-only UNAVAILABLE responses before answering
+		if calls.Add(1) <= 2 {
+			w.Header().Set("Grpc-Status", "14")
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		in := &wrapperspb.StringValue{}
+		require.Nil(t, proto.Unmarshal(body[5:], in))
+		message, err := proto.Marshal(wrapperspb.String("hello " + in.GetValue() + " " + r.Header.Get("X-Token")))
+		require.Nil(t, err)
+
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		frame := make([]byte, 5)
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+		_, _ = w.Write(append(frame, message...))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	})
+	ts := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer ts.Close()
+
+	client := retryablehttp.NewClient(retryablehttp.Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     3,
+		Timeout:      5 * time.Second,
+	})
+	out := &wrapperspb.StringValue{}
+	resp, err := Invoke(client, ts.URL, "/test.Greeter/SayHello", wrapperspb.String("gopher"), out, map[string][]string{"x-token": {"secret"}})
+	require.Nil(t, err)
+	require.Equal(t, 0, resp.Status)
+	require.Equal(t, "hello gopher secret", out.GetValue())
+	require.Equal(t, int32(3), calls.Load())
+
+	// statuses other than UNAVAILABLE are not retried
+	resp, err = Invoke(client, ts.URL, "/test.Greeter/Missing", wrapperspb.String("gopher"), out, nil)
+	var statusErr *StatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.Equal(t, 5, statusErr.Code)
+	require.Equal(t, "method not found", statusErr.Message)
+	require.Equal(t, 5, resp.Status)
+}
@@ -0,0 +1,159 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// defaultHTTP2FramesIdleTimeout is the time SendHTTP2Frames waits for the next frame
+// when RawIOTimeout is not set
+const defaultHTTP2FramesIdleTimeout = 5 * time.Second
+
+// HTTP2Frame is a raw http/2 frame, written and read as is by SendHTTP2Frames
+type HTTP2Frame struct {
+	Type     http2.FrameType
+	Flags    http2.Flags
+	StreamID uint32
+	// Payload is the payload of the frame, header blocks are hpack encoded
+	Payload []byte
+}
+
+// SendHTTP2Frames writes the http/2 client preface followed by exactly the given frames to a
+// connection to addr and returns the frames read in response, for protocol testing with
+// frames net/http would never send (ex. malformed HEADERS, CONTINUATION floods, rapid
+// resets). The address is either host:port for cleartext http/2 (prior knowledge), or a
+// http:// or https:// url for connections over tls negotiating h2.
+//
+// The frames are sent as they are, the first one is expected to be the client SETTINGS, and
+// nothing is sent in response to the frames of the server, including SETTINGS acknowledgements.
+// Frames are read until the streams opened by the HEADERS frames are ended or reset, the server
+// sends GOAWAY or closes the connection, or no frame is read for RawIOTimeout (default: 5s),
+// within Timeout. The connection is closed afterwards and nothing is retried.
+//
+// EXPERIMENTAL: the API may change. Malformed frames can exhaust or crash servers, only
+// send them to servers you are authorized to test.
+func (c *Client) SendHTTP2Frames(addr string, frames []HTTP2Frame) ([]HTTP2Frame, error) {
+	addr, useTLS, err := parseRawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	conn, err := c.dialHTTP2(ctx, addr, useTLS)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	idleTimeout := defaultHTTP2FramesIdleTimeout
+	if c.options.RawIOTimeout > 0 {
+		idleTimeout = c.options.RawIOTimeout
+	}
+	conn = &ioTimeoutConn{Conn: conn, timeout: idleTimeout, deadline: deadline}
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	framer := http2.NewFramer(conn, nil)
+	framer.AllowIllegalWrites = true
+	open := make(map[uint32]struct{})
+	for _, frame := range frames {
+		if err := framer.WriteRawFrame(frame.Type, frame.Flags, frame.StreamID, frame.Payload); err != nil {
+			return nil, err
+		}
+		if frame.Type == http2.FrameHeaders {
+			open[frame.StreamID] = struct{}{}
+		}
+	}
+
+	var received []HTTP2Frame
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := readHTTP2Frame(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return received, nil
+			}
+			// the server has nothing more to say without streams
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && len(open) == 0 {
+				return received, nil
+			}
+			return received, err
+		}
+		received = append(received, frame)
+
+		switch {
+		case frame.Type == http2.FrameGoAway:
+			return received, nil
+		case frame.Type == http2.FrameRSTStream,
+			(frame.Type == http2.FrameData || frame.Type == http2.FrameHeaders) && frame.Flags.Has(http2.FlagDataEndStream):
+			if _, ok := open[frame.StreamID]; ok {
+				delete(open, frame.StreamID)
+				if len(open) == 0 {
+					return received, nil
+				}
+			}
+		}
+	}
+}
+
+// dialHTTP2 dials a connection to addr speaking http/2, over tls if useTLS
+func (c *Client) dialHTTP2(ctx context.Context, addr string, useTLS bool) (net.Conn, error) {
+	dial, _ := c.transportDialers()
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil || !useTLS {
+		return conn, err
+	}
+
+	tlsConfig := defaultTLSConfig()
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+	tlsConfig.NextProtos = []string{http2.NextProtoTLS}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, fmt.Errorf("h2: %s negotiated %q instead of h2", addr, protocol)
+	}
+	return tlsConn, nil
+}
+
+// readHTTP2Frame reads a frame without validating it
+func readHTTP2Frame(r io.Reader) (HTTP2Frame, error) {
+	header, err := http2.ReadFrameHeader(r)
+	if err != nil {
+		return HTTP2Frame{}, err
+	}
+	frame := HTTP2Frame{
+		Type:     header.Type,
+		Flags:    header.Flags,
+		StreamID: header.StreamID,
+		Payload:  make([]byte, header.Length),
+	}
+	if _, err := io.ReadFull(r, frame.Payload); err != nil {
+		return HTTP2Frame{}, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,173 @@
+package retryablehttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// happyEyeballsDelay is the head start given to the preferred address family
+// before racing the other one (RFC 8305 connection attempt delay)
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// happyEyeballsDialer races connections to the ipv6 and ipv4 addresses of a host,
+// ipv6 first, and returns the first established one (RFC 8305)
+type happyEyeballsDialer struct {
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	lookup func(ctx context.Context, host string) ([]net.IP, error)
+	delay  time.Duration
+}
+
+func newHappyEyeballsDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *happyEyeballsDialer {
+	return &happyEyeballsDialer{dial: dial, lookup: lookupIPs, delay: happyEyeballsDelay}
+}
+
+// lookupIPs resolves the host with fastdialer if available or with the default resolver otherwise
+func lookupIPs(ctx context.Context, host string) ([]net.IP, error) {
+	if fd, _ := getFastDialer(); fd != nil {
+		data, err := fd.GetDNSData(host)
+		if err != nil {
+			return nil, err
+		}
+		var ips []net.IP
+		for _, addr := range append(append([]string(nil), data.AAAA...), data.A...) {
+			if ip := net.ParseIP(addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// DialContext dials the address racing its address families, ip addresses and
+// non tcp networks are dialed directly
+func (d *happyEyeballsDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network != "tcp" || net.ParseIP(host) != nil {
+		return d.dial(ctx, network, addr)
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var primary, fallback []string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			fallback = append(fallback, net.JoinHostPort(ip.String(), port))
+		} else {
+			primary = append(primary, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(primary) == 0 || len(fallback) == 0 {
+		return d.dialSerial(ctx, network, append(primary, fallback...))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult, 2)
+	race := func(addrs []string, primary bool) {
+		conn, err := d.dialSerial(ctx, network, addrs)
+		results <- dialResult{conn: conn, err: err, primary: primary}
+	}
+
+	go race(primary, true)
+	pending := 1
+	fallbackTimer := time.NewTimer(d.delay)
+	defer fallbackTimer.Stop()
+	startFallback := func() {
+		if fallback != nil {
+			go race(fallback, false)
+			fallback = nil
+			pending++
+		}
+	}
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			startFallback()
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// close the connection of the losing family once its dial completes
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			// the failure of the preferred family starts the fallback right away
+			startFallback()
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// dialSerial dials the addresses in order returning the first established connection
+func (d *happyEyeballsDialer) dialSerial(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	var err error
+	for _, addr := range addrs {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		var conn net.Conn
+		if conn, err = d.dial(ctx, network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// useHappyEyeballs makes the transport of the client race the address families of the hosts,
+// tls connections are dialed over it with the ztls fallback
+func useHappyEyeballs(client *http.Client, options *Options) {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = dialContext
+	}
+	// mapped hosts are not resolved
+	transport.DialContext = withHostsMap(newHappyEyeballsDialer(dial).DialContext, options.HostsMap)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = defaultTLSConfig()
+	}
+	transport.TLSHandshakeTimeout = options.tlsHandshakeTimeout()
+	transport.DialTLSContext = ztlsFallbackDialTLSContext(transport.DialContext, transport.TLSClientConfig, options.DisableZTLSFallback, transport.TLSHandshakeTimeout)
+}
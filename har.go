@@ -0,0 +1,324 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// harVersion is the version of the HTTP Archive format written by HARRecorder
+const harVersion = "1.2"
+
+// modulePath is the path of the module, whose version is the one of the HAR creator
+const modulePath = "github.com/projectdiscovery/retryablehttp-go"
+
+// HARRecorder writes the exchanges of the requests sent by a client as HTTP Archive
+// (HAR 1.2) entries of a single document, see Options.HARRecorder. The entries are
+// written as they're recorded, the document is completed on Close.
+// It's safe for concurrent use.
+type HARRecorder struct {
+	w io.Writer
+
+	mu      sync.Mutex
+	entries int
+	closed  bool
+	err     error
+}
+
+// NewHARRecorder returns a recorder writing the HAR document to w
+func NewHARRecorder(w io.Writer) *HARRecorder {
+	return &HARRecorder{w: w}
+}
+
+// Close completes the HAR document, later exchanges are not recorded. It returns the
+// first error writing the document.
+func (r *HARRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return r.err
+	}
+	if r.entries == 0 {
+		r.writeHeader()
+	}
+	r.write([]byte("\n]}}\n"))
+	r.closed = true
+	return r.err
+}
+
+// record writes the exchange captured by the request, started at start, as an entry
+func (r *HARRecorder) record(req *Request, start time.Time, lastErr error) {
+	if req.Exchange == nil || req.Exchange.Request == nil {
+		return
+	}
+	end := time.Now()
+	entry := harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Time:            durationMs(end.Sub(start)),
+		Request:         newHARRequest(req),
+		Response:        newHARResponse(req.Exchange.Response),
+		Cache:           struct{}{},
+		Timings:         newHARTimings(req.TraceInfo, start, end),
+	}
+	if lastErr != nil {
+		entry.Error = lastErr.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if r.entries == 0 {
+		r.writeHeader()
+	} else {
+		r.write([]byte(","))
+	}
+	r.write([]byte("\n"))
+	r.write(data)
+	r.entries++
+}
+
+// writeHeader writes the document up to the opening of the entries
+func (r *HARRecorder) writeHeader() {
+	header, _ := json.Marshal(harLog{
+		Version: harVersion,
+		Creator: harCreator{Name: "retryablehttp-go", Version: libraryVersion()},
+	})
+	// the entries are appended to the log as they're recorded
+	header = bytes.TrimSuffix(header, []byte(`"entries":null}`))
+	r.write([]byte(`{"log":`))
+	r.write(header)
+	r.write([]byte(`"entries":[`))
+}
+
+// write writes data unless a previous write failed
+func (r *HARRecorder) write(data []byte) {
+	if r.err == nil {
+		_, r.err = r.w.Write(data)
+	}
+}
+
+// libraryVersion returns the version of the module the package is built from
+func libraryVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Path == modulePath && info.Main.Version != "" {
+			return info.Main.Version
+		}
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				return dep.Version
+			}
+		}
+	}
+	return "(devel)"
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	// Error is the error of the request, custom fields are prefixed with an underscore
+	Error string `json:"_error,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	SSL     float64 `json:"ssl"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// newHARRequest builds the request of the entry from the captured request dump
+func newHARRequest(req *Request) harRequest {
+	harReq := harRequest{
+		Method:      req.Method,
+		URL:         req.Request.URL.String(),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+	}
+	for name, values := range req.Request.URL.Query() {
+		for _, value := range values {
+			harReq.QueryString = append(harReq.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	dumped, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.Exchange.Request)))
+	if err != nil {
+		return harReq
+	}
+	harReq.HTTPVersion = dumped.Proto
+	harReq.Headers = append(harReq.Headers, harNameValue{Name: "Host", Value: dumped.Host})
+	harReq.Headers = append(harReq.Headers, harHeaders(dumped.Header)...)
+	for _, cookie := range dumped.Cookies() {
+		harReq.Cookies = append(harReq.Cookies, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	body, _ := io.ReadAll(dumped.Body)
+	harReq.BodySize = len(body)
+	if len(body) > 0 {
+		harReq.PostData = &harPostData{MimeType: dumped.Header.Get("Content-Type"), Text: string(body)}
+	}
+	return harReq
+}
+
+// newHARResponse builds the response of the entry from the captured response dump
+func newHARResponse(dump []byte) harResponse {
+	harResp := harResponse{
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		HeadersSize: -1,
+		BodySize:    -1,
+		Content:     harContent{Size: -1},
+	}
+	if dump == nil {
+		return harResp
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), nil)
+	if err != nil {
+		return harResp
+	}
+	body, _ := io.ReadAll(resp.Body)
+	harResp.Status = resp.StatusCode
+	harResp.StatusText = http.StatusText(resp.StatusCode)
+	harResp.HTTPVersion = resp.Proto
+	harResp.Headers = harHeaders(resp.Header)
+	for _, cookie := range resp.Cookies() {
+		harResp.Cookies = append(harResp.Cookies, harNameValue{Name: cookie.Name, Value: cookie.Value})
+	}
+	harResp.RedirectURL = resp.Header.Get("Location")
+	harResp.BodySize = len(body)
+	harResp.Content = harContent{Size: len(body), MimeType: resp.Header.Get("Content-Type")}
+	if utf8.Valid(body) {
+		harResp.Content.Text = string(body)
+	} else {
+		harResp.Content.Text = base64.StdEncoding.EncodeToString(body)
+		harResp.Content.Encoding = "base64"
+	}
+	return harResp
+}
+
+// harHeaders converts the headers into name/value pairs
+func harHeaders(header http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for _, name := range sortedKeys(header) {
+		for _, value := range header[name] {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// newHARTimings derives the timings of the final attempt from its trace, the time spent
+// before it (previous attempts and backoff) is reported as blocked
+func newHARTimings(trace *TraceInfo, start, end time.Time) harTimings {
+	timings := harTimings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1, Wait: durationMs(end.Sub(start))}
+	if trace == nil || trace.GotConn.Time.IsZero() || trace.GotFirstResponseByte.Time.IsZero() {
+		return timings
+	}
+	if !trace.DNSDone.Time.IsZero() && !trace.DNSStart.Time.IsZero() {
+		timings.DNS = durationMs(trace.DNSDone.Time.Sub(trace.DNSStart.Time))
+	}
+	if !trace.ConnectDone.Time.IsZero() && !trace.ConnectStart.Time.IsZero() {
+		timings.Connect = durationMs(trace.ConnectDone.Time.Sub(trace.ConnectStart.Time))
+	}
+	if !trace.TLSHandshakeDone.Time.IsZero() && !trace.TLSHandshakeStart.Time.IsZero() {
+		timings.SSL = durationMs(trace.TLSHandshakeDone.Time.Sub(trace.TLSHandshakeStart.Time))
+		// connect includes the tls handshake
+		if timings.Connect >= 0 {
+			timings.Connect += timings.SSL
+		}
+	}
+	wroteRequest := trace.WroteRequest.Time
+	if wroteRequest.IsZero() {
+		wroteRequest = trace.GotConn.Time
+	}
+	timings.Send = max(durationMs(wroteRequest.Sub(trace.GotConn.Time)), 0)
+	timings.Wait = max(durationMs(trace.GotFirstResponseByte.Time.Sub(wroteRequest)), 0)
+	timings.Receive = max(durationMs(end.Sub(trace.GotFirstResponseByte.Time)), 0)
+
+	blocked := durationMs(end.Sub(start)) - timings.Send - timings.Wait - timings.Receive
+	for _, timing := range []float64{timings.DNS, timings.Connect} {
+		if timing > 0 {
+			blocked -= timing
+		}
+	}
+	timings.Blocked = max(blocked, 0)
+	return timings
+}
+
+// durationMs returns the duration in milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
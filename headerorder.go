@@ -0,0 +1,77 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// writeRequest writes the body-less request to w, with its headers in the order given by
+// HeaderOrder or RandomizeHeaderOrder instead of the sorted order of http.Request.Write
+func (c *Client) writeRequest(w io.Writer, req *http.Request) error {
+	if len(c.options.HeaderOrder) == 0 && !c.options.RandomizeHeaderOrder {
+		return req.Write(w)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	header := req.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header["Host"] = []string{host}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	for _, key := range c.headerOrder(header) {
+		if !httpguts.ValidHeaderFieldName(key) {
+			return fmt.Errorf("invalid header field name %q", key)
+		}
+		for _, value := range header[key] {
+			if !httpguts.ValidHeaderFieldValue(value) {
+				return fmt.Errorf("invalid header field value for %q", key)
+			}
+			fmt.Fprintf(bw, "%s: %s\r\n", key, strings.TrimSpace(value))
+		}
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// headerOrder returns the keys of the header in the order to write them: the ones listed
+// in HeaderOrder first, case-insensitively, then the others shuffled with
+// RandomizeHeaderOrder or sorted
+func (c *Client) headerOrder(header http.Header) []string {
+	keys := make([]string, 0, len(header))
+	seen := make(map[string]bool, len(header))
+	for _, name := range c.options.HeaderOrder {
+		for key := range header {
+			if !seen[key] && strings.EqualFold(key, name) {
+				keys = append(keys, key)
+				seen[key] = true
+			}
+		}
+	}
+
+	rest := make([]string, 0, len(header)-len(keys))
+	for key := range header {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+	if c.options.RandomizeHeaderOrder {
+		rand.Shuffle(len(rest), func(i, j int) {
+			rest[i], rest[j] = rest[j], rest[i]
+		})
+	}
+	return append(keys, rest...)
+}
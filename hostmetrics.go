@@ -0,0 +1,74 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HostMetrics contains the aggregate metrics of the requests sent to a host
+type HostMetrics struct {
+	// Requests is the number of requests sent to the host
+	Requests uint64
+	// Retries is the number of retries of the requests
+	Retries uint64
+	// Failures is the number of failed attempts of the requests
+	Failures uint64
+	// Errors is the number of requests which failed without a response
+	Errors uint64
+	// AverageLatency is the average duration of the requests including all their attempts
+	AverageLatency time.Duration
+}
+
+// hostMetrics aggregates the metrics of the requests to a host:port when CollectHostMetrics is enabled
+type hostMetrics struct {
+	mu       sync.Mutex
+	metrics  HostMetrics
+	duration time.Duration
+}
+
+// recordHostMetrics adds the metrics of the request to the metrics of its host
+func (c *Client) recordHostMetrics(req *Request, resp *http.Response, retries, failures int, start time.Time) {
+	value, _ := c.hostMetrics.LoadOrStore(hostPortKey(req.Request.URL), &hostMetrics{})
+	host := value.(*hostMetrics)
+	host.mu.Lock()
+	defer host.mu.Unlock()
+	host.metrics.Requests++
+	host.metrics.Retries += uint64(retries)
+	host.metrics.Failures += uint64(failures)
+	if resp == nil {
+		host.metrics.Errors++
+	}
+	host.duration += time.Since(start)
+}
+
+func (h *hostMetrics) snapshot() HostMetrics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	metrics := h.metrics
+	if metrics.Requests > 0 {
+		metrics.AverageLatency = h.duration / time.Duration(metrics.Requests)
+	}
+	return metrics
+}
+
+// HostMetrics returns the metrics of the requests sent to the given host:port, collected
+// when CollectHostMetrics is enabled. Hosts without any request have zero metrics.
+func (c *Client) HostMetrics(host string) HostMetrics {
+	value, ok := c.hostMetrics.Load(host)
+	if !ok {
+		return HostMetrics{}
+	}
+	return value.(*hostMetrics).snapshot()
+}
+
+// AllHostMetrics returns the metrics of the requests sent to each host:port, collected
+// when CollectHostMetrics is enabled
+func (c *Client) AllHostMetrics() map[string]HostMetrics {
+	all := make(map[string]HostMetrics)
+	c.hostMetrics.Range(func(key, value any) bool {
+		all[key.(string)] = value.(*hostMetrics).snapshot()
+		return true
+	})
+	return all
+}
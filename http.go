@@ -3,16 +3,24 @@ package retryablehttp
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/projectdiscovery/fastdialer/fastdialer"
+	"github.com/projectdiscovery/utils/errkit"
+	ztls "github.com/zmap/zcrypto/tls"
 )
 
+// defaultTLSHandshakeTimeout is the default time limit of tls handshakes
+const defaultTLSHandshakeTimeout = 10 * time.Second
+
 // DisableZTLSFallback disables use of ztls when there is error in tls handshake
 // can also be disabled by setting DISABLE_ZTLS_FALLBACK env variable to true
 var DisableZTLSFallback = false
@@ -36,27 +44,331 @@ func DefaultReusePooledTransport() *http.Transport {
 		Proxy:                  http.ProxyFromEnvironment,
 		MaxIdleConns:           100,
 		IdleConnTimeout:        90 * time.Second,
-		TLSHandshakeTimeout:    10 * time.Second,
+		TLSHandshakeTimeout:    defaultTLSHandshakeTimeout,
 		ExpectContinueTimeout:  1 * time.Second,
 		MaxIdleConnsPerHost:    100,
 		MaxResponseHeaderBytes: 4096, // net/http default is 10Mb
-		TLSClientConfig: &tls.Config{
-			Renegotiation:      tls.RenegotiateOnceAsClient, // Renegotiation is not supported in TLS 1.3 as per docs
-			InsecureSkipVerify: true,
-			MinVersion:         tls.VersionTLS10,
-		},
+		TLSClientConfig:        defaultTLSConfig(),
 	}
 	if fd != nil {
-		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return fd.Dial(ctx, network, addr)
-		}
+		// ipv6 literals with a zone are dialed with net.Dialer, see dialContext
+		zoneDialTLS := ztlsFallbackDialTLSContext(dialContext, transport.TLSClientConfig, nil, defaultTLSHandshakeTimeout)
+		transport.DialContext = dialContext
 		transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if hasIPv6Zone(addr) {
+				return zoneDialTLS(ctx, network, addr)
+			}
 			return fd.DialTLS(ctx, network, addr)
 		}
 	}
 	return transport
 }
 
+// defaultTLSConfig returns the tls config used by default transports
+func defaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		Renegotiation:      tls.RenegotiateOnceAsClient, // Renegotiation is not supported in TLS 1.3 as per docs
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+	}
+}
+
+// GetZtlsFallbackDialTLSContext returns a DialTLSContext function performing the tls
+// handshake with crypto/tls and the given config. If the handshake fails the connection
+// is dialed again and the handshake is retried with ztls using chrome ciphers, unless
+// DisableZTLSFallback is set. Each handshake is limited to 10 seconds.
+func GetZtlsFallbackDialTLSContext(tlsConfig *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return defaultDialTLSContext(tlsConfig, defaultTLSHandshakeTimeout)
+}
+
+// defaultDialTLSContext is like GetZtlsFallbackDialTLSContext handshaking with the fastdialer
+// DialTLSWithConfig and DialZTLSWithConfig. Dials fastdialer can't perform as configured (ipv6
+// zones, tls 1.3 only, verified connections, disabled fallback) use ztlsFallbackDialTLSContext.
+func defaultDialTLSContext(tlsConfig *tls.Config, handshakeTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialTLS := ztlsFallbackDialTLSContext(dialContext, tlsConfig, nil, handshakeTimeout)
+	fd, _ := getFastDialer()
+	if fd == nil || tlsConfig.MinVersion >= tls.VersionTLS13 || tlsConfig.VerifyConnection != nil {
+		return dialTLS
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if DisableZTLSFallback || hasIPv6Zone(addr) {
+			return dialTLS(ctx, network, addr)
+		}
+		handshakeCtx, cancel := withHandshakeTimeout(ctx, handshakeTimeout)
+		defer cancel()
+		conn, err := fd.DialTLSWithConfig(handshakeCtx, network, addr, tlsConfig)
+		// only failed handshakes are retried with ztls, timed out ones leave no time for it
+		if err == nil || handshakeCtx.Err() != nil || errkit.IsNetworkPermanentErr(err) || errkit.IsNetworkTemporaryErr(err) {
+			return conn, err
+		}
+		return fd.DialZTLSWithConfig(handshakeCtx, network, addr, asZTLSConfig(tlsConfig))
+	}
+}
+
+// ztlsFallbackDisabled reports whether the ztls fallback is disabled by the override,
+// or by the global DisableZTLSFallback if unset
+func ztlsFallbackDisabled(override *bool) bool {
+	if override != nil {
+		return *override
+	}
+	return DisableZTLSFallback
+}
+
+// ztlsFallbackDialTLSContext is like GetZtlsFallbackDialTLSContext dialing with dial, disableFallback
+// overrides the global DisableZTLSFallback when set and handshakes are limited to handshakeTimeout,
+// if positive
+func ztlsFallbackDialTLSContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config, disableFallback *bool, handshakeTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		config := tlsConfig.Clone()
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		handshakeCtx, cancel := withHandshakeTimeout(ctx, handshakeTimeout)
+		defer cancel()
+
+		tlsConn := tls.Client(conn, config)
+		handshakeErr := tlsConn.HandshakeContext(handshakeCtx)
+		if handshakeErr == nil {
+			return tlsConn, nil
+		}
+		conn.Close()
+		// ztls does not support tls 1.3 and timed out handshakes leave no time for the fallback
+		if ztlsFallbackDisabled(disableFallback) || config.MinVersion >= tls.VersionTLS13 || handshakeCtx.Err() != nil {
+			return nil, handshakeErr
+		}
+
+		conn, err = dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ztlsConn := ztls.Client(conn, asZTLSConfig(config))
+		// ztls does not support context, bound the handshake with a deadline instead
+		if deadline, ok := handshakeCtx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		if err := ztlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if config.VerifyConnection != nil {
+			if err := config.VerifyConnection(asConnectionState(ztlsConn.ConnectionState())); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return ztlsConn, nil
+	}
+}
+
+// withHandshakeTimeout returns the context of a tls handshake limited to timeout, if positive
+func withHandshakeTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// asZTLSConfig converts a crypto/tls config into the ztls config used as fallback
+func asZTLSConfig(config *tls.Config) *ztls.Config {
+	ztlsConfig := &ztls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         config.MinVersion,
+		MaxVersion:         config.MaxVersion,
+		CipherSuites:       config.CipherSuites,
+	}
+	if len(ztlsConfig.CipherSuites) == 0 {
+		ztlsConfig.CipherSuites = ztls.ChromeCiphers
+	}
+	for _, cert := range config.Certificates {
+		ztlsConfig.Certificates = append(ztlsConfig.Certificates, ztls.Certificate{
+			Certificate: cert.Certificate,
+			PrivateKey:  cert.PrivateKey,
+			OCSPStaple:  cert.OCSPStaple,
+		})
+	}
+	return ztlsConfig
+}
+
+// asConnectionState converts the state of a ztls connection into the crypto/tls one
+// given to tls.Config.VerifyConnection
+func asConnectionState(state ztls.ConnectionState) tls.ConnectionState {
+	connectionState := tls.ConnectionState{
+		Version:            state.Version,
+		HandshakeComplete:  state.HandshakeComplete,
+		DidResume:          state.DidResume,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+	}
+	for _, cert := range state.PeerCertificates {
+		if parsed, err := x509.ParseCertificate(cert.Raw); err == nil {
+			connectionState.PeerCertificates = append(connectionState.PeerCertificates, parsed)
+		}
+	}
+	return connectionState
+}
+
+// dialContext dials the address with fastdialer if available or with a standard dialer otherwise,
+// as are ipv6 literals with a zone
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if fd, _ := getFastDialer(); fd != nil && !hasIPv6Zone(addr) {
+		return fd.Dial(ctx, network, addr)
+	}
+	dialer := &net.Dialer{
+		Timeout:   defaultDialTimeout,
+		KeepAlive: defaultTCPKeepAlive,
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// hasIPv6Zone returns true if the host of addr is an ipv6 literal with a zone
+// (e.g. [fe80::1%eth0]:80), which fastdialer can't dial
+func hasIPv6Zone(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && strings.Contains(host, "%")
+}
+
+// defaultDialTimeout is the default time limit of dials
+const defaultDialTimeout = 30 * time.Second
+
+// defaultTCPKeepAlive is the default interval of tcp keep-alive probes
+const defaultTCPKeepAlive = 30 * time.Second
+
+// newDialContext returns a dialContext limiting dials to timeout and setting the tcp
+// keep-alive interval of the connections to keepAlive, negative disables keep-alives.
+// Connections are dialed from localAddr if not nil and their sockets are set up by control
+// if not nil, both bypassing fastdialer which can't do either but whose dns cache still
+// resolves the hosts.
+func newDialContext(timeout, keepAlive time.Duration, localAddr net.Addr, control func(network, address string, c syscall.RawConn) error) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if localAddr != nil || control != nil {
+			dialer := &net.Dialer{
+				Timeout:   timeout,
+				KeepAlive: keepAlive,
+				LocalAddr: localAddr,
+				Control:   control,
+			}
+			return dialFromLocalAddr(ctx, dialer, network, addr)
+		}
+		if fd, _ := getFastDialer(); fd != nil && !hasIPv6Zone(addr) {
+			// fastdialer is shared between clients, bound the dial with the context
+			// and set keep-alives on the connection instead
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			conn, err := fd.Dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			setKeepAlive(conn, keepAlive)
+			return conn, nil
+		}
+		dialer := &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: keepAlive,
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// withHostsMap returns dial connecting to the ip mapped to the host of the address in hosts,
+// if any, instead of resolving it. The tls handshake still uses the host as server name.
+func withHostsMap(dial func(ctx context.Context, network, addr string) (net.Conn, error), hosts map[string]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if len(hosts) == 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			ip, ok := hosts[host]
+			if !ok {
+				ip, ok = hosts[strings.ToLower(host)]
+			}
+			if ok {
+				addr = net.JoinHostPort(ip, port)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// dialFromLocalAddr dials the address with the dialer bound to a local address, among
+// the addresses the host resolves to only the ones of the local address family are dialed
+func dialFromLocalAddr(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	localAddr, ok := dialer.LocalAddr.(*net.TCPAddr)
+	host, port, err := net.SplitHostPort(addr)
+	if !ok || localAddr.IP == nil || localAddr.IP.IsUnspecified() || err != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = lookupIPs(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+
+	localIPv4 := localAddr.IP.To4() != nil
+	var lastErr error
+	for _, ip := range ips {
+		if (ip.To4() != nil) != localIPv4 {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("%w: %s can't reach %s", ErrAddressFamilyMismatch, localAddr.IP, host)
+	}
+	return nil, lastErr
+}
+
+// keepAliveConn is implemented by tcp connections
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive sets the tcp keep-alive interval of the connection, negative disables keep-alives
+func setKeepAlive(conn net.Conn, keepAlive time.Duration) {
+	tcpConn, ok := conn.(keepAliveConn)
+	if !ok {
+		return
+	}
+	if keepAlive < 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	_ = tcpConn.SetKeepAlivePeriod(keepAlive)
+}
+
+// configureTransportTLS makes the transport of the client dial as configured by the options
+// and use the given tls config for both crypto/tls handshakes and the ztls fallback
+func configureTransportTLS(client *http.Client, tlsConfig *tls.Config, options *Options) {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+	transport.DialContext = options.dialContext()
+	transport.TLSClientConfig = tlsConfig.Clone()
+	transport.TLSHandshakeTimeout = options.tlsHandshakeTimeout()
+	if options.customDialer() || options.DisableZTLSFallback != nil {
+		transport.DialTLSContext = ztlsFallbackDialTLSContext(transport.DialContext, transport.TLSClientConfig, options.DisableZTLSFallback, transport.TLSHandshakeTimeout)
+	} else {
+		transport.DialTLSContext = defaultDialTLSContext(transport.TLSClientConfig, transport.TLSHandshakeTimeout)
+	}
+}
+
 // DefaultClient returns a new http.Client with similar default values to
 // http.Client, but with a non-shared Transport, idle connections disabled, and
 // keepalives disabled.
@@ -0,0 +1,162 @@
+package retryablehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HasHTTP3 returns true if the response advertises http/3 support via the Alt-Svc header
+func HasHTTP3(resp *http.Response) bool {
+	_, ok := http3AltAuthority(resp)
+	return ok
+}
+
+// http3Authority is the http/3 host:port advertised by an origin until it expires
+type http3Authority struct {
+	addr    string
+	expires time.Time
+}
+
+// http3AltAuthority returns the http/3 authority advertised in the Alt-Svc header of the
+// response. An empty host in the advertised authority means the origin host.
+func http3AltAuthority(resp *http.Response) (http3Authority, bool) {
+	if resp == nil || resp.Request == nil || resp.Request.URL == nil {
+		return http3Authority{}, false
+	}
+	entries, _ := ParseAltSvc(resp)
+	for _, entry := range entries {
+		if entry.Protocol != "h3" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(entry.Authority)
+		if err != nil || port == "" {
+			continue
+		}
+		if host == "" {
+			host = resp.Request.URL.Hostname()
+		}
+		return http3Authority{addr: net.JoinHostPort(host, port), expires: time.Now().Add(entry.MaxAge)}, true
+	}
+	return http3Authority{}, false
+}
+
+// loadHTTP3Authority returns the unexpired http/3 host:port advertised by the origin,
+// expired ones are removed
+func (c *Client) loadHTTP3Authority(origin string) (string, bool) {
+	value, ok := c.http3Authorities.Load(origin)
+	if !ok {
+		return "", false
+	}
+	alt := value.(http3Authority)
+	if !time.Now().Before(alt.expires) {
+		c.http3Authorities.CompareAndDelete(origin, value)
+		return "", false
+	}
+	return alt.addr, true
+}
+
+// newHTTP3Client returns an http.Client using the quic-go http/3 round tripper.
+// Connections to origins which advertised an alternative http/3 authority
+// are dialed to that authority while keeping the origin as SNI and Host.
+func (c *Client) newHTTP3Client() *http.Client {
+	tlsConfig := &tls.Config{InsecureSkipVerify: true}
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	}
+	roundTripper := &http3.RoundTripper{
+		TLSClientConfig:    tlsConfig,
+		DisableCompression: c.options.DisableAutoAcceptEncoding,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			if alt, ok := c.loadHTTP3Authority(addr); ok {
+				addr = alt
+			}
+			conn, err := quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, &http3DialError{err: err}
+			}
+			return conn, nil
+		},
+	}
+	return &http.Client{Transport: roundTripper}
+}
+
+// http3DialError is returned by the http/3 round tripper of the client when the quic
+// connection couldn't be established, the request wasn't sent
+type http3DialError struct {
+	err error
+}
+
+func (e *http3DialError) Error() string { return e.err.Error() }
+
+func (e *http3DialError) Unwrap() error { return e.err }
+
+// canFallbackFromHTTP3 reports whether the request failing over http/3 with err can be sent
+// with the standard client. Only requests which weren't sent (quic dial or handshake
+// failures) or idempotent ones are sent again, the server may have processed the others.
+func canFallbackFromHTTP3(req *Request, err error) bool {
+	// streaming bodies can't be sent again once they started flowing
+	if !req.canRetryBody() || req.Context().Err() != nil {
+		return false
+	}
+	var dialErr *http3DialError
+	var handshakeErr *quic.HandshakeTimeoutError
+	if errors.As(err, &dialErr) || errors.As(err, &handshakeErr) {
+		return true
+	}
+	return isIdempotent(req.Method, req.Header)
+}
+
+// doWithHTTP3 sends https requests over http/3 when HTTP3 is enabled, falling back to the
+// standard client if it fails and canFallbackFromHTTP3 allows it, otherwise it upgrades the requests to http/3 when advertised.
+func (c *Client) doWithHTTP3(req *Request) (*http.Response, error) {
+	if !c.options.HTTP3 {
+		return c.doWithHTTP3Upgrade(req)
+	}
+	if req.Request.URL.Scheme != "https" {
+		return c.HTTPClient.Do(req.Request)
+	}
+	resp, err := c.HTTPClient3.Do(req.Request)
+	if err == nil || !canFallbackFromHTTP3(req, err) {
+		return resp, err
+	}
+	return c.HTTPClient.Do(req.Request)
+}
+
+// doWithHTTP3Upgrade sends the request over http/3 if the origin is known to support it,
+// otherwise it sends the request with the standard client and records the http/3 authority
+// advertised via Alt-Svc by the response for the next requests to the origin.
+func (c *Client) doWithHTTP3Upgrade(req *Request) (*http.Response, error) {
+	if req.Request.URL.Scheme != "https" {
+		return c.HTTPClient.Do(req.Request)
+	}
+
+	origin := hostPortKey(req.Request.URL)
+	if _, ok := c.loadHTTP3Authority(origin); ok {
+		resp, err := c.HTTPClient3.Do(req.Request)
+		if err == nil {
+			return resp, nil
+		}
+		// http/3 stopped working for the origin, the next requests use http/1.x or http/2
+		c.http3Authorities.Delete(origin)
+		if !canFallbackFromHTTP3(req, err) {
+			return resp, err
+		}
+	}
+
+	resp, err := c.HTTPClient.Do(req.Request)
+	if err != nil {
+		return resp, err
+	}
+	// the request already got a response, it's not sent again over http/3
+	if alt, ok := http3AltAuthority(resp); ok && time.Now().Before(alt.expires) {
+		c.http3Authorities.Store(origin, alt)
+	}
+	return resp, nil
+}
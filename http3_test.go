@@ -0,0 +1,226 @@
+package retryablehttp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAutoHTTP3Upgrade_Do(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer udpConn.Close()
+	h3Port := udpConn.LocalAddr().(*net.UDPAddr).Port
+
+	var tcpRequests, requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.ProtoMajor < 3 {
+			tcpRequests.Add(1)
+		}
+		w.Header().Set("Alt-Svc", fmt.Sprintf(`h3-29=":%d"; ma=60, h3=":%d"; ma=60`, h3Port, h3Port))
+		fmt.Fprint(w, r.Proto)
+	})
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+
+	h3Server := &http3.Server{Handler: handler, TLSConfig: ts.TLS.Clone()}
+	go h3Server.Serve(udpConn) //nolint
+	defer h3Server.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin:     10 * time.Millisecond,
+		RetryWaitMax:     50 * time.Millisecond,
+		RetryMax:         1,
+		Timeout:          5 * time.Second,
+		AutoHTTP3Upgrade: true,
+	})
+
+	// the advertising response is returned, later requests are sent over http/3
+	for _, proto := range []string{"HTTP/1.1", "HTTP/3.0", "HTTP/3.0"} {
+		req, err := NewRequest(http.MethodPost, ts.URL, "body")
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, proto, string(body))
+	}
+	// each request was sent once, only the first one over tcp
+	require.Equal(t, int32(3), requests.Load())
+	require.Equal(t, int32(1), tcpRequests.Load())
+}
+
+func TestHTTP3_Do(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})
+	ts := httptest.NewTLSServer(handler)
+	defer ts.Close()
+
+	proto := func(client *Client) string {
+		req, err := NewRequest(http.MethodGet, ts.URL, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body)
+	}
+	newClient := func() *Client {
+		return NewClient(Options{
+			RetryMax: 0,
+			Timeout:  5 * time.Second,
+			HTTP3:    true,
+			HTTP3RoundTripper: &http3.RoundTripper{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				QuicConfig:      &quic.Config{HandshakeIdleTimeout: 200 * time.Millisecond},
+			},
+		})
+	}
+
+	// nothing listens on udp yet, quic dial fails and the request falls back to tcp
+	require.Equal(t, "HTTP/1.1", proto(newClient()))
+
+	// serve http/3 on the udp port matching the tcp one
+	udpConn, err := net.ListenPacket("udp", ts.Listener.Addr().String())
+	require.Nil(t, err)
+	defer udpConn.Close()
+	h3Server := &http3.Server{Handler: handler, TLSConfig: ts.TLS.Clone()}
+	go h3Server.Serve(udpConn) //nolint
+	defer h3Server.Close()
+
+	require.Equal(t, "HTTP/3.0", proto(newClient()))
+}
+
+func TestParseAltSvc(t *testing.T) {
+	day := 24 * time.Hour
+	for _, tc := range []struct {
+		header  []string
+		entries []AltSvcEntry
+		err     bool
+	}{
+		{
+			header: []string{`h3=":443"; ma=2592000, h2=":443"`},
+			entries: []AltSvcEntry{
+				{Protocol: "h3", Authority: ":443", MaxAge: 2592000 * time.Second},
+				{Protocol: "h2", Authority: ":443", MaxAge: day},
+			},
+		},
+		{
+			header: []string{`h3-29="alt.example.com:8443";ma=60;persist=1`, `h2="a\"b,c:443"`},
+			entries: []AltSvcEntry{
+				{Protocol: "h3-29", Authority: "alt.example.com:8443", MaxAge: time.Minute, Persist: true},
+				{Protocol: "h2", Authority: `a"b,c:443`, MaxAge: day},
+			},
+		},
+		{header: []string{`w%3Dx%3Ay=":80", , h3=":443"`}, entries: []AltSvcEntry{
+			{Protocol: "w=x:y", Authority: ":80", MaxAge: day},
+			{Protocol: "h3", Authority: ":443", MaxAge: day},
+		}},
+		{header: []string{"clear"}},
+		{header: []string{`h3=":443", h2`}, entries: []AltSvcEntry{{Protocol: "h3", Authority: ":443", MaxAge: day}}, err: true},
+		{header: []string{`h3=":443"; ma=soon`}, err: true},
+		{header: []string{`h3=":443`}, err: true},
+	} {
+		resp := &http.Response{Header: http.Header{"Alt-Svc": tc.header}}
+		entries, err := ParseAltSvc(resp)
+		require.Equal(t, tc.err, err != nil, "unexpected error %v for %v", err, tc.header)
+		require.Equal(t, tc.entries, entries, tc.header)
+	}
+
+	request := &http.Request{URL: &url.URL{Scheme: "https", Host: "example.com"}}
+	resp := &http.Response{Request: request, Header: http.Header{"Alt-Svc": {`h3-29=":8443", h2=":443"; ma=60, h3=":8443"`}}}
+	require.True(t, HasHTTP2(resp))
+	require.True(t, HasHTTP3(resp))
+	authority, _ := http3AltAuthority(resp)
+	require.Equal(t, "example.com:8443", authority.addr)
+	require.WithinDuration(t, time.Now().Add(24*time.Hour), authority.expires, time.Minute)
+	resp.Header.Set("Alt-Svc", `h3=":8443"; ma=60`)
+	authority, _ = http3AltAuthority(resp)
+	require.WithinDuration(t, time.Now().Add(time.Minute), authority.expires, time.Second)
+
+	// expired authorities are ignored and removed
+	client := NewClient(Options{})
+	client.http3Authorities.Store("example.com:443", http3Authority{addr: "example.com:8443", expires: time.Now().Add(time.Minute)})
+	client.http3Authorities.Store("expired.com:443", http3Authority{addr: "expired.com:8443", expires: time.Now().Add(-time.Second)})
+	addr, ok := client.loadHTTP3Authority("example.com:443")
+	require.True(t, ok)
+	require.Equal(t, "example.com:8443", addr)
+	_, ok = client.loadHTTP3Authority("expired.com:443")
+	require.False(t, ok)
+	_, ok = client.http3Authorities.Load("expired.com:443")
+	require.False(t, ok)
+
+	resp.Header.Set("Alt-Svc", `h3-29=":8443"`)
+	require.False(t, HasHTTP2(resp))
+	require.False(t, HasHTTP3(resp))
+}
+
+func TestHTTP3Fallback_Do(t *testing.T) {
+	var requests atomic.Int32
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, r.Proto)
+	}))
+	defer ts.Close()
+
+	do := func(method string, roundTripper http.RoundTripper) (string, error) {
+		client := NewClient(Options{
+			RetryMax:          0,
+			Timeout:           5 * time.Second,
+			HTTP3:             true,
+			HTTP3RoundTripper: roundTripper,
+		})
+		req, err := NewRequest(method, ts.URL, "body")
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return string(body), nil
+	}
+	// the request may have been processed by the server
+	sent := roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.New("stream reset")
+	})
+
+	// non-idempotent requests failing after being sent aren't sent again
+	_, err := do(http.MethodPost, sent)
+	require.NotNil(t, err)
+	require.Equal(t, int32(0), requests.Load())
+
+	// idempotent ones fall back to tcp
+	proto, err := do(http.MethodPut, sent)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1", proto)
+
+	// quic handshake failures fall back for any method, nothing was sent
+	unreachable := &http3.RoundTripper{
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return nil, &quic.HandshakeTimeoutError{}
+		},
+	}
+	proto, err = do(http.MethodPost, unreachable)
+	require.Nil(t, err)
+	require.Equal(t, "HTTP/1.1", proto)
+	require.Equal(t, int32(2), requests.Load())
+}
@@ -0,0 +1,82 @@
+package retryablehttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// retryAttemptKey is the context key of the attempt passed to the retry policy
+type retryAttemptKey struct{}
+
+// retryAttempt describes the attempt the retry policy is called for
+type retryAttempt struct {
+	method string
+	header http.Header
+	// tracked is set when the retry policies rely on gotConn, untracked attempts
+	// may have been written
+	tracked bool
+	// gotConn is set once the attempt obtained a connection from the transport,
+	// from then on the request may have been (partially) written
+	gotConn atomic.Bool
+}
+
+// idempotent reports whether the request can be safely retried once sent
+func (a *retryAttempt) idempotent() bool {
+	return isIdempotent(a.method, a.header)
+}
+
+// isIdempotent reports whether a request with the method and header can be safely sent
+// again, like net/http requests with an Idempotency-Key or X-Idempotency-Key header are
+// considered idempotent
+func isIdempotent(method string, header http.Header) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	_, hasKey := header["Idempotency-Key"]
+	_, hasXKey := header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+// newRetryAttempt returns the attempt of the request, whose connection is tracked.
+// The retry policies only rely on it if track is set.
+func newRetryAttempt(req *Request, track bool) *retryAttempt {
+	attempt := &retryAttempt{method: req.Method, header: req.Header, tracked: track}
+	wrapContextWithRetryAttempt(req, attempt)
+	return attempt
+}
+
+// wrapContextWithRetryAttempt installs the trace recording when the attempt obtains a connection
+func wrapContextWithRetryAttempt(req *Request, attempt *retryAttempt) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			attempt.gotConn.Store(true)
+		},
+	}
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// IdempotentOnlyRetryPolicy wraps the policy (DefaultRetryPolicy if nil) to retry
+// non-idempotent requests (POST, PATCH, ...) only when they failed before a connection
+// was obtained, and so before any byte was written. Idempotent requests are retried
+// according to the policy. The connections of the attempts are tracked when the policy is
+// installed with Options.NoRetryNonIdempotent, otherwise failed non-idempotent requests
+// are never retried since they may have been written.
+func IdempotentOnlyRetryPolicy(policy CheckRetry) CheckRetry {
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		retry, checkErr := policy(ctx, resp, err)
+		if !retry {
+			return retry, checkErr
+		}
+		attempt, ok := ctx.Value(retryAttemptKey{}).(*retryAttempt)
+		if !ok || attempt.idempotent() {
+			return retry, checkErr
+		}
+		return resp == nil && attempt.tracked && !attempt.gotConn.Load(), checkErr
+	}
+}
@@ -0,0 +1,27 @@
+package retryablehttp
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// getHostSemaphore returns the semaphore limiting the in-flight requests to the
+// request host:port, nil if they are unlimited
+func (c *Client) getHostSemaphore(req *Request) *semaphore.Weighted {
+	if c.options.MaxInFlightPerHost <= 0 {
+		return nil
+	}
+	sem, _ := c.hostSemaphores.LoadOrStore(hostPortKey(req.Request.URL), semaphore.NewWeighted(int64(c.options.MaxInFlightPerHost)))
+	return sem.(*semaphore.Weighted)
+}
+
+// releaseHostSemaphore makes the attempt cancel func release the in-flight slot as well.
+// The slot of the returned response is held until its body is closed.
+func releaseHostSemaphore(cancelAttempt context.CancelFunc, sem *semaphore.Weighted) context.CancelFunc {
+	return sync.OnceFunc(func() {
+		cancelAttempt()
+		sem.Release(1)
+	})
+}
@@ -0,0 +1,35 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// InterimResponse is an informational (1xx) response received before the final response,
+// e.g. 103 Early Hints whose Link headers reveal the resources the page preloads
+type InterimResponse struct {
+	StatusCode int
+	Header     http.Header
+}
+
+// wrapContextWithInterimResponses installs the trace recording the interim responses of
+// the attempt in the request metrics
+func wrapContextWithInterimResponses(req *Request) {
+	req.Metrics.InterimResponses = nil
+
+	var mu sync.Mutex
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			mu.Lock()
+			defer mu.Unlock()
+			req.Metrics.InterimResponses = append(req.Metrics.InterimResponses, InterimResponse{
+				StatusCode: code,
+				Header:     http.Header(header).Clone(),
+			})
+			return nil
+		},
+	}
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -39,3 +39,32 @@ func (c *Client) Post(url, bodyType string, body interface{}) (*http.Response, e
 func (c *Client) PostForm(url string, data url.Values) (*http.Response, error) {
 	return c.Post(url, "application/x-www-form-urlencoded", strings.NewReader(data.Encode()))
 }
+
+// Put is a convenience method for doing simple PUT requests.
+func (c *Client) Put(url, bodyType string, body interface{}) (*http.Response, error) {
+	req, err := NewRequest(http.MethodPut, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", bodyType)
+	return c.Do(req)
+}
+
+// Patch is a convenience method for doing simple PATCH requests.
+func (c *Client) Patch(url, bodyType string, body interface{}) (*http.Response, error) {
+	req, err := NewRequest(http.MethodPatch, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", bodyType)
+	return c.Do(req)
+}
+
+// Delete is a convenience method for doing simple DELETE requests.
+func (c *Client) Delete(url string) (*http.Response, error) {
+	req, err := NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
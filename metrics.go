@@ -0,0 +1,122 @@
+package retryablehttp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// MetricsCollector receives the metrics of the requests sent by the client,
+// e.g. to export them to prometheus, statsd or opentelemetry.
+// Implementations must be safe for concurrent use.
+type MetricsCollector interface {
+	// ObserveRequest is called once Do returns with the final status code (0 if
+	// there is no response), the number of attempts and the duration of all of them
+	ObserveRequest(host string, status int, attempts int, duration time.Duration)
+	// ObserveRetry is called before each retry with its reason: "timeout" or "error"
+	// for failed attempts, "status_<code>" for retried responses
+	ObserveRetry(host string, reason string)
+}
+
+// observeRequest reports the request to the metrics collector
+func (c *Client) observeRequest(req *Request, resp *http.Response, attempts int, start time.Time) {
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	c.options.MetricsCollector.ObserveRequest(req.Request.URL.Host, status, attempts, time.Since(start))
+}
+
+// observeRetry reports the retry of the request to the metrics collector
+func (c *Client) observeRetry(req *Request, resp *http.Response, err error) {
+	c.options.MetricsCollector.ObserveRetry(req.Request.URL.Host, retryReason(resp, err))
+}
+
+// retryCause classifies the reason of retrying an attempt
+type retryCause int
+
+const (
+	retryUnknown retryCause = iota
+	retryStatus
+	retryPartialResponse
+	retryConnectionReset
+	retryConnectionRefused
+	retryUnexpectedEOF
+	retryConnectionClosed
+	retryTimeout
+	retryError
+)
+
+// retryCauseDescriptions are the human readable descriptions of the causes not
+// depending on the response or error
+var retryCauseDescriptions = map[retryCause]string{
+	retryUnknown:           "unknown",
+	retryPartialResponse:   "partial response",
+	retryConnectionReset:   "connection reset",
+	retryConnectionRefused: "connection refused",
+	retryUnexpectedEOF:     "unexpected EOF",
+	retryConnectionClosed:  "connection closed",
+	retryTimeout:           "timeout",
+}
+
+// classifyRetry returns the cause of retrying an attempt
+func classifyRetry(resp *http.Response, err error) retryCause {
+	var netErr net.Error
+	switch {
+	case err == nil && resp != nil:
+		return retryStatus
+	case err == nil:
+		return retryUnknown
+	case errors.Is(err, ErrPartialResponse):
+		return retryPartialResponse
+	case errors.Is(err, syscall.ECONNRESET):
+		return retryConnectionReset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return retryConnectionRefused
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return retryUnexpectedEOF
+	case errors.Is(err, io.EOF):
+		return retryConnectionClosed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return retryTimeout
+	default:
+		return retryError
+	}
+}
+
+// retryReason returns the low cardinality reason of retrying an attempt, reported to
+// the metrics collector and the tracer
+func retryReason(resp *http.Response, err error) string {
+	switch classifyRetry(resp, err) {
+	case retryStatus:
+		return "status_" + strconv.Itoa(resp.StatusCode)
+	case retryUnknown:
+		return "unknown"
+	case retryTimeout:
+		return "timeout"
+	default:
+		return "error"
+	}
+}
+
+// describeRetry returns the human readable reason of retrying an attempt, see Metrics.RetryReasons
+func describeRetry(resp *http.Response, err error) string {
+	switch cause := classifyRetry(resp, err); cause {
+	case retryStatus:
+		return "status " + strconv.Itoa(resp.StatusCode)
+	case retryError:
+		// the method and url of the request are noise
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err.Error()
+		}
+		return err.Error()
+	default:
+		return retryCauseDescriptions[cause]
+	}
+}
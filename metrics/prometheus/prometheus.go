@@ -0,0 +1,109 @@
+// Package prometheus provides a retryablehttp.MetricsCollector exporting the
+// requests metrics as prometheus series
+package prometheus
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/projectdiscovery/retryablehttp-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector exports the metrics of the requests sent by a retryablehttp.Client
+type Collector struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	attempts *prometheus.HistogramVec
+	retries  *prometheus.CounterVec
+	denied   *prometheus.CounterVec
+	// hostLabel labels the series by the host of the requests
+	hostLabel bool
+}
+
+var (
+	_ retryablehttp.MetricsCollector     = &Collector{}
+	_ retryablehttp.RetryBudgetCollector = &Collector{}
+)
+
+// NewCollector creates the metrics with the given namespace and registers them to the registerer.
+// The series aren't labeled by host, whose cardinality is unbounded when requesting many hosts.
+func NewCollector(namespace string, registerer prometheus.Registerer) (*Collector, error) {
+	return newCollector(namespace, registerer, false)
+}
+
+// NewHostCollector is like NewCollector but labels the series by the host of the requests,
+// it must only be used when the client requests a bounded set of hosts.
+func NewHostCollector(namespace string, registerer prometheus.Registerer) (*Collector, error) {
+	return newCollector(namespace, registerer, true)
+}
+
+func newCollector(namespace string, registerer prometheus.Registerer, hostLabel bool) (*Collector, error) {
+	labels := func(names ...string) []string {
+		if hostLabel {
+			return append([]string{"host"}, names...)
+		}
+		return names
+	}
+	c := &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Number of requests by final status code (0 if failed).",
+		}, labels("status")),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of requests including all attempts.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels()),
+		attempts: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_attempts",
+			Help:      "Number of attempts of requests.",
+			Buckets:   []float64{1, 2, 3, 5, 10},
+		}, labels()),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_retries_total",
+			Help:      "Number of retries by reason.",
+		}, labels("reason")),
+		denied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_retries_budget_denied_total",
+			Help:      "Number of retries not made as the retry budget was exhausted.",
+		}, labels()),
+		hostLabel: hostLabel,
+	}
+	for _, collector := range []prometheus.Collector{c.requests, c.duration, c.attempts, c.retries, c.denied} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// labelValues returns the label values of a series, prefixed by the host if labeled by host
+func (c *Collector) labelValues(host string, values ...string) []string {
+	if c.hostLabel {
+		return append([]string{host}, values...)
+	}
+	return values
+}
+
+// ObserveRequest implements retryablehttp.MetricsCollector
+func (c *Collector) ObserveRequest(host string, status int, attempts int, duration time.Duration) {
+	c.requests.WithLabelValues(c.labelValues(host, strconv.Itoa(status))...).Inc()
+	c.duration.WithLabelValues(c.labelValues(host)...).Observe(duration.Seconds())
+	c.attempts.WithLabelValues(c.labelValues(host)...).Observe(float64(attempts))
+}
+
+// ObserveRetry implements retryablehttp.MetricsCollector
+func (c *Collector) ObserveRetry(host string, reason string) {
+	c.retries.WithLabelValues(c.labelValues(host, reason)...).Inc()
+}
+
+// ObserveRetryBudgetDenied implements retryablehttp.RetryBudgetCollector
+func (c *Collector) ObserveRetryBudgetDenied(host string) {
+	c.denied.WithLabelValues(c.labelValues(host)...).Inc()
+}
@@ -0,0 +1,109 @@
+package prometheus
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/projectdiscovery/retryablehttp-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	registry := prometheus.NewRegistry()
+	collector, err := NewCollector("scanner", registry)
+	require.Nil(t, err)
+
+	client := retryablehttp.NewClient(retryablehttp.Options{MetricsCollector: collector})
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+	names := map[string]float64{}
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		if counter := metric.GetCounter(); counter != nil {
+			names[family.GetName()] = counter.GetValue()
+		} else {
+			names[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	require.Equal(t, map[string]float64{
+		"scanner_http_requests_total":           1,
+		"scanner_http_request_duration_seconds": 1,
+		"scanner_http_request_attempts":         1,
+	}, names)
+}
+
+func TestCollectorRetryBudgetDenied(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	registry := prometheus.NewRegistry()
+	collector, err := NewCollector("scanner", registry)
+	require.Nil(t, err)
+
+	client := retryablehttp.NewClient(retryablehttp.Options{
+		MetricsCollector: collector,
+		RetryMax:         20,
+		RetryWaitMin:     time.Millisecond,
+		RetryWaitMax:     time.Millisecond,
+		CheckRetry:       retryablehttp.RetryOnStatusCodes(http.StatusServiceUnavailable),
+		RetryBudget:      0.1,
+	})
+	client.ErrorHandler = retryablehttp.PassthroughErrorHandler
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+	for _, family := range families {
+		if family.GetName() == "scanner_http_retries_budget_denied_total" {
+			require.Empty(t, family.GetMetric()[0].GetLabel())
+			require.Equal(t, float64(1), family.GetMetric()[0].GetCounter().GetValue())
+			return
+		}
+	}
+	t.Fatal("no retry budget denied series")
+}
+
+func TestHostCollector(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	registry := prometheus.NewRegistry()
+	collector, err := NewHostCollector("scanner", registry)
+	require.Nil(t, err)
+
+	client := retryablehttp.NewClient(retryablehttp.Options{MetricsCollector: collector})
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+	hosts := map[string]string{}
+	for _, family := range families {
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			if label.GetName() == "host" {
+				hosts[family.GetName()] = label.GetValue()
+			}
+		}
+	}
+	host := ts.Listener.Addr().String()
+	require.Equal(t, map[string]string{
+		"scanner_http_requests_total":           host,
+		"scanner_http_request_duration_seconds": host,
+		"scanner_http_request_attempts":         host,
+	}, hosts)
+}
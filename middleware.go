@@ -0,0 +1,79 @@
+package retryablehttp
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// ClientRequestMiddleware is run by Client.Do before the request is sent.
+// Returning an error aborts the request.
+type ClientRequestMiddleware func(client *Client, req *Request) error
+
+// ClientResponseMiddleware is run by Client.Do on the response returned to the caller,
+// responses of retried attempts are not passed to it. Returning an error closes
+// the response and returns the error instead.
+type ClientResponseMiddleware func(client *Client, req *Request, resp *http.Response) error
+
+// runOnBeforeRequest runs the OnBeforeRequest middlewares in order
+func (c *Client) runOnBeforeRequest(req *Request) error {
+	for _, middleware := range c.OnBeforeRequest {
+		if err := middleware(c, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runOnAfterResponse runs the OnAfterResponse middlewares in order
+func (c *Client) runOnAfterResponse(req *Request, resp *http.Response) error {
+	for _, middleware := range c.OnAfterResponse {
+		if err := middleware(c, req, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MiddlewareOnBeforeRequestUserAgent sets the User-Agent header of requests not setting one.
+// Requests are assigned the user agents round-robin in the order they are sent by the client,
+// a request sent again is assigned the next one.
+func MiddlewareOnBeforeRequestUserAgent(userAgents ...string) ClientRequestMiddleware {
+	return func(client *Client, req *Request) error {
+		if userAgent := req.Header.Get("User-Agent"); len(userAgents) == 0 || (userAgent != "" && userAgent != req.userAgent) {
+			return nil
+		}
+		req.userAgent = userAgents[req.seq%uint32(len(userAgents))]
+		req.Header.Set("User-Agent", req.userAgent)
+		return nil
+	}
+}
+
+// hopByHopHeaders are the headers meaningful only for a single connection (RFC 7230 6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// MiddlewareOnBeforeRequestStripHopByHopHeaders removes the hop-by-hop headers of requests,
+// including the headers listed in their Connection header, see Options.StripHopByHopHeaders
+func MiddlewareOnBeforeRequestStripHopByHopHeaders() ClientRequestMiddleware {
+	return func(client *Client, req *Request) error {
+		for _, value := range req.Header.Values("Connection") {
+			for _, name := range strings.Split(value, ",") {
+				if name = textproto.TrimString(name); name != "" {
+					req.Header.Del(name)
+				}
+			}
+		}
+		for _, name := range hopByHopHeaders {
+			req.Header.Del(name)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package retryablehttp
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceContextPropagator injects and extracts w3c traceparent and tracestate headers
+var traceContextPropagator = propagation.TraceContext{}
+
+// startRequestSpan starts the span of the logical request spanning all attempts. A traceparent
+// set by the caller is used as parent when the request context carries no span.
+// It returns whether the caller set the traceparent, in which case it's not overwritten.
+func (c *Client) startRequestSpan(ctx context.Context, req *Request) (context.Context, trace.Span, bool) {
+	userTraceparent := req.Header.Get("traceparent") != ""
+	if userTraceparent && !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = traceContextPropagator.Extract(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	ctx, span := c.options.Tracer.Start(ctx, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.Request.URL.String()),
+			attribute.String("server.address", req.Request.URL.Hostname()),
+		),
+	)
+	return ctx, span, userTraceparent
+}
+
+// endRequestSpan records the outcome of the logical request and ends its span
+func endRequestSpan(span trace.Span, req *Request, resp *http.Response, err error) {
+	span.SetAttributes(attribute.Int("http.request.retries", req.Metrics.Retries))
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startAttemptSpan starts the child span of an attempt, sets it on the request context
+// and injects it as traceparent unless the caller set one
+func (c *Client) startAttemptSpan(ctx context.Context, req *Request, attemptNum int, userTraceparent bool) (context.Context, trace.Span) {
+	ctx, span := c.options.Tracer.Start(ctx, "HTTP "+req.Method+" attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("http.request.resend_count", attemptNum)),
+	)
+	if !userTraceparent {
+		traceContextPropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	req.Request = req.Request.WithContext(ctx)
+	return ctx, span
+}
+
+// endAttemptSpan records the outcome of the attempt and ends its span,
+// retry tells whether the attempt is going to be retried
+func endAttemptSpan(span trace.Span, resp *http.Response, err error, retry bool) {
+	if resp != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	if retry {
+		span.SetAttributes(attribute.String("retry.reason", retryReason(resp, err)))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,38 @@
+package retryablehttp
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizePath canonicalizes the path of the url sent for the request when NormalizePath is
+// enabled. The path is percent-decoded, rejecting malformed escapes, its dot segments are
+// resolved and it's then re-encoded by net/url. Encoded slashes (%2f) become path separators.
+// The url of the request itself is not modified.
+func (c *Client) normalizePath(req *Request) error {
+	u := *req.Request.URL
+	// unsafe urls keep the raw path as given in Path
+	rawPath := u.EscapedPath()
+	if req.URL != nil && req.URL.Unsafe && u.RawPath == "" {
+		rawPath = u.Path
+	}
+	decoded, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return fmt.Errorf("invalid path encoding: %w", err)
+	}
+	if decoded != "" {
+		cleaned := path.Clean(decoded)
+		if strings.HasSuffix(decoded, "/") && !strings.HasSuffix(cleaned, "/") {
+			cleaned += "/"
+		}
+		decoded = cleaned
+	}
+	u.Path = decoded
+	u.RawPath = ""
+
+	req.Request = req.Request.WithContext(req.Context())
+	req.Request.URL = &u
+	return nil
+}
@@ -0,0 +1,230 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRawUnsupported is returned by DoRaw for requests it can't record as sent, those
+// with a custom Transport or sent by a client using http/3
+var ErrRawUnsupported = errors.New("raw: requests sent over a custom transport or http/3 can't be recorded")
+
+// DoRaw sends the request like Do, retries included, and returns the response of the
+// final attempt exactly as it was read from the wire (status line, headers and body).
+//
+// The request is sent over a dedicated connection which is closed afterwards, hence
+// it does not benefit from connection reuse. Responses served by the internal
+// http/2 fallback client are not captured. Requests with a custom Transport and
+// clients using http/3 return ErrRawUnsupported.
+func (c *Client) DoRaw(req *Request) ([]byte, error) {
+	if req.Transport != nil || c.HTTPClient3 != nil {
+		return nil, ErrRawUnsupported
+	}
+	recorder := newRawRecorder(c.HTTPClient)
+	req.httpClient = recorder.client
+	defer func() {
+		req.httpClient = nil
+	}()
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return recorder.bytes(), err
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return recorder.bytes(), err
+}
+
+// DoRawBytes writes exactly the given bytes to a connection to addr and reads the response,
+// bypassing the validation and normalization of net/http, ex. to send requests with
+// conflicting Content-Length and Transfer-Encoding headers. The address is either host:port,
+// or a http:// or https:// url for connections over tls. The request is not retried and the
+// response is read as the response to a GET request, closing its body closes the connection.
+// Stalled servers are bounded by Timeout and RawIOTimeout.
+func (c *Client) DoRawBytes(addr string, raw []byte) (*http.Response, error) {
+	addr, useTLS, err := parseRawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	dial, dialTLS := c.transportDialers()
+	var conn net.Conn
+	if useTLS {
+		conn, err = dialTLS(ctx, "tcp", addr)
+	} else {
+		conn, err = dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the deadline covers reading the body as well
+	deadline, _ := ctx.Deadline()
+	if !deadline.IsZero() {
+		_ = conn.SetDeadline(deadline)
+	}
+	if c.options.RawIOTimeout > 0 {
+		conn = &ioTimeoutConn{Conn: conn, timeout: c.options.RawIOTimeout, deadline: deadline}
+	}
+
+	if _, err := conn.Write(raw); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: func() { conn.Close() }}
+	return resp, nil
+}
+
+// parseRawAddr returns the host:port of the address of a raw connection and whether it's
+// over tls, which http:// and https:// urls specify
+func parseRawAddr(addr string) (hostPort string, useTLS bool, err error) {
+	if !strings.Contains(addr, "://") {
+		return addr, false, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", false, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", false, &UnsupportedSchemeError{Scheme: u.Scheme, Err: fmt.Errorf("raw: unsupported scheme %q", u.Scheme)}
+	}
+	return hostPortKey(u), u.Scheme == "https", nil
+}
+
+// ioTimeoutConn limits each read and write of the connection to timeout, within the
+// overall deadline if not zero
+type ioTimeoutConn struct {
+	net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (c *ioTimeoutConn) Read(p []byte) (int, error) {
+	_ = c.Conn.SetReadDeadline(c.nextDeadline())
+	return c.Conn.Read(p)
+}
+
+func (c *ioTimeoutConn) Write(p []byte) (int, error) {
+	_ = c.Conn.SetWriteDeadline(c.nextDeadline())
+	return c.Conn.Write(p)
+}
+
+func (c *ioTimeoutConn) nextDeadline() time.Time {
+	next := time.Now().Add(c.timeout)
+	if !c.deadline.IsZero() && c.deadline.Before(next) {
+		return c.deadline
+	}
+	return next
+}
+
+// rawRecorder records the bytes read from the last connection dialed by its client
+type rawRecorder struct {
+	client *http.Client
+
+	mu   sync.Mutex
+	last *bytes.Buffer
+}
+
+// newRawRecorder returns a recorder whose client mimics the given one without keep-alives
+func newRawRecorder(base *http.Client) *rawRecorder {
+	recorder := &rawRecorder{}
+
+	var transport *http.Transport
+	if t, ok := base.Transport.(*http.Transport); ok {
+		transport = t.Clone()
+	} else {
+		transport = DefaultHostSprayingTransport()
+	}
+	transport.DisableKeepAlives = true
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = dialContext
+	}
+	dialTLS := transport.DialTLSContext
+	if dialTLS == nil {
+		tlsConfig := transport.TLSClientConfig
+		if tlsConfig == nil {
+			tlsConfig = defaultTLSConfig()
+		}
+		dialTLS = GetZtlsFallbackDialTLSContext(tlsConfig)
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return recorder.record(conn), nil
+	}
+	transport.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialTLS(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return recorder.record(conn), nil
+	}
+
+	recorder.client = &http.Client{
+		Transport:     transport,
+		CheckRedirect: base.CheckRedirect,
+		Jar:           base.Jar,
+		Timeout:       base.Timeout,
+	}
+	return recorder
+}
+
+// record wraps the connection and makes it the one being recorded
+func (r *rawRecorder) record(conn net.Conn) net.Conn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = &bytes.Buffer{}
+	return &recordingConn{Conn: conn, recorder: r, buf: r.last}
+}
+
+// bytes returns a copy of the bytes read from the last dialed connection
+func (r *rawRecorder) bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return nil
+	}
+	return bytes.Clone(r.last.Bytes())
+}
+
+// recordingConn copies all the bytes read from the connection into buf
+type recordingConn struct {
+	net.Conn
+	recorder *rawRecorder
+	buf      *bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.recorder.mu.Lock()
+		c.buf.Write(p[:n])
+		c.recorder.mu.Unlock()
+	}
+	return n, err
+}
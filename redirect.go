@@ -0,0 +1,103 @@
+package retryablehttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	readerutil "github.com/projectdiscovery/utils/reader"
+)
+
+// maxRedirects is the number of redirects followed by default as in net/http
+const maxRedirects = 10
+
+// setGetBody lets net/http replay reusable bodies on 307 and 308 redirects to any host,
+// such redirects are otherwise returned to the caller instead of being followed
+func (r *Request) setGetBody() {
+	body, ok := r.Request.Body.(*readerutil.ReusableReadCloser)
+	if !ok || r.streamBody != nil {
+		return
+	}
+	r.Request.GetBody = func() (io.ReadCloser, error) {
+		// reading to the end rewinds the body, even if it was partially sent
+		_, _ = io.Copy(io.Discard, body)
+		return body, nil
+	}
+}
+
+// redirectPolicy wraps the CheckRedirect of the internal clients dropping the Authorization
+// header on redirects to another origin than the initial request, unless ForwardAuthOnRedirect
+// is set in which case it's forwarded to any origin
+func (c *Client) redirectPolicy(next func(req *http.Request, via []*http.Request) error) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if next != nil {
+			if err := next(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		if counter := redirectBytesFrom(req); counter != nil {
+			if read := counter.read.Load(); read > counter.limit {
+				return fmt.Errorf("%w: %d bytes read across %d redirects", ErrResponseTooLarge, read, len(via))
+			}
+			// net/http reads some of the body of the redirect to reuse the connection
+			if req.Response != nil && req.Response.Body != nil {
+				req.Response.Body = &redirectBytesBody{ReadCloser: req.Response.Body, counter: counter}
+			}
+		}
+
+		initial := via[0]
+		if c.options.ForwardAuthOnRedirect {
+			if auth := initial.Header.Get("Authorization"); auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+		} else if req.URL.Scheme != initial.URL.Scheme || hostPortKey(req.URL) != hostPortKey(initial.URL) {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+}
+
+// redirectBytesKey is the context key of the redirectBytes of an attempt
+type redirectBytesKey struct{}
+
+// redirectBytes counts the bytes of the response bodies read across the redirects of an attempt
+type redirectBytes struct {
+	limit int64
+	read  atomic.Int64
+}
+
+// wrapContextWithRedirectBytes makes the redirects of the attempt count the bytes read
+// from their responses
+func wrapContextWithRedirectBytes(req *Request, limit int64) {
+	counter := &redirectBytes{limit: limit}
+	req.Request = req.Request.WithContext(context.WithValue(req.Context(), redirectBytesKey{}, counter))
+}
+
+// redirectBytesFrom returns the redirectBytes of the attempt of the request, nil if none
+func redirectBytesFrom(req *http.Request) *redirectBytes {
+	if req == nil {
+		return nil
+	}
+	counter, _ := req.Context().Value(redirectBytesKey{}).(*redirectBytes)
+	return counter
+}
+
+// redirectBytesBody adds the bytes read from the body to counter, failing the reads
+// beyond its limit
+type redirectBytesBody struct {
+	io.ReadCloser
+	counter *redirectBytes
+}
+
+func (b *redirectBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if read := b.counter.read.Add(int64(n)); read > b.counter.limit {
+		return n, fmt.Errorf("%w: %d bytes read across the redirects", ErrResponseTooLarge, read)
+	}
+	return n, err
+}
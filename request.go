@@ -3,12 +3,18 @@ package retryablehttp
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
+	"io"
+	"mime/multipart"
 	"net/http"
-	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	readerutil "github.com/projectdiscovery/utils/reader"
 	urlutil "github.com/projectdiscovery/utils/url"
@@ -19,7 +25,7 @@ var PreferHTTP bool
 
 // Request wraps the metadata needed to create HTTP requests.
 // Request is not threadsafe. A request cannot be used by multiple goroutines
-// concurrently.
+// concurrently, except as the template of Client.DoClone which sends clones of it.
 type Request struct {
 	// Embed an HTTP request directly. This makes a *Request act exactly
 	// like an *http.Request so that all meta methods are supported.
@@ -34,6 +40,45 @@ type Request struct {
 	Auth *Auth
 
 	TraceInfo *TraceInfo
+
+	// TLSBackend is the tls stack which served the connection of the last attempt,
+	// TLSBackendCryptoTLS or TLSBackendZTLS, empty for plain http or http/3. It's set
+	// when CollectTLSBackend is enabled.
+	TLSBackend string
+
+	// ResolvedAddrs are the addresses the host of the last attempt resolved to,
+	// set when CollectResolvedIPs is enabled
+	ResolvedAddrs []string
+
+	// Exchange is the exchange captured by the last Do when CaptureExchange is enabled
+	Exchange *Exchange
+
+	// Transport, if set, sends the attempts of the request instead of the client
+	// transports, retries, backoff and middlewares still apply. None of the transport
+	// settings of the client options (tls, dialer, http/2 and http/3) apply to it.
+	Transport http.RoundTripper
+
+	// streamBody is set for requests created with NewStreamingRequest
+	// whose body cannot be rewound
+	streamBody *streamingBody
+
+	// httpClient overrides the client http.Client for this request
+	httpClient *http.Client
+	// hostHeader is the Host header set with SetHostHeader
+	hostHeader string
+	// collectTrace enables collecting the timing of the attempts in Metrics.Trace
+	collectTrace bool
+	// printTrace prints the collected timing to stderr once the request is sent
+	printTrace bool
+	// attemptResponses collects the responses of the attempts when sent with DoAll
+	attemptResponses *[]*http.Response
+	// seq is the sequence number of the request in the sending client
+	seq uint32
+	// userAgent is the User-Agent header set by MiddlewareOnBeforeRequestUserAgent,
+	// which is replaced each time the request is sent
+	userAgent string
+	// cloneMu serializes the clones of DoClone and WithURL, which read the body of the request
+	cloneMu sync.Mutex
 }
 
 // Metrics contains the metrics about each request
@@ -42,8 +87,28 @@ type Metrics struct {
 	Failures int
 	// Retries is the number of retries for the request
 	Retries int
+	// InterimResponses are the informational (1xx) responses received before the final
+	// response of the final attempt, collected when enabled with Options.CollectInterimResponses
+	InterimResponses []InterimResponse
+	// RetryReasons are the reasons of the retries, one per retry
+	// (e.g. "status 503", "connection reset", "unexpected EOF")
+	RetryReasons []string
 	// DrainErrors is number of errors occured in draining response body
 	DrainErrors int
+	// DrainedBytes is the number of bytes of response bodies discarded, ex. by retries
+	DrainedBytes int64
+	// RequestBodyBytes is the size of the request body, 0 if unknown
+	RequestBodyBytes int64
+	// ResponseBodyBytes is the number of bytes read so far from the returned response body.
+	// It's updated atomically as the body is read, use atomic.LoadInt64 while it's being read.
+	ResponseBodyBytes int64
+	// Protocol is the protocol of the response of the final attempt (e.g. "HTTP/1.1", "HTTP/2.0")
+	Protocol string
+	// Trace is the timing of the final attempt, collected when enabled with
+	// Request.EnableTrace or Options.CollectTrace
+	Trace *Trace
+	// FromCache is set when the response is served from Options.Cache, fresh or revalidated
+	FromCache bool
 }
 
 // Auth specific information
@@ -51,12 +116,18 @@ type Auth struct {
 	Type     AuthType
 	Username string
 	Password string
+	// Token is the token of BearerAuth
+	Token string
 }
 
 type AuthType uint8
 
 const (
 	DigestAuth AuthType = iota
+	// BasicAuth sends the username and password in the Authorization header
+	BasicAuth
+	// BearerAuth sends the token in the Authorization header
+	BearerAuth
 )
 
 // RequestLogHook allows a function to run before each retry. The HTTP
@@ -72,6 +143,11 @@ type RequestLogHook func(*http.Request, int)
 // from this method, this will affect the response returned from Do().
 type ResponseLogHook func(*http.Response)
 
+// RetryHook is called right before the client sleeps for the backoff of a retry
+// with the retry number (1 for the first retry), the wait duration and the error
+// that triggered the retry, nil if it was triggered by the response.
+type RetryHook func(req *http.Request, attempt int, wait time.Duration, lastErr error)
+
 // ErrorHandler is called if retries are expired, containing the last status
 // from the http library. If not specified, default behavior for the library is
 // to close the body and return an error indicating how many tries were
@@ -87,7 +163,8 @@ func (r *Request) WithContext(ctx context.Context) *Request {
 
 // BodyBytes allows accessing the request body. It is an analogue to
 // http.Request's Body variable, but it returns a copy of the underlying data
-// rather than consuming it.
+// rather than consuming it. The whole body is returned after Client.Do too, even
+// if it was only partially sent.
 //
 // This function is not thread-safe; do not call it at the same time as another
 // call, or at the same time this request is being used with Client.Do.
@@ -95,6 +172,12 @@ func (r *Request) BodyBytes() ([]byte, error) {
 	if r.Request.Body == nil {
 		return nil, nil
 	}
+	// reading to the end rewinds the reusable body
+	if body, ok := r.Body.(*readerutil.ReusableReadCloser); ok && r.streamBody == nil {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, err
+		}
+	}
 	buf := new(bytes.Buffer)
 	_, err := buf.ReadFrom(r.Body)
 	if err != nil {
@@ -103,17 +186,162 @@ func (r *Request) BodyBytes() ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// SetBody replaces the request body and updates the content length accordingly.
+// It accepts the same body types as NewRequest.
+func (r *Request) SetBody(body interface{}) error {
+	bodyReader, contentLength, err := getReusableBodyandContentLength(body)
+	if err != nil {
+		return err
+	}
+	r.streamBody = nil
+	if bodyReader == nil {
+		r.Request.Body = nil
+		r.Request.ContentLength = 0
+		r.Request.Header.Del("Content-Length")
+		return nil
+	}
+	r.Request.Body = bodyReader
+	r.Request.ContentLength = contentLength
+	r.Request.Header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	return nil
+}
+
+// AddCookie adds a cookie to the request, see http.Request.AddCookie.
+// Cookies of the client jar are added on send and don't need to be set.
+func (r *Request) AddCookie(c *http.Cookie) {
+	r.Request.AddCookie(c)
+}
+
+// SetCookies replaces the cookies of the request with the given ones
+func (r *Request) SetCookies(cookies []*http.Cookie) {
+	r.Request.Header.Del("Cookie")
+	for _, c := range cookies {
+		r.Request.AddCookie(c)
+	}
+}
+
+// Cookies returns the cookies set on the request
+func (r *Request) Cookies() []*http.Cookie {
+	return r.Request.Cookies()
+}
+
+// setCookieHeader restores the Cookie header values of the request
+func (r *Request) setCookieHeader(values []string) {
+	if len(values) == 0 {
+		r.Request.Header.Del("Cookie")
+		return
+	}
+	r.Request.Header["Cookie"] = append([]string(nil), values...)
+}
+
 // Update request URL with new changes of parameters if any
 func (r *Request) Update() {
 	r.URL.Update()
 	updateScheme(r.URL.URL)
 }
 
-// SetURL updates request url (i.e http.Request.URL) with given url
+// SetQueryParam sets the query parameter key to value, replacing its existing values.
+// Values are sent as given without decoding them, so already encoded payloads
+// (ex. %0d%0a) are kept as is.
+func (r *Request) SetQueryParam(key, value string) {
+	r.queryParams().Set(key, value)
+	r.Update()
+}
+
+// AddQueryParam adds value to the values of the query parameter key, without
+// decoding it like SetQueryParam
+func (r *Request) AddQueryParam(key, value string) {
+	r.queryParams().Add(key, value)
+	r.Update()
+}
+
+// DeleteQueryParam removes the query parameter key
+func (r *Request) DeleteQueryParam(key string) {
+	r.queryParams().Del(key)
+	r.Update()
+}
+
+// queryParams returns the query parameters of the request url
+func (r *Request) queryParams() *urlutil.OrderedParams {
+	if r.URL.Params == nil {
+		r.URL.Params = urlutil.NewOrderedParams()
+	}
+	return r.URL.Params
+}
+
+// URLScheme returns the scheme of the request url, the one Update defaults to
+// if it's missing
+func (r *Request) URLScheme() string {
+	if r.URL.Scheme == "" && r.URL.Host != "" {
+		if PreferHTTP {
+			return "http"
+		}
+		return "https"
+	}
+	return r.URL.Scheme
+}
+
+// DefaultPort returns the port of the request url, or the default port of its scheme
+func (r *Request) DefaultPort() string {
+	if port := r.URL.Port(); port != "" {
+		return port
+	}
+	switch r.URLScheme() {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
+
+// IsTLS reports whether the request url uses a tls scheme (https or wss)
+func (r *Request) IsTLS() bool {
+	scheme := r.URLScheme()
+	return scheme == "https" || scheme == "wss"
+}
+
+// IsWebSocket reports whether the request url uses a websocket scheme (ws or wss)
+func (r *Request) IsWebSocket() bool {
+	scheme := r.URLScheme()
+	return scheme == "ws" || scheme == "wss"
+}
+
+// SetURL updates request url (i.e http.Request.URL) with given url.
+// The Host header follows the url unless set with SetHostHeader.
 func (r *Request) SetURL(u *urlutil.URL) {
 	r.URL = u
 	r.Request.URL = u.URL
 	r.Update()
+	r.Request.Host = u.Host
+	if r.hostHeader != "" {
+		r.Request.Host = r.hostHeader
+	}
+}
+
+// WithURL returns a clone of the request sent to the given url instead, with the method, headers
+// and an independent copy of the body of the request, ex. to send the same template request to a
+// list of targets. The Host header follows the new url unless set with SetHostHeader.
+// Streaming requests can't be cloned.
+func (r *Request) WithURL(url string) (*Request, error) {
+	u, err := parseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	clone, err := r.cloneWithBody(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	clone.SetURL(u)
+	return clone, nil
+}
+
+// SetHostHeader sets the Host header sent instead of the host of the url, which is still
+// dialed (e.g. to send Host: example.com to 127.0.0.1). It's kept on Update, Clone and
+// SetURL and restored on each attempt. An empty host restores the host of the url.
+func (r *Request) SetHostHeader(host string) {
+	r.hostHeader = host
+	r.Request.Host = host
 }
 
 // Clones and returns new Request
@@ -129,14 +357,46 @@ func (r *Request) Clone(ctx context.Context) *Request {
 			Type:     r.Auth.Type,
 			Username: r.Auth.Username,
 			Password: r.Auth.Password,
+			Token:    r.Auth.Token,
 		}
 	}
 	return &Request{
-		Request: req,
-		URL:     ux,
-		Metrics: Metrics{}, // Metrics shouldn't be cloned
-		Auth:    auth,
+		Request:      req,
+		URL:          ux,
+		Metrics:      Metrics{}, // Metrics shouldn't be cloned
+		Auth:         auth,
+		streamBody:   r.streamBody,
+		Transport:    r.Transport,
+		hostHeader:   r.hostHeader,
+		collectTrace: r.collectTrace,
+		printTrace:   r.printTrace,
+		userAgent:    r.userAgent,
+	}
+}
+
+// cloneWithBody clones the request along with a copy of its body, unlike Clone which
+// shares the body. It's safe for concurrent use with itself but not with other methods.
+func (r *Request) cloneWithBody(ctx context.Context) (*Request, error) {
+	r.cloneMu.Lock()
+	defer r.cloneMu.Unlock()
+	if r.streamBody != nil {
+		return nil, errors.New("retryablehttp: streaming requests can't be cloned")
+	}
+	clone := r.Clone(ctx)
+	if r.Request.Body == nil || r.Request.Body == http.NoBody {
+		return clone, nil
+	}
+	data, err := r.BodyBytes()
+	if err != nil {
+		return nil, err
+	}
+	body, err := readerutil.NewReusableReadCloser(data)
+	if err != nil {
+		return nil, err
 	}
+	clone.Request.Body = body
+	clone.Request.GetBody = nil
+	return clone, nil
 }
 
 // Dump returns request dump in bytes
@@ -144,9 +404,14 @@ func (r *Request) Dump() ([]byte, error) {
 	resplen := int64(0)
 	dumpbody := true
 	clone := r.Clone(context.TODO())
-	if clone.Body != nil {
+	// streaming bodies can't be dumped without consuming them
+	if clone.Body != nil && clone.streamBody == nil {
 		resplen, _ = getLength(clone.Body)
 	}
+	if resplen > 0 && clone.hasTrailer() {
+		// trailers are rendered after the chunked body
+		resplen = -1
+	}
 	if resplen == 0 {
 		dumpbody = false
 		clone.ContentLength = 0
@@ -176,7 +441,7 @@ func FromRequest(r *http.Request) (*Request, error) {
 	}
 
 	if r.URL != nil {
-		urlx, err := urlutil.Parse(r.URL.String())
+		urlx, err := parseURL(r.URL.String())
 		if err != nil {
 			return nil, err
 		}
@@ -198,32 +463,21 @@ func FromRequest(r *http.Request) (*Request, error) {
 	return &req, nil
 }
 
-// FromRequestWithTrace wraps an http.Request in a retryablehttp.Request with trace enabled
+// FromRequestWithTrace wraps an http.Request in a retryablehttp.Request with trace enabled,
+// the timing of the request (see Metrics.Trace) is printed to stderr once sent with Client.Do
 func FromRequestWithTrace(r *http.Request) (*Request, error) {
-	trace := &httptrace.ClientTrace{
-		GotConn: func(connInfo httptrace.GotConnInfo) {
-			fmt.Fprintf(os.Stderr, "Got connection\tReused: %v\tWas Idle: %v\tIdle Time: %v\n", connInfo.Reused, connInfo.WasIdle, connInfo.IdleTime)
-		},
-		ConnectStart: func(network, addr string) {
-			fmt.Fprintf(os.Stderr, "Dial start\tnetwork: %s\taddress: %s\n", network, addr)
-		},
-		ConnectDone: func(network, addr string, err error) {
-			fmt.Fprintf(os.Stderr, "Dial done\tnetwork: %s\taddress: %s\terr: %v\n", network, addr, err)
-		},
-		GotFirstResponseByte: func() {
-			fmt.Fprintf(os.Stderr, "Got response's first byte\n")
-		},
-		WroteHeaders: func() {
-			fmt.Fprintf(os.Stderr, "Wrote request headers\n")
-		},
-		WroteRequest: func(wr httptrace.WroteRequestInfo) {
-			fmt.Fprintf(os.Stderr, "Wrote request, err: %v\n", wr.Err)
-		},
-	}
-
-	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
-
-	return FromRequest(r)
+	req, err := FromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	req.EnableTrace()
+	req.printTrace = true
+	return req, nil
+}
+
+// EnableTrace collects the timing of the final attempt of the request in Metrics.Trace
+func (r *Request) EnableTrace() {
+	r.collectTrace = true
 }
 
 // NewRequest creates a new wrapped request.
@@ -243,7 +497,8 @@ func NewRequestFromURLWithContext(ctx context.Context, method string, urlx *urlu
 	// patches done by urlutil.URL in unsafe mode (ex: https://scanme.sh/%invalid)
 	// Note: this does not have any impact on actual path when sending request
 	// `http.NewRequestxxx` internally only uses `u.Host` and all other data is stored in `url.URL` instance
-	httpReq, err := http.NewRequestWithContext(ctx, method, "https://"+urlx.Host, nil)
+	// the host is escaped for the zone of ipv6 literals (e.g. [fe80::1%25eth0]) to be parsed back
+	httpReq, err := http.NewRequestWithContext(ctx, method, (&url.URL{Scheme: "https", Host: urlx.Host}).String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -268,22 +523,164 @@ func NewRequestFromURLWithContext(ctx context.Context, method string, urlx *urlu
 
 // NewRequest creates a new wrapped request
 func NewRequest(method, url string, body interface{}) (*Request, error) {
-	urlx, err := urlutil.Parse(url)
+	urlx, err := parseURL(url)
 	if err != nil {
 		return nil, err
 	}
 	return NewRequestFromURL(method, urlx, body)
 }
 
-// NewRequest creates a new wrapped request with given context
+// parseURL parses the url with urlutil, accepting the zone of ipv6 literals both escaped
+// as in RFC 6874 ([fe80::1%25eth0]) and unescaped as by curl and browsers ([fe80::1%eth0])
+func parseURL(rawURL string) (*urlutil.URL, error) {
+	return urlutil.Parse(escapeIPv6Zone(rawURL))
+}
+
+// escapeIPv6Zone escapes the unescaped zone separator of the ipv6 literal host of the url
+func escapeIPv6Zone(rawURL string) string {
+	hostStart := 0
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		hostStart = i + len("://")
+	}
+	host := rawURL[hostStart:]
+	if end := strings.IndexAny(host, "/?#"); end >= 0 {
+		host = host[:end]
+	}
+	open, end := strings.Index(host, "["), strings.Index(host, "]")
+	if open < 0 || end < open {
+		return rawURL
+	}
+	zone := strings.Index(host[open:end], "%")
+	if zone < 0 || strings.HasPrefix(host[open+zone:], "%25") {
+		return rawURL
+	}
+	zone += hostStart + open
+	return rawURL[:zone] + "%25" + rawURL[zone+1:]
+}
+
+// NewStreamingRequest creates a new wrapped request whose body is streamed
+// to the server as-is without being buffered in memory.
+//
+// The body is sent with chunked transfer encoding (ContentLength is -1) and
+// cannot be rewound, so the request is only retried if the previous attempt
+// failed before any byte of the body was read. Once the body started flowing
+// the error of that attempt is returned to the caller.
+func NewStreamingRequest(method, url string, body io.Reader) (*Request, error) {
+	return NewStreamingRequestWithContext(context.Background(), method, url, body)
+}
+
+// NewStreamingRequestWithContext creates a new wrapped streaming request with given context
+func NewStreamingRequestWithContext(ctx context.Context, method, url string, body io.Reader) (*Request, error) {
+	request, err := NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		stream := &streamingBody{reader: body}
+		request.streamBody = stream
+		request.Request.Body = stream
+		request.Request.ContentLength = -1
+	}
+	return request, nil
+}
+
+// hasTrailer reports whether the request has a body followed by trailers,
+// which are only sent with chunked transfer encoding
+func (r *Request) hasTrailer() bool {
+	return len(r.Request.Trailer) > 0 && r.Request.Body != nil && r.Request.Body != http.NoBody
+}
+
+// canRetryBody returns false when the request body was already (partially)
+// sent and cannot be replayed
+func (r *Request) canRetryBody() bool {
+	return r.streamBody == nil || !r.streamBody.consumed.Load()
+}
+
+// NewRequestWithContext creates a new wrapped request with given context, which bounds
+// the whole Do including the backoff waits between the retries
 func NewRequestWithContext(ctx context.Context, method, url string, body interface{}) (*Request, error) {
-	urlx, err := urlutil.Parse(url)
+	urlx, err := parseURL(url)
 	if err != nil {
 		return nil, err
 	}
 	return NewRequestFromURLWithContext(ctx, method, urlx, body)
 }
 
+// NewMultipartRequest creates a new wrapped request with a multipart/form-data body made of the
+// given fields and files, keyed by form field name. Files implementing Name() (e.g. *os.File)
+// are sent with their base name as file name, others with the field name.
+// The body is buffered so that it can be replayed on retries and redirects.
+func NewMultipartRequest(method, url string, fields map[string]string, files map[string]io.Reader) (*Request, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, name := range sortedKeys(fields) {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range sortedKeys(files) {
+		fileName := name
+		if named, ok := files[name].(interface{ Name() string }); ok {
+			fileName = filepath.Base(named.Name())
+		}
+		part, err := writer.CreateFormFile(name, fileName)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := NewRequest(method, url, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
+// NewCompressedRequest creates a new wrapped request whose body, of the types accepted by
+// NewRequest, is compressed with the content coding (gzip, deflate or zstd) set in the
+// Content-Encoding header. The compressed body is sent again as is by retries.
+func NewCompressedRequest(method, url string, body interface{}, encoding string) (*Request, error) {
+	var data []byte
+	bodyReader, _, err := getReusableBodyandContentLength(body)
+	if err != nil {
+		return nil, err
+	}
+	if bodyReader != nil {
+		if data, err = io.ReadAll(bodyReader); err != nil {
+			return nil, err
+		}
+	}
+	compressed, err := compressBody(data, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := NewRequest(method, url, compressed)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("Content-Length", strconv.Itoa(len(compressed)))
+	return req, nil
+}
+
+// sortedKeys returns the keys of the map in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func updateScheme(u *url.URL) {
 	// when url without scheme is passed to url.URL it loosely parses and ususally actual host is either part of scheme or path
 	// But this is sometimes handled internally when creating request using http.NewRequest
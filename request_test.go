@@ -85,3 +85,176 @@ readline:
 	}
 	goto readline
 }
+
+func TestRequestURLHelpers(t *testing.T) {
+	testcases := []struct {
+		url       string
+		scheme    string
+		hostname  string
+		port      string
+		tls       bool
+		websocket bool
+	}{
+		{url: "https://scanme.sh/path", scheme: "https", hostname: "scanme.sh", port: "443", tls: true},
+		{url: "http://scanme.sh:8080", scheme: "http", hostname: "scanme.sh", port: "8080"},
+		{url: "scanme.sh/with/path", scheme: "https", hostname: "scanme.sh", port: "443", tls: true},
+		{url: "ws://127.0.0.1/socket", scheme: "ws", hostname: "127.0.0.1", port: "80", websocket: true},
+		{url: "wss://[::1]:8443/socket", scheme: "wss", hostname: "::1", port: "8443", tls: true, websocket: true},
+	}
+	for _, tc := range testcases {
+		req, err := retryablehttp.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("got %v with url %v", err, tc.url)
+		}
+		if req.URLScheme() != tc.scheme || req.Hostname() != tc.hostname || req.DefaultPort() != tc.port || req.IsTLS() != tc.tls || req.IsWebSocket() != tc.websocket {
+			t.Errorf("unexpected helpers for %v: %v %v %v %v %v", tc.url, req.URLScheme(), req.Hostname(), req.DefaultPort(), req.IsTLS(), req.IsWebSocket())
+		}
+	}
+
+	// helpers reflect updates of the url
+	req, err := retryablehttp.NewRequest("GET", "https://scanme.sh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Scheme = "ws"
+	req.URL.Host = "example.com:8080"
+	if req.URLScheme() != "ws" || req.Hostname() != "example.com" || req.DefaultPort() != "8080" || req.IsTLS() || !req.IsWebSocket() {
+		t.Errorf("helpers don't reflect the updated url %v", req.URL.String())
+	}
+	// a missing scheme is the one set by Update, the url is left as is
+	req.URL.Scheme = ""
+	if req.URLScheme() != "https" || !req.IsTLS() || req.DefaultPort() != "8080" {
+		t.Errorf("unexpected scheme %v without one", req.URLScheme())
+	}
+	if req.URL.Scheme != "" {
+		t.Errorf("the url scheme was updated to %v", req.URL.Scheme)
+	}
+}
+
+func TestRequestQueryParams(t *testing.T) {
+	req, err := retryablehttp.NewRequest("GET", "https://scanme.sh/path?a=1&b=%0d%0a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetQueryParam("a", "2")
+	req.AddQueryParam("c", "x")
+	req.AddQueryParam("c", "y z")
+	if got := req.URL.String(); got != "https://scanme.sh/path?a=2&b=%0d%0a&c=x&c=y+z" {
+		t.Errorf("unexpected url %v", got)
+	}
+
+	// encoded payloads are sent as given
+	for _, payload := range []string{"%0d%0a", "%2e%2e%2f", "%e5%98%8a%e5%98%8d"} {
+		req.SetQueryParam("p", payload)
+		bin, err := req.Dump()
+		if err != nil {
+			t.Fatalf("failed to dump request with payload %v got %v", payload, err)
+		}
+		if relPath := getPathFromRaw(bin); relPath != "/path?a=2&b=%0d%0a&c=x&c=y+z&p="+payload {
+			t.Errorf("expected `%v` in outgoing request but got-----\n%v\n------", payload, string(bin))
+		}
+	}
+
+	req.DeleteQueryParam("b")
+	req.DeleteQueryParam("c")
+	req.DeleteQueryParam("p")
+	if got := req.Request.URL.String(); got != "https://scanme.sh/path?a=2" {
+		t.Errorf("unexpected url %v", got)
+	}
+
+	// the url had no query
+	req, err = retryablehttp.NewRequest("GET", "https://scanme.sh/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetQueryParam("q", "%27")
+	if got := req.Request.URL.String(); got != "https://scanme.sh/path?q=%27" {
+		t.Errorf("unexpected url %v", got)
+	}
+}
+
+func TestRequestToCurl(t *testing.T) {
+	req, err := retryablehttp.NewRequest("POST", "https://scanme.sh/path?a=1&b=2", `{"name": "it's"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Quote", `"double" 'single'`)
+	curl, err := req.ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `curl -k -X 'POST' -H 'Content-Type: application/json' -H 'X-Quote: "double" '\''single'\''' --data-binary '{"name": "it'\''s"}' 'https://scanme.sh/path?a=1&b=2'`
+	if curl != expected {
+		t.Errorf("unexpected curl command:\n%v\nexpected:\n%v", curl, expected)
+	}
+	// the body can be rendered again
+	if again, _ := req.ToCurl(); again != curl {
+		t.Errorf("the body was consumed: %v", again)
+	}
+
+	// binary and multipart bodies are escaped
+	req, err = retryablehttp.NewRequest("PUT", "http://127.0.0.1:8080/upload", []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x00, '\''})
+	if err != nil {
+		t.Fatal(err)
+	}
+	curl, err = req.ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(curl, `--data-binary $'\x89PNG\r\n\x00\''`) || strings.Contains(curl, " -k ") {
+		t.Errorf("unexpected curl command for a binary body: %v", curl)
+	}
+
+	req, err = retryablehttp.NewMultipartRequest("POST", "http://127.0.0.1:8080/upload", map[string]string{"name": "value"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	curl, err = req.ToCurl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(curl, `-H 'Content-Type: multipart/form-data; boundary=`) || !strings.Contains(curl, `Content-Disposition: form-data; name="name"\r\n\r\nvalue\r\n`) {
+		t.Errorf("unexpected curl command for a multipart body: %v", curl)
+	}
+
+	// GET requests don't need the method
+	req, err = retryablehttp.NewRequest("GET", "https://scanme.sh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if curl, _ = req.ToCurl(); curl != `curl -k 'https://scanme.sh'` {
+		t.Errorf("unexpected curl command for a GET request: %v", curl)
+	}
+}
+
+func TestRequestIPv6Zone(t *testing.T) {
+	testcases := []struct {
+		url      string
+		host     string
+		hostname string
+		port     string
+	}{
+		{url: "http://[fe80::1%eth0]:8080/path?a=1", host: "[fe80::1%eth0]:8080", hostname: "fe80::1%eth0", port: "8080"},
+		{url: "http://[fe80::1%25eth0]:8080/path", host: "[fe80::1%eth0]:8080", hostname: "fe80::1%eth0", port: "8080"},
+		{url: "https://user:p%40ss@[fe80::1%eth0]/", host: "[fe80::1%eth0]", hostname: "fe80::1%eth0", port: "443"},
+		{url: "http://[::1]:8080/", host: "[::1]:8080", hostname: "::1", port: "8080"},
+		{url: "[2001:db8::1]/path", host: "[2001:db8::1]", hostname: "2001:db8::1", port: "443"},
+	}
+	for _, tc := range testcases {
+		req, err := retryablehttp.NewRequest("GET", tc.url, nil)
+		if err != nil {
+			t.Fatalf("got %v with url %v", err, tc.url)
+		}
+		req.Update()
+		clone := req.Clone(req.Context())
+		for _, host := range []string{req.URL.Host, req.Request.URL.Host, req.Request.Host, clone.Request.URL.Host, clone.Request.Host} {
+			if host != tc.host {
+				t.Errorf("unexpected host %v for %v, expected %v", host, tc.url, tc.host)
+			}
+		}
+		if req.Hostname() != tc.hostname || req.DefaultPort() != tc.port {
+			t.Errorf("unexpected hostname and port for %v: %v %v", tc.url, req.Hostname(), req.DefaultPort())
+		}
+	}
+}
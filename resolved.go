@@ -0,0 +1,39 @@
+package retryablehttp
+
+import (
+	"net"
+	"net/http/httptrace"
+	"sync"
+)
+
+// wrapContextWithResolvedAddrs installs the trace recording the addresses the request
+// host resolved to. Dialers resolving names on their own (e.g. fastdialer) and reused
+// connections don't report dns lookups, the remote address of the connection is used instead.
+func wrapContextWithResolvedAddrs(req *Request) {
+	req.ResolvedAddrs = nil
+
+	var mu sync.Mutex
+	var dnsAddrs []string
+	trace := &httptrace.ClientTrace{
+		// dns lookups may run on the transport dial goroutine
+		DNSDone: func(dnsInfo httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, addr := range dnsInfo.Addrs {
+				dnsAddrs = append(dnsAddrs, addr.IP.String())
+			}
+		},
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(dnsAddrs) > 0 {
+				req.ResolvedAddrs = append([]string(nil), dnsAddrs...)
+				return
+			}
+			if host, _, err := net.SplitHostPort(connInfo.Conn.RemoteAddr().String()); err == nil {
+				req.ResolvedAddrs = []string{host}
+			}
+		},
+	}
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
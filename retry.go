@@ -3,9 +3,14 @@ package retryablehttp
 import (
 	"context"
 	"crypto/x509"
+	"errors"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/projectdiscovery/utils/errkit"
 )
@@ -19,7 +24,12 @@ var (
 	// A regular expression to match the error returned by net/http when the
 	// scheme specified in the URL is invalid. This error isn't typed
 	// specifically so we resort to matching on the error string.
-	schemeErrorRegex = regexp.MustCompile(`unsupported protocol scheme`)
+	schemeErrorRegex = regexp.MustCompile(`unsupported protocol scheme(?: "([^"]*)")?`)
+
+	// A regular expression to match the error returned by net/http when the
+	// per attempt http.Client timeout expires. This error wraps
+	// context.DeadlineExceeded but unlike a caller deadline it's retryable.
+	clientTimeoutErrorRegex = regexp.MustCompile(`Client\.Timeout exceeded`)
 )
 
 // CheckRetry specifies a policy for handling retries. It is called
@@ -32,6 +42,11 @@ var (
 // response body before returning.
 type CheckRetry func(ctx context.Context, resp *http.Response, err error) (bool, error)
 
+// CheckRetryWithBody is like CheckRetry but also receives the first bytes of the
+// response body, so that retries can depend on its content (e.g. a waf block page).
+// The body of the response is left unconsumed, bodyPeek is nil without a response.
+type CheckRetryWithBody func(ctx context.Context, resp *http.Response, err error, bodyPeek []byte) (bool, error)
+
 // DefaultRetryPolicy provides a default callback for Client.CheckRetry, which
 // will retry on connection errors and server errors.
 func DefaultRetryPolicy() func(ctx context.Context, resp *http.Response, err error) (bool, error) {
@@ -56,6 +71,14 @@ func CheckRecoverableErrors(ctx context.Context, resp *http.Response, err error)
 	}
 
 	if err != nil {
+		// do not retry errors caused by a cancelled or expired context
+		if errors.Is(err, context.Canceled) {
+			return false, nil
+		}
+		if errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, errAttemptTimeout) && !clientTimeoutErrorRegex.MatchString(err.Error()) {
+			return false, nil
+		}
+
 		if v, ok := err.(*url.Error); ok {
 			// Don't retry if the error was due to too many redirects.
 			if redirectsErrorRegex.MatchString(v.Error()) {
@@ -67,6 +90,21 @@ func CheckRecoverableErrors(ctx context.Context, resp *http.Response, err error)
 				return false, nil
 			}
 
+			// Don't retry if the destination can't be reached from the local address.
+			if errors.Is(v.Err, ErrAddressFamilyMismatch) {
+				return false, nil
+			}
+
+			// Don't retry if the redirects exceeded the response bodies limit.
+			if errors.Is(v.Err, ErrResponseTooLarge) {
+				return false, nil
+			}
+
+			// Don't retry if the response headers exceeded the limit.
+			if headerTooLargeErrorRegex.MatchString(v.Error()) {
+				return false, nil
+			}
+
 			// Don't retry if the error was due to TLS cert verification failure.
 			if _, ok := v.Err.(x509.UnknownAuthorityError); ok {
 				return false, nil
@@ -82,3 +120,106 @@ func CheckRecoverableErrors(ctx context.Context, resp *http.Response, err error)
 	}
 	return false, nil
 }
+
+// withRetryableErrorCallback returns a CheckRetry where the callback decides if
+// errors are retryable, other than cancellation or expiry of the request context.
+// Responses without errors are handled by the given policy.
+func withRetryableErrorCallback(policy CheckRetry, callback func(error) bool) CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if err != nil && ctx.Err() == nil && !errors.Is(err, context.Canceled) {
+			return callback(err), nil
+		}
+		return policy(ctx, resp, err)
+	}
+}
+
+// netErrnos are the network errors named in Options.RetryableNetErrors recognized by their
+// errno, even if the message of the error doesn't contain the name
+var netErrnos = map[string]syscall.Errno{
+	"connection reset by peer": syscall.ECONNRESET,
+	"connection refused":       syscall.ECONNREFUSED,
+	"connection aborted":       syscall.ECONNABORTED,
+	"broken pipe":              syscall.EPIPE,
+	"no route to host":         syscall.EHOSTUNREACH,
+	"network is unreachable":   syscall.ENETUNREACH,
+	"host is down":             syscall.EHOSTDOWN,
+}
+
+// isRetryableNetError reports whether the error matches one of the conditions of
+// Options.RetryableNetErrors: a case-insensitive substring of the error message, an
+// errno of netErrnos or "timeout" for net.Error timeouts
+func isRetryableNetError(err error, conditions []string) bool {
+	message := strings.ToLower(err.Error())
+	for _, condition := range conditions {
+		condition = strings.ToLower(condition)
+		if condition == "" {
+			continue
+		}
+		if strings.Contains(message, condition) {
+			return true
+		}
+		if errno, ok := netErrnos[condition]; ok && errors.Is(err, errno) {
+			return true
+		}
+		var netErr net.Error
+		if condition == "timeout" && errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+	}
+	return false
+}
+
+// withBodyPeek returns a CheckRetry calling the policy with up to limit bytes
+// peeked from the response body within timeout
+func withBodyPeek(policy CheckRetryWithBody, limit int64, timeout time.Duration) CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		var bodyPeek []byte
+		if resp != nil && resp.Body != nil && resp.Body != http.NoBody {
+			bodyPeek = peekBody(resp, limit, timeout)
+		}
+		return policy(ctx, resp, err, bodyPeek)
+	}
+}
+
+// RetryOnStatusCodes provides a callback for Client.CheckRetry, which
+// will retry on connection errors and on responses whose status code is
+// one of the given codes. Any other response is returned to the caller.
+func RetryOnStatusCodes(codes ...int) CheckRetry {
+	statusCodes := make(map[int]struct{}, len(codes))
+	for _, code := range codes {
+		statusCodes[code] = struct{}{}
+	}
+
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		if err != nil || ctx.Err() != nil {
+			return CheckRecoverableErrors(ctx, resp, err)
+		}
+		if resp == nil {
+			return false, nil
+		}
+		_, ok := statusCodes[resp.StatusCode]
+		return ok, nil
+	}
+}
+
+// CombineRetryPolicies returns a CheckRetry that retries when any of the
+// given policies asks for a retry. When none of them does, the first error
+// reported by a policy (if any) is returned.
+func CombineRetryPolicies(policies ...CheckRetry) CheckRetry {
+	return func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		var firstErr error
+		for _, policy := range policies {
+			if policy == nil {
+				continue
+			}
+			retry, checkErr := policy(ctx, resp, err)
+			if retry {
+				return true, nil
+			}
+			if checkErr != nil && firstErr == nil {
+				firstErr = checkErr
+			}
+		}
+		return false, firstErr
+	}
+}
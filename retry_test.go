@@ -0,0 +1,580 @@
+package retryablehttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRetryOnStatusCodes(t *testing.T) {
+	policy := RetryOnStatusCodes(http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	ctx := context.Background()
+
+	for code, expected := range map[int]bool{
+		http.StatusTooManyRequests:     true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusInternalServerError: false,
+		http.StatusOK:                  false,
+	} {
+		retry, err := policy(ctx, &http.Response{StatusCode: code}, nil)
+		require.Nil(t, err)
+		require.Equal(t, expected, retry, "unexpected decision for status %d", code)
+	}
+
+	// transport errors are still retried
+	retry, err := policy(ctx, nil, errors.New("connection reset by peer"))
+	require.Nil(t, err)
+	require.True(t, retry)
+}
+
+func TestCombineRetryPolicies(t *testing.T) {
+	never := func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		return false, nil
+	}
+	policy := CombineRetryPolicies(never, RetryOnStatusCodes(http.StatusBadGateway), nil)
+
+	retry, err := policy(context.Background(), &http.Response{StatusCode: http.StatusBadGateway}, nil)
+	require.Nil(t, err)
+	require.True(t, retry)
+
+	retry, err = policy(context.Background(), &http.Response{StatusCode: http.StatusNotFound}, nil)
+	require.Nil(t, err)
+	require.False(t, retry)
+}
+
+func TestClientRetryOnStatusCodes_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     5,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	}
+	client := NewClient(options)
+
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 2, req.Metrics.Retries)
+}
+
+func TestDefaultRetryPolicyContextErrors(t *testing.T) {
+	policy := DefaultRetryPolicy()
+
+	retry, _ := policy(context.Background(), nil, fmt.Errorf("dial: %w", context.Canceled))
+	require.False(t, retry)
+	retry, _ = policy(context.Background(), nil, fmt.Errorf("dial: %w", context.DeadlineExceeded))
+	require.False(t, retry)
+	// per attempt client timeouts are retried
+	retry, _ = policy(context.Background(), nil, fmt.Errorf("context deadline exceeded (Client.Timeout exceeded while awaiting headers): %w", context.DeadlineExceeded))
+	require.True(t, retry)
+}
+
+func TestClientCancelledContext_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     5,
+	})
+	req, err := NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+
+	start := time.Now()
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, req.Metrics.Retries)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+func TestClientCancelledBackoff_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin: 30 * time.Second,
+		RetryWaitMax: 30 * time.Second,
+		RetryMax:     1,
+		Timeout:      time.Minute,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+	})
+
+	// cancelled during the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client.OnRetry = func(req *http.Request, attempt int, wait time.Duration, err error) {
+		time.AfterFunc(50*time.Millisecond, cancel)
+	}
+	req, err := NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	start := time.Now()
+	_, err = client.Do(req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, time.Since(start), time.Second)
+
+	// the deadline expires before the end of the backoff, the request gives up without retrying
+	var retries atomic.Int32
+	client.OnRetry = func(req *http.Request, attempt int, wait time.Duration, err error) {
+		retries.Add(1)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err = NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	start = time.Now()
+	_, err = client.Do(req)
+	var exhausted *RetriesExhaustedError
+	require.ErrorAs(t, err, &exhausted)
+	require.Equal(t, 1, exhausted.Attempts)
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, int32(0), retries.Load())
+	require.Equal(t, 0, req.Metrics.Retries)
+	require.Empty(t, req.Metrics.RetryReasons)
+
+	// the error handler gets the last response
+	client.ErrorHandler = func(resp *http.Response, err error, numTries int) (*http.Response, error) {
+		return resp, err
+	}
+	req, err = NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestRetryableErrorCallback_Do(t *testing.T) {
+	var calls atomic.Int32
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     3,
+		RetryableErrorCallback: func(err error) bool {
+			calls.Add(1)
+			return strings.Contains(err.Error(), "stopped after 10 redirects")
+		},
+	})
+
+	// too many redirects are terminal for the default policy
+	req, err := NewRequest(http.MethodGet, "http://127.0.0.1:8080/infiniteRedirects", nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.Equal(t, 3, req.Metrics.Retries)
+	require.Equal(t, int32(4), calls.Load())
+}
+
+func TestRetryableNetErrors_Do(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "read", Net: "tcp", Err: err}
+	}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"reset", opError(os.NewSyscallError("read", syscall.ECONNRESET)), true},
+		{"no route", opError(os.NewSyscallError("connect", syscall.EHOSTUNREACH)), true},
+		// matched by errno whatever the message
+		{"refused", fmt.Errorf("port closed or filtered: %w", syscall.ECONNREFUSED), true},
+		{"timeout", opError(os.ErrDeadlineExceeded), true},
+		{"substring", errors.New("proxy: upstream HANDSHAKE failed"), true},
+		{"broken pipe", opError(os.NewSyscallError("write", syscall.EPIPE)), false},
+		{"eof", io.ErrUnexpectedEOF, false},
+	}
+
+	client := NewClient(Options{
+		RetryWaitMin:       time.Millisecond,
+		RetryWaitMax:       time.Millisecond,
+		RetryMax:           2,
+		RetryableNetErrors: []string{"Connection reset by peer", "no route to host", "connection refused", "timeout", "upstream handshake"},
+	})
+	for _, test := range tests {
+		var attempts int
+		req, err := NewRequest(http.MethodGet, "http://127.0.0.1:8080/foo", nil)
+		require.Nil(t, err)
+		req.Transport = roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			attempts++
+			return nil, test.err
+		})
+		_, err = client.Do(req)
+		require.NotNil(t, err, test.name)
+		if test.retryable {
+			require.Equal(t, 3, attempts, test.name)
+			require.Equal(t, 2, req.Metrics.Retries, test.name)
+		} else {
+			require.Equal(t, 1, attempts, test.name)
+		}
+	}
+
+	// responses are still handled by the retry policy
+	client = NewClient(Options{
+		RetryWaitMin:       time.Millisecond,
+		RetryWaitMax:       time.Millisecond,
+		RetryMax:           2,
+		CheckRetry:         RetryOnStatusCodes(http.StatusServiceUnavailable),
+		RetryableNetErrors: []string{"connection reset by peer"},
+	})
+	var attempts int
+	req, err := NewRequest(http.MethodGet, "http://127.0.0.1:8080/foo", nil)
+	require.Nil(t, err)
+	req.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		attempts++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: r}, nil
+	})
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+func TestExponentialPerAttemptTimeout(t *testing.T) {
+	strategy := ExponentialPerAttemptTimeout(100 * time.Millisecond)
+
+	require.Equal(t, 100*time.Millisecond, strategy(0, time.Second))
+	require.Equal(t, 400*time.Millisecond, strategy(2, time.Second))
+	// capped at the client timeout
+	require.Equal(t, time.Second, strategy(5, time.Second))
+	require.Equal(t, time.Second, strategy(100, time.Second))
+}
+
+func TestPerAttemptTimeout_Do(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(150 * time.Millisecond):
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer ts.Close()
+
+	client := NewClient(Options{
+		RetryWaitMin:              10 * time.Millisecond,
+		RetryWaitMax:              10 * time.Millisecond,
+		RetryMax:                  5,
+		Timeout:                   5 * time.Second,
+		PerAttemptTimeoutStrategy: ExponentialPerAttemptTimeout(50 * time.Millisecond),
+	})
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+
+	// attempts get 50ms, 100ms then 200ms which is enough for the slow server
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, 2, req.Metrics.Retries)
+	require.Nil(t, req.Context().Err())
+}
+
+func TestErrorTypes_Do(t *testing.T) {
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+	})
+
+	_, err := client.Get("ftp://127.0.0.1/")
+	var schemeErr *UnsupportedSchemeError
+	require.ErrorAs(t, err, &schemeErr)
+	require.Equal(t, "ftp", schemeErr.Scheme)
+	require.Contains(t, err.Error(), `unsupported protocol scheme "ftp"`)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = io.Copy(io.Discard, io.LimitReader(conn, 1))
+			_, _ = conn.Write([]byte("HTTP/10.0 200 OK\r\nContent-Length: 0\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+	_, err = client.Get("http://" + listener.Addr().String())
+	var versionErr *UnsupportedHTTPVersionError
+	require.ErrorAs(t, err, &versionErr)
+	require.Equal(t, "HTTP/10.0", versionErr.Version)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	client.CheckRetry = RetryOnStatusCodes(http.StatusServiceUnavailable)
+	_, err = client.Get(ts.URL)
+	var exhaustedErr *RetriesExhaustedError
+	require.ErrorAs(t, err, &exhaustedErr)
+	require.Equal(t, 3, exhaustedErr.Attempts)
+	require.ErrorIs(t, err, &RetriesExhaustedError{})
+	require.Contains(t, err.Error(), "giving up after 3 attempts")
+
+	// only the connections closed once obtained are closed without response, not the
+	// ones closed in the tls handshake or the CONNECT of the proxy
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer closing.Close()
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+			// read all the client sent so that closing doesn't reset the connection
+			_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+			_, _ = io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+	closingURL, err := url.Parse("http://" + closing.Addr().String())
+	require.Nil(t, err)
+	plainClient := NewClient(Options{RetryMax: 0, HttpClient: &http.Client{Transport: &http.Transport{}}})
+	_, err = plainClient.Get(closingURL.String())
+	require.ErrorIs(t, err, ErrConnectionClosedWithoutResponse)
+	_, err = plainClient.Get("https://" + closingURL.Host)
+	require.ErrorIs(t, err, io.EOF)
+	require.NotErrorIs(t, err, ErrConnectionClosedWithoutResponse)
+	proxyClient := NewClient(Options{RetryMax: 0, HttpClient: &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(closingURL)}}})
+	_, err = proxyClient.Get("https://example.com")
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, ErrConnectionClosedWithoutResponse)
+}
+
+type testMetricsCollector struct {
+	mu       sync.Mutex
+	requests []string
+	retries  []string
+}
+
+func (c *testMetricsCollector) ObserveRequest(host string, status int, attempts int, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, fmt.Sprintf("%d %d", status, attempts))
+}
+
+func (c *testMetricsCollector) ObserveRetry(host string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retries = append(c.retries, reason)
+}
+
+func TestMetricsCollector_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	collector := &testMetricsCollector{}
+	client := NewClient(Options{
+		RetryWaitMin:     10 * time.Millisecond,
+		RetryWaitMax:     10 * time.Millisecond,
+		RetryMax:         3,
+		CheckRetry:       RetryOnStatusCodes(http.StatusServiceUnavailable),
+		MetricsCollector: collector,
+	})
+	resp, err := client.Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+
+	_, err = client.Get("http://127.0.0.1:8080/emptyResponse")
+	require.ErrorIs(t, err, ErrConnectionClosedWithoutResponse)
+
+	require.Equal(t, []string{"200 3", "0 4"}, collector.requests)
+	require.Equal(t, []string{"status_503", "status_503", "error", "error", "error"}, collector.retries)
+}
+
+func TestRetryReason(t *testing.T) {
+	tests := []struct {
+		resp        *http.Response
+		err         error
+		reason      string
+		description string
+	}{
+		{&http.Response{StatusCode: http.StatusServiceUnavailable}, nil, "status_503", "status 503"},
+		{nil, nil, "unknown", "unknown"},
+		{nil, &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timeout", "timeout"},
+		{nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, "error", "connection reset"},
+		{nil, fmt.Errorf("read: %w", ErrPartialResponse), "error", "partial response"},
+		{nil, &url.Error{Op: "Get", URL: "http://example.com", Err: errors.New("boom")}, "error", "boom"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.reason, retryReason(test.resp, test.err), test.description)
+		require.Equal(t, test.description, describeRetry(test.resp, test.err))
+	}
+}
+
+func TestTracer_Do(t *testing.T) {
+	var hits atomic.Int32
+	var traceparents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		if hits.Add(1) <= 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	client := NewClient(Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     3,
+		CheckRetry:   RetryOnStatusCodes(http.StatusServiceUnavailable),
+		Tracer:       provider.Tracer("retryablehttp"),
+	})
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Empty(t, req.Header.Get("traceparent"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 3)
+	parent := spans[2]
+	require.Equal(t, "HTTP GET", parent.Name())
+	require.Contains(t, parent.Attributes(), attribute.Int("http.response.status_code", http.StatusOK))
+	for i, span := range spans[:2] {
+		require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		require.Contains(t, span.Attributes(), attribute.Int("http.request.resend_count", i))
+		require.Contains(t, traceparents[i], span.SpanContext().SpanID().String())
+	}
+	require.Contains(t, spans[0].Attributes(), attribute.String("retry.reason", "status_503"))
+
+	// a traceparent set by the caller is kept and used as parent
+	traceparents = nil
+	userTraceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	req.Header.Set("traceparent", userTraceparent)
+	resp, err = client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, []string{userTraceparent}, traceparents)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", recorder.Ended()[4].SpanContext().TraceID().String())
+}
+
+func TestMaxResponseHeaderBytes_Do(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Set-Cookie", "token="+strings.Repeat("a", 8192))
+	}))
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 10 * time.Millisecond,
+		RetryMax:     2,
+	}
+	_, err := NewClient(options).Get(ts.URL)
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+	require.Equal(t, int32(1), hits.Load())
+
+	options.MaxResponseHeaderBytes = 16 << 10
+	resp, err := NewClient(options).Get(ts.URL)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Len(t, resp.Header.Get("Set-Cookie"), 8198)
+}
+
+func TestIdempotentOnlyRetryPolicy(t *testing.T) {
+	policy := IdempotentOnlyRetryPolicy(nil)
+	connErr := errors.New("connection reset by peer")
+
+	post := &retryAttempt{method: http.MethodPost, header: http.Header{}, tracked: true}
+	retry, err := policy(context.WithValue(context.Background(), retryAttemptKey{}, post), nil, connErr)
+	require.Nil(t, err)
+	// failed before obtaining a connection, nothing was written
+	require.True(t, retry)
+
+	post.gotConn.Store(true)
+	retry, _ = policy(context.WithValue(context.Background(), retryAttemptKey{}, post), nil, connErr)
+	require.False(t, retry)
+
+	post.header.Set("Idempotency-Key", "key")
+	retry, _ = policy(context.WithValue(context.Background(), retryAttemptKey{}, post), nil, connErr)
+	require.True(t, retry)
+
+	// without tracking the connection the request may have been written
+	untracked := &retryAttempt{method: http.MethodPost, header: http.Header{}}
+	retry, _ = policy(context.WithValue(context.Background(), retryAttemptKey{}, untracked), nil, connErr)
+	require.False(t, retry)
+}
+
+func TestNoRetryNonIdempotent_Do(t *testing.T) {
+	client := NewClient(Options{
+		RetryWaitMin:         10 * time.Millisecond,
+		RetryWaitMax:         10 * time.Millisecond,
+		RetryMax:             2,
+		NoRetryNonIdempotent: true,
+	})
+
+	for method, expectedRetries := range map[string]int{
+		http.MethodGet:   2,
+		http.MethodPost:  0,
+		http.MethodPatch: 0,
+	} {
+		req, err := NewRequest(method, "http://127.0.0.1:8080/emptyResponse", "body")
+		require.Nil(t, err)
+		_, err = client.Do(req)
+		require.NotNil(t, err)
+		require.Equal(t, expectedRetries, req.Metrics.Retries, method)
+	}
+
+	req, err := NewRequest(http.MethodPost, "http://127.0.0.1:8080/emptyResponse", "body")
+	require.Nil(t, err)
+	req.Header.Set("Idempotency-Key", "key")
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+	require.Equal(t, 2, req.Metrics.Retries)
+}
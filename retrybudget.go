@@ -0,0 +1,71 @@
+package retryablehttp
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// retryBudgetMaxTokens is the number of retries the budget holds at most, available
+// before enough requests were sent to earn them
+const retryBudgetMaxTokens = 10
+
+// RetryBudgetCollector is implemented by metrics collectors counting the retries
+// denied by the retry budget of the client
+type RetryBudgetCollector interface {
+	// ObserveRetryBudgetDenied is called when a retry is not made as the budget is exhausted
+	ObserveRetryBudgetDenied(host string)
+}
+
+// retryBudget is a token bucket earning ratio tokens per request, each retry costs one.
+// It follows the gRPC retry throttling model limiting the retries to a share of the requests.
+type retryBudget struct {
+	ratio float64
+
+	mu     sync.Mutex
+	tokens float64
+
+	denied atomic.Uint64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{ratio: ratio, tokens: retryBudgetMaxTokens}
+}
+
+// deposit credits the budget for a new request
+func (b *retryBudget) deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetMaxTokens)
+}
+
+// withdraw returns true if a retry fits in the budget, consuming its token
+func (b *retryBudget) withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		b.denied.Add(1)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// allowRetry returns true if the retry of the request fits in the retry budget of the client
+func (c *Client) allowRetry(req *Request) bool {
+	if c.retryBudget == nil || c.retryBudget.withdraw() {
+		return true
+	}
+	if collector, ok := c.options.MetricsCollector.(RetryBudgetCollector); ok {
+		collector.ObserveRetryBudgetDenied(req.Request.URL.Host)
+	}
+	return false
+}
+
+// RetryBudgetDenied returns the number of retries not made since the retry budget was
+// exhausted, 0 if RetryBudget is not set
+func (c *Client) RetryBudgetDenied() uint64 {
+	if c.retryBudget == nil {
+		return 0
+	}
+	return c.retryBudget.denied.Load()
+}
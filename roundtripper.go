@@ -0,0 +1,36 @@
+package retryablehttp
+
+import (
+	"net/http"
+)
+
+// RoundTripper implements http.RoundTripper by sending the requests through the
+// retry loop of Client, so that any http.Client can benefit from retries
+type RoundTripper struct {
+	// Client is the client sending the requests
+	Client *Client
+}
+
+// RoundTrip wraps the request in a Request with a reusable body and sends it with Client.Do.
+// The request context is propagated and the original request is not modified.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the body is read once in memory to be replayed on retries
+	clone := req.Clone(req.Context())
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	retryableReq, err := FromRequest(clone)
+	if err != nil {
+		return nil, err
+	}
+	return rt.Client.Do(retryableReq)
+}
+
+// StandardClient returns an http.Client whose transport sends the requests with the client,
+// for libraries accepting only a standard http.Client. Redirects and timeouts are handled by
+// the client.
+func (c *Client) StandardClient() *http.Client {
+	return &http.Client{
+		Transport: &RoundTripper{Client: c},
+	}
+}
@@ -0,0 +1,56 @@
+package retryablehttp
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClientClosed is returned by Client.Do once the client is shut down
+var ErrClientClosed = errors.New("retryablehttp: client closed")
+
+// shutdownState tracks the requests in-flight to wait for them on shutdown
+type shutdownState struct {
+	mu       sync.RWMutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+// begin registers a request in-flight, it returns false if the client is closed
+func (s *shutdownState) begin() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	s.inFlight.Add(1)
+	return true
+}
+
+// Shutdown closes the client, new requests fail with ErrClientClosed, and waits for the
+// requests in-flight to complete before closing the idle connections. A request is
+// in-flight until Do returns, reading the response body is up to the caller. If ctx
+// expires before, Shutdown returns its error while the requests in-flight go on.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.shutdown.mu.Lock()
+	c.shutdown.closed = true
+	c.shutdown.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.shutdown.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	c.HTTPClient.CloseIdleConnections()
+	c.HTTPClient2.CloseIdleConnections()
+	if c.HTTPClient3 != nil {
+		c.HTTPClient3.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package retryablehttp
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpFastOpenControl enables tcp fast open on the sockets of tcp dials, sending the
+// request with the syn to the hosts it already has a cookie of. Kernels not supporting
+// it (before 4.11) dial without it. It is a variable as it is nil on other platforms.
+var tcpFastOpenControl = func(network, address string, c syscall.RawConn) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil
+	}
+	return c.Control(func(fd uintptr) {
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package retryablehttp
+
+import "syscall"
+
+// tcpFastOpenControl is nil where tcp fast open can't be enabled on connecting sockets,
+// dials are left unchanged
+var tcpFastOpenControl func(network, address string, c syscall.RawConn) error
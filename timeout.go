@@ -0,0 +1,60 @@
+package retryablehttp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+// errAttemptTimeout marks errors caused by the expiry of a per attempt timeout,
+// which unlike the expiry of the request context are retryable
+var errAttemptTimeout = errors.New("per attempt timeout exceeded")
+
+// PerAttemptTimeoutStrategy specifies the timeout of each attempt given the attempt
+// number (0 for the initial request) and the client timeout. A zero duration
+// disables the per attempt timeout for that attempt.
+type PerAttemptTimeoutStrategy func(attemptNum int, timeout time.Duration) time.Duration
+
+// ExponentialPerAttemptTimeout provides a PerAttemptTimeoutStrategy where each attempt
+// gets twice the time of the previous one starting from base (base * 2^attemptNum),
+// limited by the client timeout.
+func ExponentialPerAttemptTimeout(base time.Duration) PerAttemptTimeoutStrategy {
+	return func(attemptNum int, timeout time.Duration) time.Duration {
+		mult := math.Pow(2, float64(attemptNum)) * float64(base)
+
+		attemptTimeout := time.Duration(mult)
+		if float64(attemptTimeout) != mult || (timeout > 0 && attemptTimeout > timeout) {
+			attemptTimeout = timeout
+		}
+		return attemptTimeout
+	}
+}
+
+// withAttemptTimeout sets the per attempt timeout on the request derived from ctx.
+// The returned cancel func must be called once the attempt response is consumed.
+func (c *Client) withAttemptTimeout(ctx context.Context, req *Request, attemptNum int) (context.Context, context.CancelFunc) {
+	if c.options.PerAttemptTimeoutStrategy == nil {
+		return nil, func() {}
+	}
+	timeout := c.options.PerAttemptTimeoutStrategy(attemptNum, c.options.Timeout)
+	if timeout <= 0 {
+		return nil, func() {}
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	req.Request = req.Request.WithContext(attemptCtx)
+	return attemptCtx, cancel
+}
+
+// cancelOnCloseBody releases the attempt context once the body is closed
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,280 @@
+package retryablehttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// generateTestCertificate returns a self signed certificate for the given common name
+func generateTestCertificate(t *testing.T, commonName string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificates_Do(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Client-CN", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin: 10 * time.Millisecond,
+		RetryWaitMax: 50 * time.Millisecond,
+		RetryMax:     1,
+	}
+
+	// handshake is rejected without a client certificate
+	client := NewClient(options)
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+
+	options.ClientCertificates = []tls.Certificate{generateTestCertificate(t, "retryablehttp-client")}
+	client = NewClient(options)
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "retryablehttp-client", resp.Header.Get("X-Client-CN"))
+}
+
+func TestNewClientWithError(t *testing.T) {
+	options := Options{ClientCertFile: "missing.pem", ClientKeyFile: "missing.key"}
+	client, err := NewClientWithError(options)
+	require.Nil(t, client)
+	require.NotNil(t, err)
+	require.Nil(t, NewClient(options))
+
+	client, err = NewClientWithError(Options{})
+	require.Nil(t, err)
+	require.NotNil(t, client)
+}
+
+func TestClientCertificatesZTLSFallback(t *testing.T) {
+	cert := generateTestCertificate(t, "retryablehttp-client")
+	config := defaultTLSConfig()
+	config.Certificates = []tls.Certificate{cert}
+
+	ztlsConfig := asZTLSConfig(config)
+	require.Len(t, ztlsConfig.Certificates, 1)
+	require.Equal(t, cert.Certificate, ztlsConfig.Certificates[0].Certificate)
+	require.Equal(t, cert.PrivateKey, ztlsConfig.Certificates[0].PrivateKey)
+}
+
+func TestTLSVersionsAndCiphers_Do(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-TLS-Version", tls.VersionName(r.TLS.Version))
+		w.Header().Set("X-TLS-Cipher", tls.CipherSuiteName(r.TLS.CipherSuite))
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	options := Options{
+		RetryWaitMin:    10 * time.Millisecond,
+		RetryWaitMax:    50 * time.Millisecond,
+		RetryMax:        1,
+		TLSMaxVersion:   tls.VersionTLS12,
+		TLSCipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	client := NewClient(options)
+	req, err := NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, "TLS 1.2", resp.Header.Get("X-TLS-Version"))
+	require.Equal(t, "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", resp.Header.Get("X-TLS-Cipher"))
+
+	// a tls 1.3 only client can't talk to a tls 1.2 server
+	client = NewClient(Options{RetryMax: 1, TLSMinVersion: tls.VersionTLS13})
+	req, err = NewRequest(http.MethodGet, ts.URL, nil)
+	require.Nil(t, err)
+	_, err = client.Do(req)
+	require.NotNil(t, err)
+}
+
+func TestDefaultTLSOptions(t *testing.T) {
+	options := Options{}
+	tlsConfig, err := options.tlsConfig()
+	require.Nil(t, err)
+	require.Nil(t, tlsConfig, "default options must keep the default transports")
+}
+
+func TestDisableZTLSFallback_Do(t *testing.T) {
+	// crypto/tls clients no longer offer rsa key exchange by default while ztls does
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	send := func(disableZTLSFallback *bool) error {
+		client := NewClient(Options{
+			RetryMax:            0,
+			Timeout:             5 * time.Second,
+			TLSMinVersion:       tls.VersionTLS10,
+			DisableZTLSFallback: disableZTLSFallback,
+		})
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	disable, enable := true, false
+	require.Nil(t, send(nil))
+	require.Nil(t, send(&enable))
+	require.NotNil(t, send(&disable))
+
+	// clients can enable the fallback disabled globally
+	DisableZTLSFallback = true
+	defer func() { DisableZTLSFallback = false }()
+	require.NotNil(t, send(nil))
+	require.Nil(t, send(&enable))
+}
+
+func TestTLSBackend_Do(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	rsaServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rsaServer.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	rsaServer.StartTLS()
+	defer rsaServer.Close()
+	plainServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer plainServer.Close()
+
+	client := NewClient(Options{Timeout: 5 * time.Second, TLSMinVersion: tls.VersionTLS10, CollectTLSBackend: true})
+	tlsBackend := func(url string) string {
+		req, err := NewRequest(http.MethodGet, url, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		return req.TLSBackend
+	}
+
+	require.Equal(t, TLSBackendCryptoTLS, tlsBackend(tlsServer.URL))
+	// reused connections report the backend as well
+	require.Equal(t, TLSBackendCryptoTLS, tlsBackend(tlsServer.URL))
+	require.Equal(t, TLSBackendZTLS, tlsBackend(rsaServer.URL))
+	require.Equal(t, "", tlsBackend(plainServer.URL))
+
+	// nothing is recorded by default
+	client = NewClient(Options{Timeout: 5 * time.Second})
+	require.Equal(t, "", tlsBackend(tlsServer.URL))
+}
+
+func TestTLSHandshakeTimeout_Do(t *testing.T) {
+	// the listener accepts connections but never answers the client hello
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client := NewClient(Options{
+		RetryMax:            0,
+		Timeout:             10 * time.Second,
+		TLSHandshakeTimeout: 500 * time.Millisecond,
+	})
+	start := time.Now()
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), 5*time.Second, "the handshake must time out before the request")
+}
+
+func TestTLSVerifyCallback_Do(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	fingerprint := sha256.Sum256(ts.Certificate().Raw)
+
+	send := func(options Options) error {
+		options.RetryMax = 0
+		options.Timeout = 5 * time.Second
+		resp, err := NewClient(options).Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	pinning := func(expected [32]byte) func(cs tls.ConnectionState) error {
+		return func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || sha256.Sum256(cs.PeerCertificates[0].Raw) != expected {
+				return errors.New("unexpected certificate fingerprint")
+			}
+			return nil
+		}
+	}
+
+	require.Nil(t, send(Options{TLSVerifyCallback: pinning(fingerprint)}))
+	err := send(Options{TLSVerifyCallback: pinning([32]byte{})})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unexpected certificate fingerprint")
+	// the certificate of the test server is self signed
+	require.NotNil(t, send(Options{VerifyCertificates: true}))
+
+	// connections of the ztls fallback are verified as well
+	rsaServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rsaServer.TLS = &tls.Config{
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	rsaServer.StartTLS()
+	defer rsaServer.Close()
+	req, err := NewRequest(http.MethodGet, rsaServer.URL, nil)
+	require.Nil(t, err)
+	client := NewClient(Options{Timeout: 5 * time.Second, CollectTLSBackend: true, TLSVerifyCallback: pinning(sha256.Sum256(rsaServer.Certificate().Raw))})
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, TLSBackendZTLS, req.TLSBackend)
+	client = NewClient(Options{RetryMax: 0, Timeout: 5 * time.Second, TLSVerifyCallback: pinning([32]byte{})})
+	_, err = client.Get(rsaServer.URL)
+	require.NotNil(t, err)
+}
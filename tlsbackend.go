@@ -0,0 +1,32 @@
+package retryablehttp
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+
+	ztls "github.com/zmap/zcrypto/tls"
+)
+
+const (
+	// TLSBackendCryptoTLS means the tls handshake was performed by crypto/tls
+	TLSBackendCryptoTLS = "crypto/tls"
+	// TLSBackendZTLS means the tls handshake was performed by the ztls fallback
+	TLSBackendZTLS = "ztls"
+)
+
+// wrapContextWithTLSBackend installs the trace recording the tls stack serving the
+// connection of the request, including reused connections
+func wrapContextWithTLSBackend(req *Request) {
+	req.TLSBackend = ""
+	trace := &httptrace.ClientTrace{
+		GotConn: func(connInfo httptrace.GotConnInfo) {
+			switch connInfo.Conn.(type) {
+			case *tls.Conn:
+				req.TLSBackend = TLSBackendCryptoTLS
+			case *ztls.Conn:
+				req.TLSBackend = TLSBackendZTLS
+			}
+		},
+	}
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
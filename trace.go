@@ -1,6 +1,10 @@
 package retryablehttp
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
 	"time"
 )
 
@@ -24,3 +28,84 @@ type TraceInfo struct {
 	WroteHeaders         TraceEventInfo
 	WroteRequest         TraceEventInfo
 }
+
+// Trace is the timing of the final attempt of a request, events are reported as the time
+// elapsed since the attempt started and are zero when they didn't happen, ex. reused
+// connections have no dns lookup nor connect. Dials made by fastdialer don't report the
+// dns lookup and tls handshakes made by the transport dialers are not reported.
+type Trace struct {
+	DNSStart             time.Duration
+	DNSDone              time.Duration
+	ConnectStart         time.Duration
+	ConnectDone          time.Duration
+	TLSHandshakeDone     time.Duration
+	WroteRequest         time.Duration
+	GotFirstResponseByte time.Duration
+	// Reused reports whether the attempt was sent over a reused connection
+	Reused bool
+}
+
+// String formats the events of the trace, one per line
+func (t *Trace) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Reused connection: %v\n", t.Reused)
+	events := []struct {
+		name    string
+		elapsed time.Duration
+	}{
+		{"DNS start", t.DNSStart},
+		{"DNS done", t.DNSDone},
+		{"Connect start", t.ConnectStart},
+		{"Connect done", t.ConnectDone},
+		{"TLS handshake done", t.TLSHandshakeDone},
+		{"Wrote request", t.WroteRequest},
+		{"Got first response byte", t.GotFirstResponseByte},
+	}
+	for _, event := range events {
+		if event.elapsed > 0 {
+			fmt.Fprintf(&sb, "%s: %v\n", event.name, event.elapsed)
+		}
+	}
+	return sb.String()
+}
+
+// wrapContextWithTimings collects the timing of the attempt in req.Metrics.Trace
+func wrapContextWithTimings(req *Request) {
+	timings := &Trace{}
+	start := time.Now()
+	elapsed := func(d *time.Duration) {
+		*d = time.Since(start)
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			elapsed(&timings.DNSStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			elapsed(&timings.DNSDone)
+		},
+		ConnectStart: func(network, addr string) {
+			elapsed(&timings.ConnectStart)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				elapsed(&timings.ConnectDone)
+			}
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				elapsed(&timings.TLSHandshakeDone)
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timings.Reused = info.Reused
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			elapsed(&timings.WroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			elapsed(&timings.GotFirstResponseByte)
+		},
+	}
+	req.Metrics.Trace = timings
+	req.Request = req.Request.WithContext(httptrace.WithClientTrace(req.Request.Context(), trace))
+}
@@ -1,8 +1,11 @@
 package retryablehttp
 
 import (
+	"bytes"
 	"io"
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	readerutil "github.com/projectdiscovery/utils/reader"
 )
@@ -15,11 +18,33 @@ const (
 
 // Discard is an helper function that discards the response body and closes the underlying connection
 func Discard(req *Request, resp *http.Response, RespReadLimit int64) {
-	_, err := io.Copy(io.Discard, io.LimitReader(resp.Body, RespReadLimit))
+	_, _ = DiscardN(req, resp, RespReadLimit)
+}
+
+// DiscardN is like Discard but returns the number of bytes discarded, which are
+// added to req.Metrics.DrainedBytes, and the error of reading the body
+func DiscardN(req *Request, resp *http.Response, RespReadLimit int64) (int64, error) {
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, RespReadLimit))
+	req.Metrics.DrainedBytes += n
+	if err != nil {
+		req.Metrics.DrainErrors++
+	}
+	resp.Body.Close()
+	return n, err
+}
+
+// ReadAndReuse is like Discard but keeps the body: it reads up to RespReadLimit bytes of the
+// response body, closes the underlying body to free the connection and replaces it with
+// a reader over the bytes read, which are returned as well.
+func ReadAndReuse(req *Request, resp *http.Response, RespReadLimit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(resp.Body, RespReadLimit))
 	if err != nil {
 		req.Metrics.DrainErrors++
 	}
 	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(buf.Bytes()))
+	return buf.Bytes(), err
 }
 
 // getLength returns length of a Reader efficiently
@@ -71,3 +96,55 @@ func getReusableBodyandContentLength(rawBody interface{}) (*readerutil.ReusableR
 
 	return bodyReader, contentLength, nil
 }
+
+// streamingBody is a non rewindable request body which records whether
+// any byte has been read from it
+type streamingBody struct {
+	reader   io.Reader
+	consumed atomic.Bool
+	// the transports close the body of failed attempts, even those which can be
+	// retried, so the reader is only closed once the request is done
+	done       atomic.Bool
+	closed     atomic.Bool
+	closeOnce  sync.Once
+	closeError error
+}
+
+func (s *streamingBody) Read(p []byte) (int, error) {
+	n, err := s.reader.Read(p)
+	if n > 0 {
+		s.consumed.Store(true)
+	}
+	return n, err
+}
+
+// Close closes the reader once the request is done, until then it's deferred to finish
+func (s *streamingBody) Close() error {
+	s.closed.Store(true)
+	if s.done.Load() {
+		return s.closeReader()
+	}
+	return nil
+}
+
+// reset forgets the close of the previous attempt
+func (s *streamingBody) reset() {
+	s.closed.Store(false)
+}
+
+// finish marks the request done, closing the reader if the last attempt closed the body
+func (s *streamingBody) finish() {
+	s.done.Store(true)
+	if s.closed.Load() {
+		_ = s.closeReader()
+	}
+}
+
+func (s *streamingBody) closeReader() error {
+	s.closeOnce.Do(func() {
+		if closer, ok := s.reader.(io.Closer); ok {
+			s.closeError = closer.Close()
+		}
+	})
+	return s.closeError
+}
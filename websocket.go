@@ -0,0 +1,210 @@
+package retryablehttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// websocketGUID is the key suffix used to compute Sec-WebSocket-Accept (RFC 6455)
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// websocketErrorBodyLimit is the maximum body size read from rejected handshakes
+	websocketErrorBodyLimit = 4096
+)
+
+// ErrBadHandshake is returned when the server doesn't accept the websocket upgrade
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// DialWebSocket performs the websocket opening handshake with the given ws:// or wss:// url
+// over the client dialers and returns the upgraded connection, left to the caller to frame.
+// Retries apply to the handshake only.
+func (c *Client) DialWebSocket(rawURL string, header http.Header) (net.Conn, *http.Response, error) {
+	return c.DialWebSocketContext(context.Background(), rawURL, header)
+}
+
+// DialWebSocketContext is like DialWebSocket with a context cancelling the handshake and the
+// wait between its retries. The dial is in-flight for Shutdown until it returns.
+func (c *Client) DialWebSocketContext(ctx context.Context, rawURL string, header http.Header) (net.Conn, *http.Response, error) {
+	if !c.shutdown.begin() {
+		return nil, nil, ErrClientClosed
+	}
+	defer c.shutdown.inFlight.Done()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, nil, &UnsupportedSchemeError{Scheme: u.Scheme, Err: fmt.Errorf("websocket: unsupported protocol scheme %q", u.Scheme)}
+	}
+
+	for i := 0; ; i++ {
+		conn, resp, err := c.websocketHandshake(ctx, u, header)
+		if err == nil {
+			return conn, resp, nil
+		}
+		if errors.Is(err, ErrBadHandshake) {
+			return nil, resp, err
+		}
+		if ctx.Err() != nil {
+			return nil, resp, ctx.Err()
+		}
+		if checkOK, _ := c.CheckRetry(ctx, resp, err); !checkOK || i >= c.options.RetryMax {
+			return nil, resp, err
+		}
+		timer := time.NewTimer(c.Backoff(c.options.RetryWaitMin, c.options.RetryWaitMax, i, resp))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, resp, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// websocketHandshake dials the url and sends the upgrade request
+func (c *Client) websocketHandshake(ctx context.Context, u *url.URL, header http.Header) (net.Conn, *http.Response, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	dial, dialTLS := c.transportDialers()
+	addr := hostPortKey(u)
+	var conn net.Conn
+	var err error
+	if u.Scheme == "https" {
+		conn, err = dialTLS(ctx, "tcp", addr)
+	} else {
+		conn, err = dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// a cancelled context interrupts the handshake reads and writes
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	keyBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, keyBytes); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := c.writeRequest(conn, req); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(resp.Header, "Connection", "upgrade") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		// keep the body of the rejection readable once the connection is closed
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, websocketErrorBodyLimit))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		conn.Close()
+		return nil, resp, ErrBadHandshake
+	}
+	if !stop() {
+		conn.Close()
+		return nil, nil, ctx.Err()
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: br}, resp, nil
+}
+
+// transportDialers returns the dialers of the client transport, or the default ones
+func (c *Client) transportDialers() (dial, dialTLS func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	dial = dialContext
+	tlsConfig := defaultTLSConfig()
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig
+	}
+	if transport, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+		if transport.DialContext != nil {
+			dial = transport.DialContext
+		}
+		if transport.DialTLSContext != nil {
+			return dial, transport.DialTLSContext
+		}
+		if transport.TLSClientConfig != nil {
+			tlsConfig = transport.TLSClientConfig
+		}
+	}
+	return dial, ztlsFallbackDialTLSContext(dial, tlsConfig, c.options.DisableZTLSFallback, c.options.tlsHandshakeTimeout())
+}
+
+// websocketAccept returns the expected Sec-WebSocket-Accept for the key
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerContainsToken reports whether the comma separated header values contain the token
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bufferedConn reads first the bytes buffered while reading the handshake response
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}